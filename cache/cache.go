@@ -0,0 +1,152 @@
+// Package cache has stores of smtpd and workers, which are shared by
+// all falcon nodes in redis. In-memory implementations are used if
+// redis is disabled, so a single node runs without it.
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/storage"
+)
+
+const (
+	INBOX_SETTINGS_TTL  = 14400 // 4 hours
+	INBOX_SETTINGS_SIZE = 10000 // inboxes in memory
+	CAMPAIGN_TTL        = 20    // seconds
+	CAMPAIGN_MAX_EMAILS = 10    // more emails in TTL are campaign
+	CAMPAIGN_SWEEP      = 60    // seconds between removals of expired counters
+	DNSBL_SIZE          = 10000 // block list answers in memory
+)
+
+// SettingsCache keeps inbox settings from database
+type SettingsCache interface {
+	GetInboxSettings(mailboxID int) (storage.InboxSettings, bool)
+	StoreInboxSettings(mailboxID int, inboxSettings storage.InboxSettings)
+}
+
+// FaultsCache keeps fault rules of inboxes from database, empty rules
+// are cached too
+type FaultsCache interface {
+	GetInboxFaults(mailboxID int) ([]storage.FaultRule, bool)
+	StoreInboxFaults(mailboxID int, rules []storage.FaultRule)
+}
+
+// CampaignCounter counts emails of inbox, mass mailing is not scanned
+type CampaignCounter interface {
+	IsNotSpamAttackCampaign(mailboxID int) bool
+}
+
+// in-memory settings cache
+
+type MemorySettingsCache struct {
+	lru *LRU
+}
+
+func NewMemorySettingsCache() *MemorySettingsCache {
+	return &MemorySettingsCache{lru: NewLRU(INBOX_SETTINGS_SIZE, INBOX_SETTINGS_TTL*time.Second)}
+}
+
+func (c *MemorySettingsCache) GetInboxSettings(mailboxID int) (storage.InboxSettings, bool) {
+	value, ok := c.lru.Get(fmt.Sprintf("%d", mailboxID))
+	if !ok {
+		return storage.InboxSettings{}, false
+	}
+	return value.(storage.InboxSettings), true
+}
+
+func (c *MemorySettingsCache) StoreInboxSettings(mailboxID int, inboxSettings storage.InboxSettings) {
+	c.lru.Set(fmt.Sprintf("%d", mailboxID), inboxSettings)
+}
+
+// in-memory fault rules cache
+
+type MemoryFaultsCache struct {
+	lru *LRU
+}
+
+func NewMemoryFaultsCache() *MemoryFaultsCache {
+	return &MemoryFaultsCache{lru: NewLRU(INBOX_SETTINGS_SIZE, INBOX_SETTINGS_TTL*time.Second)}
+}
+
+func (c *MemoryFaultsCache) GetInboxFaults(mailboxID int) ([]storage.FaultRule, bool) {
+	value, ok := c.lru.Get(fmt.Sprintf("%d", mailboxID))
+	if !ok {
+		return nil, false
+	}
+	return value.([]storage.FaultRule), true
+}
+
+func (c *MemoryFaultsCache) StoreInboxFaults(mailboxID int, rules []storage.FaultRule) {
+	c.lru.Set(fmt.Sprintf("%d", mailboxID), rules)
+}
+
+// in-memory block list answers, empty codes mean "not listed"
+
+type MemoryDnsblCache struct {
+	lru *LRU
+}
+
+func NewMemoryDnsblCache(ttl time.Duration) *MemoryDnsblCache {
+	return &MemoryDnsblCache{lru: NewLRU(DNSBL_SIZE, ttl)}
+}
+
+func (c *MemoryDnsblCache) Get(query string) ([]string, bool) {
+	value, ok := c.lru.Get(query)
+	if !ok {
+		return nil, false
+	}
+	return value.([]string), true
+}
+
+func (c *MemoryDnsblCache) Set(query string, codes []string) {
+	c.lru.Set(query, codes)
+}
+
+// in-memory campaign counter, counter expires TTL after last email,
+// like INCR and EXPIRE in redis
+
+type MemoryCampaignCounter struct {
+	mu        sync.Mutex
+	counts    map[int]*campaignCount
+	lastSweep time.Time
+}
+
+type campaignCount struct {
+	count   int
+	expires time.Time
+}
+
+func NewMemoryCampaignCounter() *MemoryCampaignCounter {
+	return &MemoryCampaignCounter{counts: make(map[int]*campaignCount), lastSweep: time.Now()}
+}
+
+func (c *MemoryCampaignCounter) IsNotSpamAttackCampaign(mailboxID int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	counter, ok := c.counts[mailboxID]
+	if !ok || now.After(counter.expires) {
+		counter = &campaignCount{}
+		c.counts[mailboxID] = counter
+	}
+	counter.count++
+	counter.expires = now.Add(CAMPAIGN_TTL * time.Second)
+	return counter.count < CAMPAIGN_MAX_EMAILS
+}
+
+// remove expired counters, so map doesn't grow
+
+func (c *MemoryCampaignCounter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < CAMPAIGN_SWEEP*time.Second {
+		return
+	}
+	c.lastSweep = now
+	for id, counter := range c.counts {
+		if now.After(counter.expires) {
+			delete(c.counts, id)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU(2, time.Minute)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	// a is recently used, b is removed
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("a not found")
+	}
+	c.Set("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b not removed")
+	}
+	if value, ok := c.Get("c"); !ok || value.(int) != 3 {
+		t.Errorf("c = %v, %v", value, ok)
+	}
+	if c.Len() != 2 {
+		t.Errorf("len = %d", c.Len())
+	}
+	c.SetWithTTL("a", 4, -time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("expired a found")
+	}
+	if c.Len() != 1 {
+		t.Errorf("len after expire = %d", c.Len())
+	}
+}
+
+func TestMemoryCampaignCounter(t *testing.T) {
+	c := NewMemoryCampaignCounter()
+	for i := 1; i < CAMPAIGN_MAX_EMAILS; i++ {
+		if !c.IsNotSpamAttackCampaign(1) {
+			t.Fatalf("email %d is campaign", i)
+		}
+	}
+	if c.IsNotSpamAttackCampaign(1) {
+		t.Errorf("email %d is not campaign", CAMPAIGN_MAX_EMAILS)
+	}
+	if !c.IsNotSpamAttackCampaign(2) {
+		t.Errorf("other inbox is campaign")
+	}
+	// expired counter starts again before it is swept
+	c.counts[1].expires = time.Now().Add(-time.Second)
+	if !c.IsNotSpamAttackCampaign(1) {
+		t.Errorf("expired counter is campaign")
+	}
+	c.counts[2].expires = time.Now().Add(-time.Second)
+	c.lastSweep = time.Now().Add(-CAMPAIGN_SWEEP * time.Second)
+	c.IsNotSpamAttackCampaign(1)
+	if _, ok := c.counts[2]; ok {
+		t.Errorf("expired counter is not swept")
+	}
+}
@@ -18,16 +18,18 @@ var (
 )
 
 type Clamav struct {
-	config   *config.Config
-	RawEmail []byte
+	config    *config.Config
+	RawEmail  io.ReaderAt
+	EmailSize int64
 }
 
 // check email for viruses by clamav
 
-func CheckEmailForViruses(config *config.Config, email []byte) (string, error) {
+func CheckEmailForViruses(config *config.Config, email io.ReaderAt, size int64) (string, error) {
 	clamav := &Clamav{
-		config:   config,
-		RawEmail: email,
+		config:    config,
+		RawEmail:  email,
+		EmailSize: size,
 	}
 	output, err := clamav.checkEmail()
 	if err != nil {
@@ -46,7 +48,7 @@ func (ss *Clamav) checkEmail() ([]string, error) {
 	}
 	defer conn.Close()
 	// check email
-	if len(ss.RawEmail) <= 0 {
+	if ss.EmailSize <= 0 {
 		return dataArrays, nil
 	}
 	// write headers
@@ -54,22 +56,21 @@ func (ss *Clamav) checkEmail() ([]string, error) {
 	if err != nil {
 		return dataArrays, err
 	}
-	chunkPos := 0
+	// email is read in chunks
+	emailReader := io.NewSectionReader(ss.RawEmail, 0, ss.EmailSize)
+	chunk := make([]byte, CHUNK_SIZE)
 	for {
-		if chunkPos+CHUNK_SIZE >= len(ss.RawEmail)-1 {
-			data := ss.RawEmail[chunkPos : len(ss.RawEmail)-1]
-			err = sendChunkOfData(conn, data)
-			if err != nil {
+		n, err := io.ReadFull(emailReader, chunk)
+		if n > 0 {
+			if err := sendChunkOfData(conn, chunk[:n]); err != nil {
 				return dataArrays, err
 			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
-		} else {
-			data := ss.RawEmail[chunkPos : chunkPos+CHUNK_SIZE]
-			err = sendChunkOfData(conn, data)
-			if err != nil {
-				return dataArrays, err
-			}
-			chunkPos = chunkPos + CHUNK_SIZE + 1
+		}
+		if err != nil {
+			return dataArrays, err
 		}
 	}
 	// write end
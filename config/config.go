@@ -3,11 +3,19 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/dnsbl"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/ratelimit"
+	"github.com/Polymail/go-falcon/resolver"
 	"github.com/Polymail/go-falcon/storage"
 	"github.com/garyburd/redigo/redis"
+	"gopkg.in/yaml.v2"
 )
 
 // Config represents the supported configuration options for a falcon,
@@ -19,33 +27,63 @@ const (
 	protocolLmtp protocolType = "lmtp"
 )
 
+const (
+	EMAIL_QUEUE_SIZE = 200 // emails waiting for storage workers
+)
+
 type Config struct {
 	Adapter struct {
-		Protocol      protocolType
-		Host          string
-		Port          int
-		Hostname      string
-		Auth          bool
-		Tls           bool
-		Ssl_Hostname  string
-		Ssl_Pub_Key   string
-		Ssl_Prv_Key   string
-		Welcome_Msg   string
-		Max_Mail_Size int
-		Rate_Limit    int
-		Workers_Size  int
+		Protocol         protocolType
+		Host             string
+		Port             int
+		Unix_Socket      string
+		Hostname         string
+		Auth             bool
+		Tls              bool
+		Tls_Port         int // implicit TLS (SMTPS) port, 0 if disabled
+		Ssl_Hostname     string
+		Ssl_Pub_Key      string
+		Ssl_Prv_Key      string
+		Welcome_Msg      string
+		Max_Mail_Size    int
+		Memory_Mail_Size int    // bigger emails are received to temp files
+		Temp_Dir         string // directory of temp files, system default if empty
+		Rate_Limit       int
+		Workers_Size     int
 	}
 	Storage            *storage.StorageConfig
 	Email_Address_Mode struct {
 		Enabled bool
 		Domains []string
 	}
+	Spool struct {
+		Enabled      bool
+		Directory    string
+		Max_Attempts int // storing attempts, then entry is moved to failed directory
+		Retry_Delay  int // seconds before first retry, doubled on every attempt
+	}
+	Data struct {
+		Bare_Line_Endings string // normalize or reject bare CR and LF in DATA
+		Max_Line_Length   int    // characters without CRLF
+		Max_Headers       int    // header fields of email
+	}
+	Backpressure struct {
+		Queue_High_Water int // queued emails, new MAIL transactions are refused above it
+		Spool_High_Water int // spool entries, which are not stored yet
+		Queue_Timeout    int // seconds end of DATA waits for free place in queue
+	}
+	Stats struct {
+		Enabled bool // queue depth and worker lag as JSON over http
+		Host    string
+		Port    int
+	}
 	Pop3 struct {
 		Enabled      bool
 		Host         string
 		Port         int
 		Hostname     string
 		Tls          bool
+		Tls_Port     int // implicit TLS (POP3S) port, 0 if disabled
 		Ssl_Hostname string
 		Ssl_Pub_Key  string
 		Ssl_Prv_Key  string
@@ -62,6 +100,45 @@ type Config struct {
 		Port    int
 		Timeout int
 	}
+	Dns struct {
+		Server  string // "host:port", system resolver if empty
+		Timeout int    // seconds for one lookup
+	}
+	Spf struct {
+		Enabled bool
+	}
+	Dkim struct {
+		Enabled bool
+	}
+	Dmarc struct {
+		Enabled bool
+	}
+	Dnsbl struct {
+		Enabled      bool
+		Zones        []dnsbl.Zone
+		Reject_Score int // reject with 554 if score reaches it, 0 to disable
+		Tag_Score    int // add X-Falcon-Dnsbl header if score reaches it, 0 to disable
+		Cache_Ttl    int // seconds to keep answers in redis or memory
+	}
+	Greylisting struct {
+		Enabled       bool
+		Delay         int // seconds before retry is accepted
+		Retry_Window  int // seconds to wait for retry of unseen triplet
+		Whitelist_Ttl int // seconds to accept triplet after successful retry
+	}
+	Rate_Limits struct {
+		Policies []ratelimit.Policy // inbox per second limit of settings if empty
+	}
+	Tarpit struct {
+		Enabled          bool
+		Command_Delays   map[string]int // milliseconds by command, "connect" for greeting
+		Error_Delay      int            // milliseconds added after every protocol error
+		Auth_Error_Delay int            // milliseconds added after every failed auth
+		Max_Delay        int            // milliseconds, limit of one reply delay
+	}
+	Faults struct {
+		Enabled bool // per inbox fault rules from storage.faults_sql
+	}
 	Proxy struct {
 		Enabled      bool
 		Proxy_Mode   bool
@@ -72,6 +149,11 @@ type Config struct {
 			Smtp []int
 			Pop3 []int
 		}
+		Trusted_Networks []string // networks allowed to send XCLIENT, loopback if empty
+	}
+	Proxy_Protocol struct {
+		Enabled          bool
+		Trusted_Networks []string
 	}
 	Redis struct {
 		Enabled       bool
@@ -87,15 +169,36 @@ type Config struct {
 	Log struct {
 		Debug bool
 	}
-	DbPool         *storage.DBConn
-	RedisPool      *redis.Pool
-	SmtpPortRanges []int
-	Pop3PortRanges []int
+	DbPool          *storage.DBConn   `yaml:"-"`
+	RedisPool       *redis.Pool       `yaml:"-"`
+	SmtpPortRanges  []int             `yaml:"-"`
+	Pop3PortRanges  []int             `yaml:"-"`
+	ProxyNetworks   []*net.IPNet      `yaml:"-"`
+	XclientNetworks []*net.IPNet      `yaml:"-"`
+	Resolver        resolver.Resolver `yaml:"-"`
+	// inbox lookup of email address mode, database by default
+	AddressMode storage.AddressModeFinder `yaml:"-"`
+	// stores are in memory, redisworker replaces them if redis is enabled
+	SettingsCache   cache.SettingsCache   `yaml:"-"`
+	FaultsCache     cache.FaultsCache     `yaml:"-"`
+	CampaignCounter cache.CampaignCounter `yaml:"-"`
+	RateLimiter     ratelimit.Limiter     `yaml:"-"`
+}
+
+// IsLmtp returns true if adapter speak LMTP instead of SMTP
+func (config *Config) IsLmtp() bool {
+	return config.Adapter.Protocol == protocolLmtp
 }
 
 // NewConfig returns a new Config without any options.
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		Storage:         &storage.StorageConfig{},
+		SettingsCache:   cache.NewMemorySettingsCache(),
+		FaultsCache:     cache.NewMemoryFaultsCache(),
+		CampaignCounter: cache.NewMemoryCampaignCounter(),
+		RateLimiter:     ratelimit.NewMemoryLimiter(),
+	}
 }
 
 // ReadEnvirons reads the juju config.yml file
@@ -113,6 +216,11 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	e.setDefaultValues()
+	err = e.validate()
+	if err != nil {
+		log.Errorf("invalid config file %q: %v", filename, err)
+		return nil, err
+	}
 	err = e.initDbPool()
 	if err != nil {
 		return nil, err
@@ -120,13 +228,14 @@ func ReadConfig(filename string) (*Config, error) {
 	if e.Redis.Enabled {
 		e.initRedisPool()
 	}
+	e.Resolver = resolver.NewDNSResolver(e.Dns.Server, time.Duration(e.Dns.Timeout)*time.Second)
 	return e, nil
 }
 
 // setDefaultValues for yaml config
 func (config *Config) setDefaultValues() {
 	// default for Adapter
-	if config.Adapter.Protocol != protocolSmtp && config.Adapter.Protocol != protocolLmtp {
+	if config.Adapter.Protocol == "" {
 		config.Adapter.Protocol = protocolSmtp
 	}
 	if config.Adapter.Host == "" {
@@ -141,6 +250,9 @@ func (config *Config) setDefaultValues() {
 	if config.Adapter.Max_Mail_Size <= 0 || config.Adapter.Max_Mail_Size > 99999999 {
 		config.Adapter.Max_Mail_Size = 10240000
 	}
+	if config.Adapter.Memory_Mail_Size <= 0 {
+		config.Adapter.Memory_Mail_Size = mailbody.DEFAULT_MEMORY_SIZE
+	}
 	if config.Adapter.Rate_Limit <= 0 {
 		config.Adapter.Rate_Limit = 2
 	}
@@ -160,6 +272,71 @@ func (config *Config) setDefaultValues() {
 	if config.Storage.Pool_Idle < 1 {
 		config.Storage.Pool_Idle = 2
 	}
+	// default for Dns
+	if config.Dns.Timeout <= 0 {
+		config.Dns.Timeout = 5
+	}
+	// default for Dnsbl
+	for i := range config.Dnsbl.Zones {
+		if config.Dnsbl.Zones[i].Weight == 0 {
+			config.Dnsbl.Zones[i].Weight = 1
+		}
+	}
+	if config.Dnsbl.Cache_Ttl <= 0 {
+		config.Dnsbl.Cache_Ttl = 3600
+	}
+	// default for Greylisting
+	if config.Greylisting.Delay <= 0 {
+		config.Greylisting.Delay = 300
+	}
+	if config.Greylisting.Retry_Window <= 0 {
+		config.Greylisting.Retry_Window = 14400
+	}
+	if config.Greylisting.Whitelist_Ttl <= 0 {
+		config.Greylisting.Whitelist_Ttl = 3110400
+	}
+	// default for Spool
+	if config.Spool.Max_Attempts <= 0 {
+		config.Spool.Max_Attempts = 5
+	}
+	if config.Spool.Retry_Delay <= 0 {
+		config.Spool.Retry_Delay = 60
+	}
+	// default for Data
+	if config.Data.Bare_Line_Endings == "" {
+		config.Data.Bare_Line_Endings = "normalize"
+	}
+	if config.Data.Max_Line_Length <= 0 {
+		config.Data.Max_Line_Length = 998
+	}
+	if config.Data.Max_Headers <= 0 {
+		config.Data.Max_Headers = 1000
+	}
+	// default for Backpressure
+	if config.Backpressure.Queue_High_Water <= 0 {
+		config.Backpressure.Queue_High_Water = 150
+	}
+	if config.Backpressure.Spool_High_Water <= 0 {
+		config.Backpressure.Spool_High_Water = 1000
+	}
+	if config.Backpressure.Queue_Timeout <= 0 {
+		config.Backpressure.Queue_Timeout = 20
+	}
+	// default for Stats
+	if config.Stats.Host == "" {
+		config.Stats.Host = "localhost"
+	}
+	if config.Stats.Port <= 0 {
+		config.Stats.Port = 2527
+	}
+	// default for Rate_Limits
+	if len(config.Rate_Limits.Policies) == 0 {
+		config.Rate_Limits.Policies = []ratelimit.Policy{{Scope: ratelimit.SCOPE_INBOX, Window: "second"}}
+	}
+	// default for Tarpit
+	if config.Tarpit.Max_Delay <= 0 {
+		config.Tarpit.Max_Delay = 20000
+	}
 	// default for Proxy
 	if config.Proxy.Host == "" {
 		config.Proxy.Host = "localhost"
@@ -185,6 +362,48 @@ func (config *Config) setDefaultValues() {
 	if len(config.Proxy.Client_Ports.Pop3) > 0 {
 		config.Pop3PortRanges = append(config.Pop3PortRanges, config.Proxy.Client_Ports.Pop3...)
 	}
+	// trusted networks for XCLIENT
+	trustedNetworks := config.Proxy.Trusted_Networks
+	if len(trustedNetworks) == 0 {
+		trustedNetworks = []string{"127.0.0.0/8", "::1"}
+	}
+	config.XclientNetworks, _ = parseNetworks(trustedNetworks)
+	// trusted networks for PROXY protocol, invalid are reported by validate
+	config.ProxyNetworks = nil
+	if config.Proxy_Protocol.Enabled {
+		config.ProxyNetworks, _ = parseNetworks(config.Proxy_Protocol.Trusted_Networks)
+	}
+}
+
+// parse CIDR networks or single IPs, return invalid values
+
+func parseNetworks(values []string) ([]*net.IPNet, []string) {
+	var (
+		networks []*net.IPNet
+		invalid  []string
+	)
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				invalid = append(invalid, value)
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			invalid = append(invalid, value)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks, invalid
 }
 
 func (config *Config) initDbPool() error {
@@ -196,6 +415,7 @@ func (config *Config) initDbPool() error {
 		log.Errorf("Problem with connection to storage: %s", err)
 		return err
 	}
+	config.AddressMode = config.DbPool
 	return nil
 }
 
@@ -225,8 +445,17 @@ func (config *Config) initRedisPool() {
 }
 
 // readConfigBytes parses the contents of an config.yml file
-// and returns its representation.
+// and returns its representation. Unknown keys are reported
+// as errors together with their line numbers.
 func readConfigBytes(data []byte) (*Config, error) {
 	config := NewConfig()
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, newYamlErrors(err)
+	}
+	// empty "storage:" section
+	if config.Storage == nil {
+		config.Storage = &storage.StorageConfig{}
+	}
 	return config, nil
 }
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+adapter:
+  protocol: lmtp
+  port: 2525
+  max_mail_size: 1024
+storage:
+  adapter: postgresql
+  database: falcon_test
+  messages_sql: "INSERT INTO messages"
+email_address_mode:
+  enabled: true
+  domains:
+    - "example.com"
+pop3:
+  enabled: false
+redis:
+  enabled: false
+`
+
+func TestReadConfigBytes(t *testing.T) {
+	config, err := readConfigBytes([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Adapter.Protocol != protocolLmtp {
+		t.Errorf("Unexpected protocol: %q", config.Adapter.Protocol)
+	}
+	if config.Adapter.Port != 2525 || config.Adapter.Max_Mail_Size != 1024 {
+		t.Errorf("Unexpected adapter: %+v", config.Adapter)
+	}
+	if config.Storage.Database != "falcon_test" || config.Storage.Messages_Sql != "INSERT INTO messages" {
+		t.Errorf("Unexpected storage: %+v", config.Storage)
+	}
+	if !config.Email_Address_Mode.Enabled || len(config.Email_Address_Mode.Domains) != 1 {
+		t.Errorf("Unexpected email address mode: %+v", config.Email_Address_Mode)
+	}
+}
+
+func TestReadConfigBytesWithoutStorage(t *testing.T) {
+	config, err := readConfigBytes([]byte("adapter:\n  port: 25\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config.setDefaultValues()
+	if config.Storage.Host != "localhost" || config.Storage.Port != 5432 {
+		t.Errorf("Unexpected storage defaults: %+v", config.Storage)
+	}
+}
+
+func TestReadConfigBytesUnknownKey(t *testing.T) {
+	_, err := readConfigBytes([]byte("adapter:\n  port: 25\n  prot: smtp\n"))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Expected one config error, got: %v", err)
+	}
+	if errs[0].Line != 3 || !strings.Contains(errs[0].Message, "prot") {
+		t.Errorf("Unexpected error: %+v", errs[0])
+	}
+}
+
+func TestReadConfigBytesInvalidType(t *testing.T) {
+	_, err := readConfigBytes([]byte("adapter:\n  port: abc\n"))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 2 {
+		t.Fatalf("Expected config error on line 2, got: %v", err)
+	}
+}
+
+func TestReadConfigBytesSyntaxError(t *testing.T) {
+	_, err := readConfigBytes([]byte("adapter:\n  port: 25\n   host: a: b\n"))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line == 0 {
+		t.Fatalf("Expected config error with line, got: %v", err)
+	}
+}
+
+type configValidationTest struct {
+	Yaml  string
+	Field string
+}
+
+var configValidationTests = []configValidationTest{
+	{"adapter:\n  protocol: http\n", "adapter.protocol"},
+	{"adapter:\n  tls: true\n  ssl_prv_key: /nonexistent/test.key\n", "adapter.ssl_pub_key"},
+	{"adapter:\n  tls: true\n  ssl_prv_key: /nonexistent/test.key\n", "adapter.ssl_prv_key"},
+	{"adapter:\n  tls_port: 465\n", "adapter.tls_port"},
+	{"pop3:\n  enabled: true\n", "pop3.port"},
+	{"pop3:\n  enabled: true\n  port: 110\n  tls_port: 110\n", "pop3.tls_port"},
+	{"pop3:\n  enabled: true\n  port: 110\n  tls: true\n", "pop3.ssl_pub_key"},
+	{"storage:\n  adapter: mysql\n", "storage.adapter"},
+	{"spool:\n  enabled: true\n", "spool.directory"},
+	{"email_address_mode:\n  enabled: true\n", "email_address_mode.domains"},
+	{"spamassassin:\n  enabled: true\n", "storage.spamassassin_sql"},
+	{"clamav:\n  enabled: true\n", "storage.clamav_sql"},
+	{"spf:\n  enabled: true\n", "storage.spf_sql"},
+	{"dkim:\n  enabled: true\n", "storage.dkim_sql"},
+	{"dmarc:\n  enabled: true\n", "storage.dmarc_sql"},
+	{"dmarc:\n  enabled: true\n", "dmarc.enabled"},
+	{"dns:\n  server: 127.0.0.1\n", "dns.server"},
+	{"dnsbl:\n  enabled: true\n", "dnsbl.zones"},
+	{"dnsbl:\n  enabled: true\n  zones:\n    - weight: 2\n", "dnsbl.zones"},
+	{"dnsbl:\n  enabled: true\n", "storage.dnsbl_sql"},
+	{"greylisting:\n  enabled: true\n", "greylisting.enabled"},
+	{"greylisting:\n  enabled: true\n  delay: 600\n  retry_window: 300\n", "greylisting.retry_window"},
+	{"rate_limits:\n  policies:\n    - scope: domain\n      window: second\n      limit: 1\n", "rate_limits.policies"},
+	{"rate_limits:\n  policies:\n    - scope: ip\n      window: day\n      limit: 1\n", "rate_limits.policies"},
+	{"rate_limits:\n  policies:\n    - scope: sender\n      window: minute\n", "rate_limits.policies"},
+	{"tarpit:\n  enabled: true\n  command_delays:\n    mail: 100\n    dot: 100\n", "tarpit.command_delays"},
+	{"tarpit:\n  enabled: true\n  error_delay: -1\n", "tarpit.error_delay"},
+	{"faults:\n  enabled: true\n", "storage.faults_sql"},
+	{"proxy:\n  trusted_networks: [\"localhost\"]\n", "proxy.trusted_networks"},
+	{"proxy_protocol:\n  enabled: true\n", "proxy_protocol.trusted_networks"},
+	{"proxy_protocol:\n  enabled: true\n  trusted_networks: [\"10.0.0.0/33\"]\n", "proxy_protocol.trusted_networks"},
+	{"redis:\n  enabled: false\n  hook_username: admin\n", "redis.hook_username"},
+	{"redis:\n  enabled: false\n  sidekiq_queue: server\n", "redis.sidekiq_queue"},
+	{"redis:\n  enabled: false\n  hook_password: secret\n", "redis.hook_password"},
+	{"redis:\n  enabled: false\n  sidekiq_class: Worker\n", "redis.sidekiq_class"},
+	{"backpressure:\n  queue_high_water: 200\n", "backpressure.queue_high_water"},
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, test := range configValidationTests {
+		config, err := readConfigBytes([]byte(test.Yaml))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", test.Yaml, err)
+		}
+		config.setDefaultValues()
+		errs, _ := config.validate().(ConfigErrors)
+		found := false
+		for _, configErr := range errs {
+			if configErr.Field == test.Field {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected error for %s in %q, got: %v", test.Field, test.Yaml, errs)
+		}
+	}
+}
+
+func TestConfigValidationValid(t *testing.T) {
+	config, err := readConfigBytes([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config.Storage.Email_Address_Mode_Sql = "SELECT id FROM inboxes"
+	config.setDefaultValues()
+	if err := config.validate(); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/ratelimit"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	yamlLineRE = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+	// tarpit delays are set for greeting, smtp commands and end of data
+	tarpitCommands = map[string]bool{
+		"connect": true, "helo": true, "ehlo": true, "lhlo": true, "mail": true, "rcpt": true,
+		"data": true, "end_of_data": true, "bdat": true, "rset": true, "noop": true, "quit": true, "vrfy": true,
+		"expn": true, "help": true, "auth": true, "starttls": true, "xclient": true,
+	}
+
+	// handling of bare CR and LF in DATA
+	bareLineEndings = map[string]bool{"normalize": true, "reject": true}
+)
+
+// ConfigError describes one problem found in config.yml. Line is
+// set for parse errors and is 0 for validation errors, which name
+// the offending option in Field instead.
+type ConfigError struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return e.Message
+}
+
+// ConfigErrors is returned when config.yml has one or more problems.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// convert yaml errors to ConfigErrors
+
+func newYamlErrors(err error) ConfigErrors {
+	var lines []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		lines = typeErr.Errors
+	} else {
+		lines = []string{err.Error()}
+	}
+	errs := ConfigErrors{}
+	for _, line := range lines {
+		configErr := &ConfigError{Message: line}
+		if res := yamlLineRE.FindStringSubmatch(line); len(res) == 3 {
+			configErr.Line, _ = strconv.Atoi(res[1])
+			configErr.Message = res[2]
+		}
+		errs = append(errs, configErr)
+	}
+	return errs
+}
+
+// validate checks options which depend on each other
+
+func (config *Config) validate() error {
+	errs := ConfigErrors{}
+	addError := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	// adapter
+	if config.Adapter.Protocol != protocolSmtp && config.Adapter.Protocol != protocolLmtp {
+		addError("adapter.protocol", "unknown protocol %q, should be smtp or lmtp", config.Adapter.Protocol)
+	}
+	if config.Adapter.Tls {
+		if msg := checkKeyFile(config.Adapter.Ssl_Pub_Key); msg != "" {
+			addError("adapter.ssl_pub_key", "tls is enabled, but %s", msg)
+		}
+		if msg := checkKeyFile(config.Adapter.Ssl_Prv_Key); msg != "" {
+			addError("adapter.ssl_prv_key", "tls is enabled, but %s", msg)
+		}
+	}
+	if config.Adapter.Tls_Port != 0 {
+		if !config.Adapter.Tls {
+			addError("adapter.tls_port", "implicit tls port is set, but tls is disabled")
+		}
+		if config.Adapter.Tls_Port < 0 || config.Adapter.Tls_Port == config.Adapter.Port {
+			addError("adapter.tls_port", "invalid implicit tls port %d", config.Adapter.Tls_Port)
+		}
+	}
+	if config.Adapter.Temp_Dir != "" {
+		if info, err := os.Stat(config.Adapter.Temp_Dir); err != nil || !info.IsDir() {
+			addError("adapter.temp_dir", "temp directory %q doesn't exist", config.Adapter.Temp_Dir)
+		}
+	}
+	// data
+	if !bareLineEndings[config.Data.Bare_Line_Endings] {
+		addError("data.bare_line_endings", "unknown mode %q, should be normalize or reject", config.Data.Bare_Line_Endings)
+	}
+	// storage
+	if strings.ToLower(config.Storage.Adapter) != "postgresql" {
+		addError("storage.adapter", "unsupported adapter %q, should be postgresql", config.Storage.Adapter)
+	}
+	// spool
+	if config.Spool.Enabled && config.Spool.Directory == "" {
+		addError("spool.directory", "spool is enabled, but directory is not set")
+	}
+	// backpressure
+	if config.Backpressure.Queue_High_Water >= EMAIL_QUEUE_SIZE {
+		addError("backpressure.queue_high_water", "high water mark %d should be below queue size %d", config.Backpressure.Queue_High_Water, EMAIL_QUEUE_SIZE)
+	}
+	// email address mode
+	if config.Email_Address_Mode.Enabled {
+		if len(config.Email_Address_Mode.Domains) == 0 {
+			addError("email_address_mode.domains", "email address mode is enabled, but no domains are set")
+		}
+		if config.Storage.Email_Address_Mode_Sql == "" {
+			addError("storage.email_address_mode_sql", "email address mode is enabled, but sql is empty")
+		}
+	}
+	// pop3
+	if config.Pop3.Enabled {
+		if config.Pop3.Port <= 0 {
+			addError("pop3.port", "pop3 is enabled, but port is not set")
+		}
+		if config.Pop3.Tls {
+			if msg := checkKeyFile(config.Pop3.Ssl_Pub_Key); msg != "" {
+				addError("pop3.ssl_pub_key", "tls is enabled, but %s", msg)
+			}
+			if msg := checkKeyFile(config.Pop3.Ssl_Prv_Key); msg != "" {
+				addError("pop3.ssl_prv_key", "tls is enabled, but %s", msg)
+			}
+		}
+		if config.Pop3.Tls_Port != 0 {
+			if !config.Pop3.Tls {
+				addError("pop3.tls_port", "implicit tls port is set, but tls is disabled")
+			}
+			if config.Pop3.Tls_Port < 0 || config.Pop3.Tls_Port == config.Pop3.Port {
+				addError("pop3.tls_port", "invalid implicit tls port %d", config.Pop3.Tls_Port)
+			}
+		}
+	}
+	// spamassassin and clamav
+	if config.Spamassassin.Enabled && config.Storage.Spamassassin_Sql == "" {
+		addError("storage.spamassassin_sql", "spamassassin is enabled, but sql is empty")
+	}
+	if config.Clamav.Enabled && config.Storage.Clamav_Sql == "" {
+		addError("storage.clamav_sql", "clamav is enabled, but sql is empty")
+	}
+	// spf
+	if config.Spf.Enabled && config.Storage.Spf_Sql == "" {
+		addError("storage.spf_sql", "spf is enabled, but sql is empty")
+	}
+	// dkim
+	if config.Dkim.Enabled && config.Storage.Dkim_Sql == "" {
+		addError("storage.dkim_sql", "dkim is enabled, but sql is empty")
+	}
+	// dmarc
+	if config.Dmarc.Enabled {
+		if config.Storage.Dmarc_Sql == "" {
+			addError("storage.dmarc_sql", "dmarc is enabled, but sql is empty")
+		}
+		if !config.Spf.Enabled {
+			addError("dmarc.enabled", "dmarc is enabled, but spf is disabled")
+		}
+	}
+	if config.Dns.Server != "" {
+		if _, _, err := net.SplitHostPort(config.Dns.Server); err != nil {
+			addError("dns.server", "invalid server %q, should be host:port", config.Dns.Server)
+		}
+	}
+	// dnsbl
+	if config.Dnsbl.Enabled {
+		if len(config.Dnsbl.Zones) == 0 {
+			addError("dnsbl.zones", "dnsbl is enabled, but no zones are set")
+		}
+		for _, zone := range config.Dnsbl.Zones {
+			if strings.Trim(zone.Zone, ".") == "" {
+				addError("dnsbl.zones", "zone name is empty")
+			}
+		}
+		if config.Storage.Dnsbl_Sql == "" {
+			addError("storage.dnsbl_sql", "dnsbl is enabled, but sql is empty")
+		}
+	}
+	// greylisting
+	if config.Greylisting.Enabled {
+		if !config.Redis.Enabled {
+			addError("greylisting.enabled", "greylisting is enabled, but redis is disabled")
+		}
+		if config.Greylisting.Delay >= config.Greylisting.Retry_Window {
+			addError("greylisting.retry_window", "retry window %d should be longer than delay %d", config.Greylisting.Retry_Window, config.Greylisting.Delay)
+		}
+	}
+	// rate limits
+	for _, policy := range config.Rate_Limits.Policies {
+		switch policy.Scope {
+		case ratelimit.SCOPE_INBOX, ratelimit.SCOPE_IP, ratelimit.SCOPE_SENDER, ratelimit.SCOPE_USER:
+		default:
+			addError("rate_limits.policies", "unknown scope %q, should be inbox, ip, sender or user", policy.Scope)
+		}
+		if _, ok := ratelimit.Windows[policy.Window]; !ok {
+			addError("rate_limits.policies", "unknown window %q, should be second, minute or hour", policy.Window)
+		}
+		if policy.Limit < 0 || (policy.Limit == 0 && policy.Scope != ratelimit.SCOPE_INBOX) {
+			addError("rate_limits.policies", "invalid limit %d of %s scope", policy.Limit, policy.Scope)
+		}
+		if policy.Burst < 0 {
+			addError("rate_limits.policies", "negative burst %d", policy.Burst)
+		}
+		if policy.Prefix < 0 || policy.Prefix > 32 || policy.Prefix6 < 0 || policy.Prefix6 > 128 {
+			addError("rate_limits.policies", "invalid network prefix")
+		}
+	}
+	// tarpit
+	if config.Tarpit.Enabled {
+		for command, delay := range config.Tarpit.Command_Delays {
+			if !tarpitCommands[command] {
+				addError("tarpit.command_delays", "unknown command %q", command)
+			}
+			if delay < 0 {
+				addError("tarpit.command_delays", "negative delay %d of %s", delay, command)
+			}
+		}
+		if config.Tarpit.Error_Delay < 0 || config.Tarpit.Auth_Error_Delay < 0 {
+			addError("tarpit.error_delay", "negative error delay")
+		}
+	}
+	// faults
+	if config.Faults.Enabled && config.Storage.Faults_Sql == "" {
+		addError("storage.faults_sql", "faults are enabled, but sql is empty")
+	}
+	// xclient
+	_, invalid := parseNetworks(config.Proxy.Trusted_Networks)
+	for _, value := range invalid {
+		addError("proxy.trusted_networks", "invalid network %q", value)
+	}
+	// proxy protocol
+	if config.Proxy_Protocol.Enabled {
+		networks, invalid := parseNetworks(config.Proxy_Protocol.Trusted_Networks)
+		for _, value := range invalid {
+			addError("proxy_protocol.trusted_networks", "invalid network %q", value)
+		}
+		if len(networks) == 0 && len(invalid) == 0 {
+			addError("proxy_protocol.trusted_networks", "proxy protocol is enabled, but trusted networks are empty")
+		}
+	}
+	// redis
+	if !config.Redis.Enabled {
+		if config.Redis.Hook_Username != "" {
+			addError("redis.hook_username", "faye hooks are set, but redis is disabled")
+		}
+		if config.Redis.Hook_Password != "" {
+			addError("redis.hook_password", "faye hooks are set, but redis is disabled")
+		}
+		if config.Redis.Sidekiq_Queue != "" {
+			addError("redis.sidekiq_queue", "sidekiq hooks are set, but redis is disabled")
+		}
+		if config.Redis.Sidekiq_Class != "" {
+			addError("redis.sidekiq_class", "sidekiq hooks are set, but redis is disabled")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkKeyFile return problem with key file or empty string
+
+func checkKeyFile(filename string) string {
+	if filename == "" {
+		return "key file is not set"
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Sprintf("key file %q is not readable: %v", filename, err)
+	}
+	return ""
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/redisworker"
 	stdlog "log"
 	"os"
 	"os/signal"
@@ -19,18 +20,35 @@ var (
 
 	loggerFileDescr *os.File
 	errorFile       error
+
+	shutdownHook func()
 )
 
+// OnShutdown set function, which called on SIGTERM or SIGINT
+
+func OnShutdown(hook func()) {
+	shutdownHook = hook
+}
+
 // signals
 
 func listenSignals() {
 	go func() {
 		signals := make(chan os.Signal, 2)
-		signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+		signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
 		defer signal.Stop(signals)
+		shuttingDown := false
 		for {
 			sig := <-signals
 			switch sig {
+			case syscall.SIGTERM, syscall.SIGINT:
+				if shuttingDown || shutdownHook == nil {
+					log.Infof("Got %v, exit", sig)
+					os.Exit(1)
+				}
+				log.Infof("Got %v, graceful shutdown", sig)
+				shuttingDown = true
+				go shutdownHook()
 			case syscall.SIGUSR1:
 				if *logFile != "" {
 					loggerFileDescr.Close()
@@ -91,6 +109,10 @@ func InitDaemon() (*config.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	// stores shared by nodes, in memory without redis
+	if globalConfig.Redis.Enabled {
+		redisworker.UseRedisStores(globalConfig)
+	}
 	// verbose
 	if *verbose == true {
 		globalConfig.Log.Debug = *verbose
@@ -0,0 +1,210 @@
+package dkim
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// header field as it is in message, with folding and CRLF
+
+type headerField struct {
+	name  string
+	raw   string
+	colon int // position of colon in raw
+}
+
+func (f *headerField) value() string {
+	return f.raw[f.colon+1:]
+}
+
+// SMTP session stores lines with LF, DKIM is computed over CRLF
+
+func normalizeNewlines(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) {
+		return data
+	}
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// split message in header fields and body
+
+func splitMessage(data []byte) ([]*headerField, []byte) {
+	var (
+		headers []*headerField
+		body    []byte
+	)
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += 2
+		}
+		line := string(data[:end])
+		data = data[end:]
+		if line == "\r\n" {
+			body = data
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			// folded line
+			headers[len(headers)-1].raw += line
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			// not a header field, ignore it
+			continue
+		}
+		headers = append(headers, &headerField{name: strings.TrimSpace(line[:colon]), raw: line, colon: colon})
+	}
+	return headers, body
+}
+
+// header canonicalization (s3.4.1, s3.4.2)
+
+func canonicalHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	colon := strings.IndexByte(raw, ':')
+	if colon < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimRight(raw[:colon], " \t"))
+	value := strings.Replace(raw[colon+1:], "\r\n", "", -1)
+	value = strings.Trim(compressWhitespace(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// body canonicalization (s3.4.3, s3.4.4) of streamed body. Body lines
+// end with CRLF or LF, canonical body is written to hash up to length
+// limit. Empty lines are kept until next content, so empty lines at
+// the end of body are removed.
+
+type bodyCanonicalizer struct {
+	hash    io.Writer
+	relaxed bool
+	limit   int64 // canonical octets to hash, -1 for whole body
+	length  int64 // canonical octets of whole body
+
+	emptyLines int  // empty lines, which are not written yet
+	inLine     bool // content of line is written
+	space      bool // relaxed: whitespace, which is not written yet
+	cr         bool // CR, line ending isn't known yet
+}
+
+func newBodyCanonicalizer(hash io.Writer, canon string, limit int64) *bodyCanonicalizer {
+	return &bodyCanonicalizer{hash: hash, relaxed: canon == "relaxed", limit: limit}
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				c.endLine()
+				continue
+			}
+			// bare CR is content
+			c.content('\r')
+		}
+		switch b {
+		case '\r':
+			c.cr = true
+		case '\n':
+			c.endLine()
+		default:
+			c.content(b)
+		}
+	}
+	return len(p), nil
+}
+
+// Close ends last line, canonical empty body is CRLF in simple mode
+
+func (c *bodyCanonicalizer) Close() error {
+	if c.cr {
+		c.cr = false
+		c.content('\r')
+	}
+	if c.inLine {
+		c.endLine()
+	}
+	if c.length == 0 && !c.relaxed {
+		c.write([]byte("\r\n"))
+	}
+	return nil
+}
+
+func (c *bodyCanonicalizer) content(b byte) {
+	if c.relaxed && (b == ' ' || b == '\t') {
+		c.space = true
+		return
+	}
+	if !c.inLine {
+		for ; c.emptyLines > 0; c.emptyLines-- {
+			c.write([]byte("\r\n"))
+		}
+		c.inLine = true
+	}
+	if c.space {
+		c.write([]byte{' '})
+		c.space = false
+	}
+	c.write([]byte{b})
+}
+
+// relaxed: whitespace at the end of line is removed
+
+func (c *bodyCanonicalizer) endLine() {
+	c.space = false
+	if !c.inLine {
+		c.emptyLines++
+		return
+	}
+	c.write([]byte("\r\n"))
+	c.inLine = false
+}
+
+func (c *bodyCanonicalizer) write(data []byte) {
+	if c.limit >= 0 && c.length+int64(len(data)) > c.limit {
+		if c.length < c.limit {
+			c.hash.Write(data[:c.limit-c.length])
+		}
+	} else {
+		c.hash.Write(data)
+	}
+	c.length += int64(len(data))
+}
+
+// sequences of space and tab are one space
+
+func compressWhitespace(value string) string {
+	var out strings.Builder
+	space := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out.WriteByte(' ')
+			space = false
+		}
+		out.WriteByte(c)
+	}
+	if space {
+		out.WriteByte(' ')
+	}
+	return out.String()
+}
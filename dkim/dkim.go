@@ -0,0 +1,434 @@
+// Package dkim verifies DomainKeys Identified Mail signatures (RFC 6376)
+// with rsa-sha256 and ed25519-sha256 (RFC 8463) algorithms.
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+type Result string
+
+const (
+	NONE      Result = "none"
+	PASS      Result = "pass"
+	FAIL      Result = "fail"
+	TEMPERROR Result = "temperror"
+	PERMERROR Result = "permerror"
+
+	SIGNATURE_HEADER = "DKIM-Signature"
+	MAX_SIGNATURES   = 10
+	MIN_RSA_KEY_BITS = 1024    // RFC 8301
+	MAX_HEADER_SIZE  = 1048576 // header of email is read in memory
+)
+
+var (
+	signatureValueRE = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	whitespaceRE     = regexp.MustCompile(`[ \t\r\n]+`)
+)
+
+// Report is result of one signature
+type Report struct {
+	Domain   string
+	Selector string
+	Result   Result
+	Reason   string
+}
+
+// verifyError stops verification of signature
+
+type verifyError struct {
+	result Result
+	reason string
+}
+
+func (e *verifyError) Error() string {
+	return e.reason
+}
+
+func failf(result Result, format string, args ...interface{}) error {
+	return &verifyError{result: result, reason: fmt.Sprintf(format, args...)}
+}
+
+// signature is parsed DKIM-Signature header
+
+type signature struct {
+	algorithm       string // rsa-sha256 or ed25519-sha256
+	signature       []byte
+	bodyHash        []byte
+	headerCanon     string
+	bodyCanon       string
+	domain          string
+	headers         []string
+	identity        string
+	bodyLength      int64 // -1 if not set
+	selector        string
+	expiration      int64 // 0 if not set
+	headerWithoutB  string
+	signatureHeader *headerField
+}
+
+// signature, which is verified after body is hashed
+
+type signatureCheck struct {
+	report   *Report
+	sig      *signature
+	bodyHash hash.Hash
+	body     *bodyCanonicalizer
+}
+
+// Verify checks all DKIM-Signature headers of raw email. Report is
+// returned for every signature, empty if email isn't signed. Header is
+// read in memory, body is hashed for all signatures in one pass.
+
+func Verify(r resolver.Resolver, rawMail io.ReaderAt, size int64) []*Report {
+	headers, bodyOffset, err := readHeaders(io.NewSectionReader(rawMail, 0, size))
+	if err != nil {
+		return []*Report{{Result: TEMPERROR, Reason: err.Error()}}
+	}
+	reports := []*Report{}
+	checks := []*signatureCheck{}
+	bodies := []io.Writer{}
+	for _, field := range headers {
+		if !strings.EqualFold(field.name, SIGNATURE_HEADER) {
+			continue
+		}
+		if len(reports) >= MAX_SIGNATURES {
+			break
+		}
+		report := &Report{Result: PASS}
+		reports = append(reports, report)
+		sig, err := parseSignature(field)
+		if sig != nil {
+			report.Domain, report.Selector = sig.domain, sig.selector
+		}
+		if err != nil {
+			report.Result, report.Reason = err.(*verifyError).result, err.Error()
+			continue
+		}
+		check := &signatureCheck{report: report, sig: sig, bodyHash: sha256.New()}
+		check.body = newBodyCanonicalizer(check.bodyHash, sig.bodyCanon, sig.bodyLength)
+		checks = append(checks, check)
+		bodies = append(bodies, check.body)
+	}
+	if len(checks) == 0 {
+		return reports
+	}
+	_, readErr := io.Copy(io.MultiWriter(bodies...), io.NewSectionReader(rawMail, bodyOffset, size-bodyOffset))
+	for _, check := range checks {
+		var err error
+		if readErr != nil {
+			err = failf(TEMPERROR, "body read error: %v", readErr)
+		} else {
+			check.body.Close()
+			err = verifySignature(r, check.sig, headers, check.bodyHash.Sum(nil), check.body.length)
+		}
+		if err != nil {
+			check.report.Result, check.report.Reason = err.(*verifyError).result, err.Error()
+		} else {
+			check.report.Reason = "signature verified"
+		}
+	}
+	return reports
+}
+
+// header fields of email and offset of body. Lines of header are read
+// until empty line, at most MAX_HEADER_SIZE.
+
+func readHeaders(r io.Reader) ([]*headerField, int64, error) {
+	br := bufio.NewReader(r)
+	var (
+		data      []byte
+		offset    int64
+		lineStart = true
+	)
+	for offset < MAX_HEADER_SIZE {
+		line, err := br.ReadSlice('\n')
+		data = append(data, line...)
+		offset += int64(len(line))
+		if err == bufio.ErrBufferFull {
+			// long line, continue it
+			lineStart = false
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if lineStart && (string(line) == "\r\n" || string(line) == "\n") {
+			break
+		}
+		lineStart = true
+	}
+	headers, _ := splitMessage(normalizeNewlines(data))
+	return headers, offset, nil
+}
+
+// tag=value list (s3.2)
+
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		name := strings.TrimSpace(tag[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(tag[i+1:])
+	}
+	return tags, nil
+}
+
+func parseSignature(field *headerField) (*signature, error) {
+	tags, err := parseTags(field.value())
+	if err != nil {
+		return nil, failf(PERMERROR, "signature syntax error: %v", err)
+	}
+	sig := &signature{
+		domain:          strings.ToLower(tags["d"]),
+		selector:        tags["s"],
+		bodyLength:      -1,
+		signatureHeader: field,
+	}
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return sig, failf(PERMERROR, "signature missing required tag %s=", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, failf(PERMERROR, "incompatible signature version %q", tags["v"])
+	}
+	sig.algorithm = strings.ToLower(tags["a"])
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return sig, failf(PERMERROR, "unsupported algorithm %q", tags["a"])
+	}
+	if sig.signature, err = decodeBase64(tags["b"]); err != nil || len(sig.signature) == 0 {
+		return sig, failf(PERMERROR, "invalid signature data")
+	}
+	if sig.bodyHash, err = decodeBase64(tags["bh"]); err != nil || len(sig.bodyHash) == 0 {
+		return sig, failf(PERMERROR, "invalid body hash")
+	}
+	// canonicalization, simple/simple if not set
+	sig.headerCanon, sig.bodyCanon = "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.headerCanon = parts[0]
+		if len(parts) == 2 {
+			sig.bodyCanon = parts[1]
+		}
+	}
+	if !isCanonicalization(sig.headerCanon) || !isCanonicalization(sig.bodyCanon) {
+		return sig, failf(PERMERROR, "unsupported canonicalization %q", tags["c"])
+	}
+	if sig.domain == "" || sig.selector == "" {
+		return sig, failf(PERMERROR, "empty domain or selector")
+	}
+	hasFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return sig, failf(PERMERROR, "invalid signed header list")
+		}
+		hasFrom = hasFrom || strings.EqualFold(name, "from")
+		sig.headers = append(sig.headers, name)
+	}
+	if !hasFrom {
+		return sig, failf(PERMERROR, "From header is not signed")
+	}
+	// agent identity must be in signing domain
+	sig.identity = "@" + sig.domain
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndex(i, "@")
+		idDomain := strings.ToLower(i[at+1:])
+		if at < 0 || (idDomain != sig.domain && !strings.HasSuffix(idDomain, "."+sig.domain)) {
+			return sig, failf(PERMERROR, "identity %q is not in domain %s", i, sig.domain)
+		}
+		sig.identity = i
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.bodyLength < 0 {
+			return sig, failf(PERMERROR, "invalid body length %q", l)
+		}
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return sig, failf(PERMERROR, "unsupported query method %q", q)
+	}
+	if x, ok := tags["x"]; ok {
+		if sig.expiration, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return sig, failf(PERMERROR, "invalid expiration %q", x)
+		}
+		if t, err := strconv.ParseInt(tags["t"], 10, 64); err == nil && sig.expiration < t {
+			return sig, failf(PERMERROR, "signature expires before it was created")
+		}
+	}
+	// signature header is signed with empty b= value
+	sig.headerWithoutB = field.raw[:field.colon+1] + signatureValueRE.ReplaceAllString(field.value(), "$1$2")
+	return sig, nil
+}
+
+func isCanonicalization(c string) bool {
+	return c == "simple" || c == "relaxed"
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(whitespaceRE.ReplaceAllString(value, ""))
+}
+
+// VERIFICATION
+
+// body hash is computed over canonical body of length octets
+
+func verifySignature(r resolver.Resolver, sig *signature, headers []*headerField, bodyHash []byte, bodyLength int64) error {
+	if sig.expiration > 0 && time.Now().Unix() > sig.expiration {
+		return failf(PERMERROR, "signature expired")
+	}
+	key, err := lookupKey(r, sig)
+	if err != nil {
+		return err
+	}
+	// body hash
+	if sig.bodyLength > bodyLength {
+		return failf(PERMERROR, "body length tag exceeds body size")
+	}
+	if !bytes.Equal(bodyHash, sig.bodyHash) {
+		return failf(FAIL, "body hash did not verify")
+	}
+	// header hash
+	hash := sha256.New()
+	used := make(map[*headerField]bool)
+	for _, name := range sig.headers {
+		// repeated names are taken from the bottom (s5.4.2)
+		for i := len(headers) - 1; i >= 0; i-- {
+			field := headers[i]
+			if !used[field] && field != sig.signatureHeader && strings.EqualFold(field.name, name) {
+				used[field] = true
+				hash.Write([]byte(canonicalHeader(field.raw, sig.headerCanon)))
+				break
+			}
+		}
+	}
+	signed := canonicalHeader(sig.headerWithoutB, sig.headerCanon)
+	hash.Write([]byte(strings.TrimSuffix(signed, "\r\n")))
+	hashed := hash.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig.signature) != nil {
+			return failf(FAIL, "signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, hashed, sig.signature) {
+			return failf(FAIL, "signature did not verify")
+		}
+	}
+	return nil
+}
+
+// public key from "selector._domainkey.domain" TXT record (s3.6)
+
+func lookupKey(r resolver.Resolver, sig *signature) (crypto.PublicKey, error) {
+	name := sig.selector + "._domainkey." + sig.domain
+	txts, err := r.LookupTXT(name)
+	if err != nil {
+		if resolver.IsNotFound(err) {
+			return nil, failf(PERMERROR, "no key for signature at %s", name)
+		}
+		return nil, failf(TEMPERROR, "key lookup failed: %v", err)
+	}
+	var keyErr error
+	for _, txt := range txts {
+		key, err := parseKey(txt, sig)
+		if err == nil {
+			return key, nil
+		}
+		keyErr = err
+	}
+	if keyErr == nil {
+		keyErr = failf(PERMERROR, "no key for signature at %s", name)
+	}
+	return nil, keyErr
+}
+
+func parseKey(txt string, sig *signature) (crypto.PublicKey, error) {
+	tags, err := parseTags(txt)
+	if err != nil {
+		return nil, failf(PERMERROR, "key syntax error: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, failf(PERMERROR, "incompatible key version %q", v)
+	}
+	keyType := "rsa"
+	if k, ok := tags["k"]; ok {
+		keyType = strings.ToLower(k)
+	}
+	if keyType+"-sha256" != sig.algorithm {
+		return nil, failf(PERMERROR, "key type %q doesn't match algorithm %s", keyType, sig.algorithm)
+	}
+	if h, ok := tags["h"]; ok && !strings.Contains(strings.ToLower(h), "sha256") {
+		return nil, failf(PERMERROR, "key doesn't allow sha256")
+	}
+	if s, ok := tags["s"]; ok && s != "*" && !strings.Contains(strings.ToLower(s), "email") {
+		return nil, failf(PERMERROR, "key is not for email")
+	}
+	if t, ok := tags["t"]; ok {
+		for _, flag := range strings.Split(t, ":") {
+			if strings.TrimSpace(flag) == "s" && !strings.HasSuffix(strings.ToLower(sig.identity), "@"+sig.domain) {
+				return nil, failf(PERMERROR, "key requires identity in domain %s", sig.domain)
+			}
+		}
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return nil, failf(PERMERROR, "key missing p= tag")
+	}
+	data, err := decodeBase64(p)
+	if err != nil {
+		return nil, failf(PERMERROR, "invalid key data")
+	}
+	if len(data) == 0 {
+		return nil, failf(PERMERROR, "key revoked")
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, failf(PERMERROR, "invalid ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	var pub *rsa.PublicKey
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		pub, _ = key.(*rsa.PublicKey)
+	} else {
+		pub, _ = x509.ParsePKCS1PublicKey(data)
+	}
+	if pub == nil {
+		return nil, failf(PERMERROR, "invalid rsa key")
+	}
+	if pub.N.BitLen() < MIN_RSA_KEY_BITS {
+		return nil, failf(PERMERROR, "rsa key is too short (%d bits)", pub.N.BitLen())
+	}
+	return pub, nil
+}
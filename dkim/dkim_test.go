@@ -0,0 +1,231 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+// canonical body, which is written at once
+
+func canonicalBody(body []byte, canon string) []byte {
+	var out bytes.Buffer
+	c := newBodyCanonicalizer(&out, canon, -1)
+	c.Write(body)
+	c.Close()
+	return out.Bytes()
+}
+
+// example from RFC 6376 s3.4.5
+
+func TestCanonicalization(t *testing.T) {
+	message := "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+	headers, body := splitMessage([]byte(message))
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 headers, got %d", len(headers))
+	}
+	relaxed := canonicalHeader(headers[0].raw, "relaxed") + canonicalHeader(headers[1].raw, "relaxed")
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("relaxed headers: got %q", relaxed)
+	}
+	simple := canonicalHeader(headers[0].raw, "simple") + canonicalHeader(headers[1].raw, "simple")
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("simple headers: got %q", simple)
+	}
+	if canon := string(canonicalBody(body, "relaxed")); canon != " C\r\nD E\r\n" {
+		t.Errorf("relaxed body: got %q", canon)
+	}
+	if canon := string(canonicalBody(body, "simple")); canon != " C \r\nD \t E\r\n" {
+		t.Errorf("simple body: got %q", canon)
+	}
+	if canon := string(canonicalBody(nil, "simple")); canon != "\r\n" {
+		t.Errorf("simple empty body: got %q", canon)
+	}
+	if canon := string(canonicalBody([]byte("\r\n\r\n"), "relaxed")); canon != "" {
+		t.Errorf("relaxed empty body: got %q", canon)
+	}
+}
+
+func TestBodyCanonicalizerStream(t *testing.T) {
+	body := "Hello,  world \n\r\nbare\rCR \t\n\n\n"
+	for _, canon := range []string{"simple", "relaxed"} {
+		expected := canonicalBody([]byte(body), canon)
+		// body is written in chunks of one byte
+		var out bytes.Buffer
+		c := newBodyCanonicalizer(&out, canon, 10)
+		for i := 0; i < len(body); i++ {
+			c.Write([]byte{body[i]})
+		}
+		c.Close()
+		if out.String() != string(expected[:10]) || c.length != int64(len(expected)) {
+			t.Errorf("%s: expected %q of %d octets, got %q of %d", canon, expected[:10], len(expected), out.String(), c.length)
+		}
+	}
+	if canon := string(canonicalBody([]byte(body), "relaxed")); canon != "Hello, world\r\n\r\nbare\rCR\r\n" {
+		t.Errorf("relaxed body: got %q", canon)
+	}
+}
+
+// example from RFC 8463 Appendix A
+
+const rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+func verify(zone *resolver.Zone, message string) []*Report {
+	return Verify(zone, strings.NewReader(message), int64(len(message)))
+}
+
+func TestVerifyEd25519Example(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddTXT("brisbane._domainkey.football.example.com", "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=")
+	reports := verify(zone, rfc8463Message)
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(reports))
+	}
+	report := reports[0]
+	if report.Result != PASS || report.Domain != "football.example.com" || report.Selector != "brisbane" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	// changed body
+	reports = verify(zone, strings.Replace(rfc8463Message, "hungry", "angry", 1))
+	if reports[0].Result != FAIL || reports[0].Reason != "body hash did not verify" {
+		t.Errorf("unexpected report for changed body: %+v", reports[0])
+	}
+	// changed header
+	reports = verify(zone, strings.Replace(rfc8463Message, "Is dinner", "Was dinner", 1))
+	if reports[0].Result != FAIL || reports[0].Reason != "signature did not verify" {
+		t.Errorf("unexpected report for changed header: %+v", reports[0])
+	}
+}
+
+// test signer, body and signature are computed by package functions
+
+func signMessage(message, tags, canon string, sign func(hashed []byte) []byte) string {
+	headers, body := splitMessage(normalizeNewlines([]byte(message)))
+	prefix := "DKIM-Signature: v=1; " + tags + "; c=" + canon + "; h=from:to:subject;\r\n bh="
+	sig, err := parseSignature(&headerField{name: SIGNATURE_HEADER, raw: prefix + "AA==; b=AA==\r\n", colon: len(SIGNATURE_HEADER)})
+	if err != nil {
+		// invalid signature is not signed
+		return prefix + "AA==; b=AA==\n" + message
+	}
+	canonBody := canonicalBody(body, sig.bodyCanon)
+	if sig.bodyLength >= 0 {
+		canonBody = canonBody[:sig.bodyLength]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	header := prefix + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	sig, _ = parseSignature(&headerField{name: SIGNATURE_HEADER, raw: header + "AA==\r\n", colon: len(SIGNATURE_HEADER)})
+	hash := sha256.New()
+	for _, name := range sig.headers {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headers[i].name, name) {
+				hash.Write([]byte(canonicalHeader(headers[i].raw, sig.headerCanon)))
+				break
+			}
+		}
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(sig.headerWithoutB, sig.headerCanon), "\r\n")))
+	return header + base64.StdEncoding.EncodeToString(sign(hash.Sum(nil))) + "\n" + message
+}
+
+const testMessage = "From: Joe <joe@example.com>\nTo: suzie@example.net\nSubject:  Test  \n\nHello,  world \n\n\n"
+
+func TestVerifyRsa(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	zone := resolver.NewZone()
+	zone.AddTXT("sel._domainkey.example.com", "v=DKIM1; k=rsa; p="+base64.StdEncoding.EncodeToString(pub))
+	zone.AddTXT("revoked._domainkey.example.com", "v=DKIM1; p=")
+	zone.AddFailure("broken._domainkey.example.com")
+	sign := func(hashed []byte) []byte {
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	tests := []struct {
+		tags   string
+		canon  string
+		result Result
+		reason string
+	}{
+		{"a=rsa-sha256; d=example.com; s=sel", "simple/simple", PASS, ""},
+		{"a=rsa-sha256; d=example.com; s=sel", "relaxed/relaxed", PASS, ""},
+		{"a=rsa-sha256; d=example.com; s=sel; l=5", "relaxed/simple", PASS, ""},
+		{"a=rsa-sha256; d=Example.com; s=sel; i=joe@mail.example.com", "simple/relaxed", PASS, ""},
+		{"a=rsa-sha256; d=example.com; s=sel; i=joe@example.org", "simple/simple", PERMERROR, "identity"},
+		{"a=rsa-sha1; d=example.com; s=sel", "simple/simple", PERMERROR, "unsupported algorithm"},
+		{"a=ed25519-sha256; d=example.com; s=sel", "simple/simple", FAIL, "signature did not verify"},
+		{"a=rsa-sha256; d=example.com; s=missing", "simple/simple", PERMERROR, "no key"},
+		{"a=rsa-sha256; d=example.com; s=revoked", "simple/simple", PERMERROR, "key revoked"},
+		{"a=rsa-sha256; d=example.com; s=broken", "simple/simple", TEMPERROR, "key lookup failed"},
+		{"a=rsa-sha256; d=example.com; s=sel; x=1000", "simple/simple", PERMERROR, "signature expired"},
+	}
+	for _, test := range tests {
+		signed := signMessage(testMessage, test.tags, test.canon, sign)
+		if test.result == FAIL {
+			// rsa signature, but ed25519 key
+			zone.AddTXT("sel._domainkey.example.com", "v=DKIM1; k=ed25519; p="+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+		}
+		reports := verify(zone, signed)
+		if len(reports) != 1 {
+			t.Fatalf("%s: expected 1 report, got %d", test.tags, len(reports))
+		}
+		if reports[0].Result != test.result || !strings.Contains(reports[0].Reason, test.reason) {
+			t.Errorf("%s %s: expected %s (%s), got %+v", test.tags, test.canon, test.result, test.reason, reports[0])
+		}
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := resolver.NewZone()
+	zone.AddTXT("sel._domainkey.example.com", "v=DKIM1; k=ed25519; p="+base64.StdEncoding.EncodeToString(pub))
+	signed := signMessage(testMessage, "a=ed25519-sha256; d=example.com; s=sel", "relaxed/relaxed", func(hashed []byte) []byte {
+		return ed25519.Sign(key, hashed)
+	})
+	// whitespace changes are allowed by relaxed canonicalization
+	signed = strings.Replace(signed, "Subject:  Test  ", "Subject: Test", 1)
+	signed = strings.Replace(signed, "Hello,  world", "Hello, world", 1)
+	reports := verify(zone, signed)
+	if len(reports) != 1 || reports[0].Result != PASS {
+		t.Errorf("unexpected reports: %+v", reports)
+	}
+	// unsigned email has no reports
+	if reports := verify(zone, testMessage); len(reports) != 0 {
+		t.Errorf("unexpected reports for unsigned email: %+v", reports)
+	}
+}
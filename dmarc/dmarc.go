@@ -0,0 +1,251 @@
+// Package dmarc evaluates Domain-based Message Authentication, Reporting
+// and Conformance (RFC 7489): SPF and DKIM results are aligned with the
+// header From domain and its published policy is found.
+package dmarc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/dkim"
+	"github.com/Polymail/go-falcon/resolver"
+	"github.com/Polymail/go-falcon/spf"
+	"golang.org/x/net/publicsuffix"
+)
+
+type Result string
+
+const (
+	NONE      Result = "none"
+	PASS      Result = "pass"
+	FAIL      Result = "fail"
+	TEMPERROR Result = "temperror"
+	PERMERROR Result = "permerror"
+
+	POLICY_NONE       = "none"
+	POLICY_QUARANTINE = "quarantine"
+	POLICY_REJECT     = "reject"
+
+	ALIGNMENT_RELAXED = "r"
+	ALIGNMENT_STRICT  = "s"
+
+	RECORD_PREFIX = "_dmarc."
+)
+
+// Report is DMARC verdict for header From domain
+type Report struct {
+	Domain      string // header From domain
+	OrgDomain   string // organizational domain of From domain
+	Result      Result
+	Policy      string // policy, which receiver applies on fail
+	Percent     int    // percent of failed messages policy is applied to
+	Record      string // matched DMARC record
+	SpfAligned  bool
+	DkimAligned bool
+	Reason      string
+}
+
+// Record is parsed DMARC record (s6.3)
+type Record struct {
+	Policy          string
+	SubdomainPolicy string
+	Dkim            string // DKIM alignment mode
+	Spf             string // SPF alignment mode
+	Percent         int
+}
+
+// Check evaluates DMARC of header From domain. spfReport is nil if SPF
+// wasn't checked.
+
+func Check(r resolver.Resolver, fromDomain string, spfReport *spf.Report, dkimReports []*dkim.Report) *Report {
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(fromDomain), "."))
+	report := &Report{Domain: domain, Result: NONE}
+	if domain == "" || !strings.Contains(domain, ".") {
+		report.Reason = "no valid From domain"
+		return report
+	}
+	report.OrgDomain = OrganizationalDomain(domain)
+
+	// policy of From domain, organizational domain is fallback (s6.6.3)
+	record, txt, err := lookupRecord(r, domain)
+	isSubdomain := false
+	if err == nil && record == nil && report.OrgDomain != domain {
+		record, txt, err = lookupRecord(r, report.OrgDomain)
+		isSubdomain = true
+	}
+	if err != nil {
+		report.Result, report.Reason = TEMPERROR, err.Error()
+		return report
+	}
+	if record == nil {
+		report.Reason = "no DMARC record"
+		return report
+	}
+	report.Record = txt
+	report.Policy, report.Percent = record.Policy, record.Percent
+	if isSubdomain && record.SubdomainPolicy != "" {
+		report.Policy = record.SubdomainPolicy
+	}
+
+	// identifier alignment (s3.1)
+	var reasons []string
+	if spfReport != nil && spfReport.Result == spf.PASS {
+		report.SpfAligned = isAligned(spfReport.Domain, domain, record.Spf)
+		if !report.SpfAligned {
+			reasons = append(reasons, fmt.Sprintf("SPF domain %s is not aligned", spfReport.Domain))
+		}
+	} else {
+		reasons = append(reasons, "SPF did not pass")
+	}
+	dkimPassed := false
+	for _, dkimReport := range dkimReports {
+		if dkimReport.Result != dkim.PASS {
+			continue
+		}
+		dkimPassed = true
+		if isAligned(dkimReport.Domain, domain, record.Dkim) {
+			report.DkimAligned = true
+			break
+		}
+	}
+	if !report.DkimAligned {
+		if dkimPassed {
+			reasons = append(reasons, "DKIM signing domain is not aligned")
+		} else {
+			reasons = append(reasons, "no valid DKIM signature")
+		}
+	}
+
+	if report.SpfAligned || report.DkimAligned {
+		report.Result = PASS
+		aligned := []string{}
+		if report.SpfAligned {
+			aligned = append(aligned, "SPF")
+		}
+		if report.DkimAligned {
+			aligned = append(aligned, "DKIM")
+		}
+		report.Reason = strings.Join(aligned, " and ") + " aligned with " + domain
+		return report
+	}
+	report.Result = FAIL
+	report.Reason = strings.Join(reasons, ", ")
+	if report.Percent < 100 {
+		report.Reason += fmt.Sprintf("; policy %s applies to %d%% of messages", report.Policy, report.Percent)
+	}
+	return report
+}
+
+// OrganizationalDomain is public suffix and one label (s3.2), domain
+// itself if it is public suffix
+
+func OrganizationalDomain(domain string) string {
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
+
+// relaxed mode requires same organizational domain, strict mode exact match
+
+func isAligned(authDomain, fromDomain, mode string) bool {
+	authDomain = strings.ToLower(strings.TrimSuffix(authDomain, "."))
+	if authDomain == "" {
+		return false
+	}
+	if mode == ALIGNMENT_STRICT {
+		return authDomain == fromDomain
+	}
+	return OrganizationalDomain(authDomain) == OrganizationalDomain(fromDomain)
+}
+
+// lookupRecord returns nil record if domain has no valid DMARC record
+
+func lookupRecord(r resolver.Resolver, domain string) (*Record, string, error) {
+	txts, err := r.LookupTXT(RECORD_PREFIX + domain)
+	if err != nil {
+		if resolver.IsNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("DNS error for %s%s: %v", RECORD_PREFIX, domain, err)
+	}
+	var (
+		record *Record
+		txt    string
+	)
+	for _, value := range txts {
+		parsed, err := ParseRecord(value)
+		if err != nil {
+			continue
+		}
+		if record != nil {
+			// several records are same as no record (s6.6.3)
+			return nil, "", nil
+		}
+		record, txt = parsed, value
+	}
+	return record, txt, nil
+}
+
+// ParseRecord parses "v=DMARC1; p=..." record. Unknown tags are ignored.
+
+func ParseRecord(txt string) (*Record, error) {
+	record := &Record{Dkim: ALIGNMENT_RELAXED, Spf: ALIGNMENT_RELAXED, Percent: 100}
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(tags[0]) != "v=DMARC1" {
+		return nil, fmt.Errorf("not a DMARC record")
+	}
+	hasRua := false
+	for _, tag := range tags[1:] {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(tag[:i])), strings.TrimSpace(tag[i+1:])
+		switch name {
+		case "p":
+			record.Policy = strings.ToLower(value)
+		case "sp":
+			record.SubdomainPolicy = strings.ToLower(value)
+			if !isPolicy(record.SubdomainPolicy) {
+				record.SubdomainPolicy = ""
+			}
+		case "adkim", "aspf":
+			mode := strings.ToLower(value)
+			if mode != ALIGNMENT_RELAXED && mode != ALIGNMENT_STRICT {
+				return nil, fmt.Errorf("invalid %s mode %q", name, value)
+			}
+			if name == "adkim" {
+				record.Dkim = mode
+			} else {
+				record.Spf = mode
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("invalid pct %q", value)
+			}
+			record.Percent = pct
+		case "rua":
+			hasRua = value != ""
+		}
+	}
+	if !isPolicy(record.Policy) {
+		// record with reports is used with none policy (s6.6.3)
+		if !hasRua {
+			return nil, fmt.Errorf("invalid policy %q", record.Policy)
+		}
+		record.Policy = POLICY_NONE
+	}
+	return record, nil
+}
+
+func isPolicy(policy string) bool {
+	return policy == POLICY_NONE || policy == POLICY_QUARANTINE || policy == POLICY_REJECT
+}
@@ -0,0 +1,96 @@
+package dmarc
+
+import (
+	"testing"
+
+	"github.com/Polymail/go-falcon/dkim"
+	"github.com/Polymail/go-falcon/resolver"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":            "example.com",
+		"mail.example.com":       "example.com",
+		"a.b.example.co.uk":      "example.co.uk",
+		"user.github.io":         "user.github.io",
+		"co.uk":                  "co.uk",
+		"mail.example.com.au":    "example.com.au",
+		"deep.sub.example.local": "example.local",
+	}
+	for domain, expected := range tests {
+		if orgDomain := OrganizationalDomain(domain); orgDomain != expected {
+			t.Errorf("%s: expected %s, got %s", domain, expected, orgDomain)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord("v=DMARC1; p=Reject; sp=quarantine; adkim=s; pct=20; rua=mailto:d@example.com")
+	if err != nil {
+		t.Fatalf("ParseRecord: %v", err)
+	}
+	if record.Policy != POLICY_REJECT || record.SubdomainPolicy != POLICY_QUARANTINE || record.Dkim != ALIGNMENT_STRICT || record.Spf != ALIGNMENT_RELAXED || record.Percent != 20 {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	invalid := []string{
+		"v=spf1 -all",
+		"p=reject; v=DMARC1",
+		"v=DMARC1; p=block",
+		"v=DMARC1; p=none; adkim=x",
+		"v=DMARC1; p=none; pct=101",
+	}
+	for _, txt := range invalid {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Errorf("%q: expected error", txt)
+		}
+	}
+	// invalid policy with reports is none policy
+	if record, err := ParseRecord("v=DMARC1; p=block; rua=mailto:d@example.com"); err != nil || record.Policy != POLICY_NONE {
+		t.Errorf("unexpected result: %+v, %v", record, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddTXT("_dmarc.example.com", "v=DMARC1; p=reject; sp=quarantine; aspf=s")
+	zone.AddTXT("_dmarc.example.org", "v=DMARC1; p=quarantine; pct=50")
+	zone.AddTXT("_dmarc.double.example", "v=DMARC1; p=reject", "v=DMARC1; p=none")
+	zone.AddFailure("_dmarc.broken.example")
+
+	spfPass := func(domain string) *spf.Report {
+		return &spf.Report{Identity: spf.IDENTITY_MAILFROM, Domain: domain, Result: spf.PASS}
+	}
+	dkimPass := func(domain string) []*dkim.Report {
+		return []*dkim.Report{{Domain: domain, Selector: "sel", Result: dkim.PASS}}
+	}
+	tests := []struct {
+		from   string
+		spf    *spf.Report
+		dkim   []*dkim.Report
+		result Result
+		policy string
+	}{
+		{"example.com", spfPass("example.com"), nil, PASS, POLICY_REJECT},
+		{"example.com", spfPass("mail.example.com"), nil, FAIL, POLICY_REJECT},
+		{"example.com", nil, dkimPass("mail.example.com"), PASS, POLICY_REJECT},
+		{"example.com", spfPass("example.net"), dkimPass("example.net"), FAIL, POLICY_REJECT},
+		{"example.com", nil, []*dkim.Report{{Domain: "example.com", Result: dkim.FAIL}}, FAIL, POLICY_REJECT},
+		{"news.example.com", nil, nil, FAIL, POLICY_QUARANTINE},
+		{"example.org", &spf.Report{Domain: "example.org", Result: spf.SOFTFAIL}, nil, FAIL, POLICY_QUARANTINE},
+		{"example.net", spfPass("example.net"), nil, NONE, ""},
+		{"double.example", nil, nil, NONE, ""},
+		{"broken.example", nil, nil, TEMPERROR, ""},
+		{"", nil, nil, NONE, ""},
+	}
+	for _, test := range tests {
+		report := Check(zone, test.from, test.spf, test.dkim)
+		if report.Result != test.result || report.Policy != test.policy {
+			t.Errorf("%q: expected %s/%s, got %+v", test.from, test.result, test.policy, report)
+		}
+	}
+	report := Check(zone, "example.org", nil, nil)
+	if report.Percent != 50 || report.Reason != "SPF did not pass, no valid DKIM signature; policy quarantine applies to 50% of messages" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
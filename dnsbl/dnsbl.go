@@ -0,0 +1,223 @@
+// Package dnsbl checks client IP addresses and sender domains in DNS
+// block lists (RFC 5782). Every listing adds zone weight to score.
+package dnsbl
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+const (
+	ACTION_NONE   = ""       // not listed
+	ACTION_RECORD = "record" // listings are only recorded
+	ACTION_TAG    = "tag"    // email is tagged by header
+	ACTION_REJECT = "reject" // email is rejected with 554
+)
+
+// Zone is block list, Rhsbl zones list domains instead of IPs
+type Zone struct {
+	Zone   string
+	Weight int
+	Rhsbl  bool
+}
+
+// Listing is one positive answer of block list
+type Listing struct {
+	Zone   string
+	Query  string
+	Weight int
+	Codes  []string // returned addresses, e.g. 127.0.0.2
+}
+
+// Result of checks, listings are sorted by zone
+type Result struct {
+	Score    int
+	Listings []*Listing
+}
+
+// Cache keeps answers of block lists. Empty codes mean "not listed".
+type Cache interface {
+	Get(query string) ([]string, bool)
+	Set(query string, codes []string)
+}
+
+type Checker struct {
+	Resolver resolver.Resolver
+	Zones    []Zone
+	Cache    Cache // optional
+}
+
+// CheckIP looks up ip in IP block lists
+
+func (c *Checker) CheckIP(ip net.IP) *Result {
+	name := reverseIP(ip)
+	if name == "" {
+		return &Result{}
+	}
+	return c.checkZones(name, false)
+}
+
+// CheckDomain looks up domain in RHSBL zones
+
+func (c *Checker) CheckDomain(domain string) *Result {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" || !strings.Contains(domain, ".") {
+		return &Result{}
+	}
+	return c.checkZones(domain, true)
+}
+
+// zones are queried in parallel, so slow list delays check only by its
+// own timeout
+
+func (c *Checker) checkZones(name string, rhsbl bool) *Result {
+	result := &Result{}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, zone := range c.Zones {
+		if zone.Rhsbl != rhsbl {
+			continue
+		}
+		wg.Add(1)
+		go func(zone Zone) {
+			defer wg.Done()
+			if listing := c.check(zone, name); listing != nil {
+				mu.Lock()
+				result.add(listing)
+				mu.Unlock()
+			}
+		}(zone)
+	}
+	wg.Wait()
+	return result
+}
+
+// listing of name in zone, nil if not listed
+
+func (c *Checker) check(zone Zone, name string) *Listing {
+	query := name + "." + strings.Trim(zone.Zone, ".")
+	codes, ok := []string(nil), false
+	if c.Cache != nil {
+		codes, ok = c.Cache.Get(query)
+	}
+	if !ok {
+		var err error
+		codes, err = c.lookup(query)
+		if err != nil {
+			// not cached, next check tries again
+			log.Errorf("DNSBL %s: %v", query, err)
+			return nil
+		}
+		if c.Cache != nil {
+			c.Cache.Set(query, codes)
+		}
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	return &Listing{Zone: zone.Zone, Query: query, Weight: zone.Weight, Codes: codes}
+}
+
+// lookup returns listing codes, empty if name is not listed
+
+func (c *Checker) lookup(query string) ([]string, error) {
+	ips, err := c.Resolver.LookupIP("ip4", query)
+	if err != nil {
+		if resolver.IsNotFound(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	codes := []string{}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		// only 127.0.0.0/8 is listing (RFC 5782 s2.1), 127.255.255.0/24
+		// are errors of list, e.g. query through public resolver
+		if ip4 == nil || ip4[0] != 127 {
+			continue
+		}
+		if ip4[1] == 255 && ip4[2] == 255 {
+			return nil, fmt.Errorf("list error code %s", ip4)
+		}
+		codes = append(codes, ip4.String())
+	}
+	sort.Strings(codes)
+	return codes, nil
+}
+
+func (r *Result) add(listing *Listing) {
+	r.Score += listing.Weight
+	r.Listings = append(r.Listings, listing)
+	sort.Slice(r.Listings, func(i, j int) bool {
+		return r.Listings[i].Query < r.Listings[j].Query
+	})
+}
+
+// Merge adds listings of other result, which are not in result yet
+
+func (r *Result) Merge(other *Result) {
+	if other == nil {
+		return
+	}
+	for _, listing := range other.Listings {
+		found := false
+		for _, existing := range r.Listings {
+			if existing.Query == listing.Query {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r.add(listing)
+		}
+	}
+}
+
+// Action for score, zero score limit disables action
+
+func (r *Result) Action(rejectScore, tagScore int) string {
+	switch {
+	case len(r.Listings) == 0:
+		return ACTION_NONE
+	case rejectScore > 0 && r.Score >= rejectScore:
+		return ACTION_REJECT
+	case tagScore > 0 && r.Score >= tagScore:
+		return ACTION_TAG
+	}
+	return ACTION_RECORD
+}
+
+// Zones returns listed zones, e.g. for reply to client
+
+func (r *Result) Zones() []string {
+	zones := []string{}
+	for _, listing := range r.Listings {
+		zones = append(zones, listing.Zone)
+	}
+	return zones
+}
+
+// IPv4 as reversed octets, IPv6 as reversed nibbles (RFC 5782 s2.4)
+
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
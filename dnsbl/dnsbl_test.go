@@ -0,0 +1,167 @@
+package dnsbl
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+// cache in map, counts lookups
+
+type testCache struct {
+	mu      sync.Mutex
+	answers map[string][]string
+	sets    int
+}
+
+func (c *testCache) Get(query string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	codes, ok := c.answers[query]
+	return codes, ok
+}
+
+func (c *testCache) Set(query string, codes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.answers[query] = codes
+	c.sets++
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.99":                "99.2.0.192",
+		"::ffff:1.2.3.4":            "4.3.2.1",
+		"2001:db8:1:2:3:4:567:89ab": "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2",
+	}
+	for ip, expected := range tests {
+		if name := reverseIP(net.ParseIP(ip)); name != expected {
+			t.Errorf("%s: expected %s, got %s", ip, expected, name)
+		}
+	}
+	if name := reverseIP(nil); name != "" {
+		t.Errorf("nil: expected empty name, got %s", name)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddIP("2.0.0.127.bl.example", "127.0.0.2", "127.0.0.4")
+	zone.AddIP("2.0.0.127.small.example", "127.0.0.3")
+	zone.AddIP("2.0.0.127.broken.example", "127.255.255.254")
+	cache := &testCache{answers: map[string][]string{}}
+	checker := &Checker{
+		Resolver: zone,
+		Zones: []Zone{
+			{Zone: "bl.example", Weight: 5},
+			{Zone: "small.example", Weight: 1},
+			{Zone: "broken.example", Weight: 5},
+		},
+		Cache: cache,
+	}
+
+	result := checker.CheckIP(net.ParseIP("127.0.0.2"))
+	if result.Score != 6 || !reflect.DeepEqual(result.Zones(), []string{"bl.example", "small.example"}) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if codes := result.Listings[0].Codes; !reflect.DeepEqual(codes, []string{"127.0.0.2", "127.0.0.4"}) {
+		t.Errorf("unexpected codes: %v", codes)
+	}
+	// error code of broken list is not cached
+	if cache.sets != 2 {
+		t.Errorf("expected 2 cached answers, got %d", cache.sets)
+	}
+	// second check is answered from cache
+	checker.Resolver = resolver.NewZone()
+	if result := checker.CheckIP(net.ParseIP("127.0.0.2")); result.Score != 6 {
+		t.Errorf("unexpected cached result: %+v", result)
+	}
+}
+
+func TestCheckIPv6AndDomain(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddIP("b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.bl.example", "127.0.0.2")
+	zone.AddIP("spam.example.dbl.example", "127.0.1.2")
+	zone.AddFailure("3.0.0.127.bl.example")
+	checker := &Checker{
+		Resolver: zone,
+		Zones: []Zone{
+			{Zone: "bl.example", Weight: 5},
+			{Zone: "dbl.example", Weight: 3, Rhsbl: true},
+		},
+	}
+	result := checker.CheckIP(net.ParseIP("2001:db8:1:2:3:4:567:89ab"))
+	if result.Score != 5 {
+		t.Errorf("unexpected IPv6 result: %+v", result)
+	}
+	domainResult := checker.CheckDomain("Spam.Example.")
+	if domainResult.Score != 3 || domainResult.Listings[0].Query != "spam.example.dbl.example" {
+		t.Errorf("unexpected domain result: %+v", domainResult)
+	}
+	result.Merge(domainResult)
+	result.Merge(domainResult)
+	if result.Score != 8 || len(result.Listings) != 2 {
+		t.Errorf("unexpected merged result: %+v", result)
+	}
+	// temporary failure is not listing
+	if result := checker.CheckIP(net.ParseIP("127.0.0.3")); len(result.Listings) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result := checker.CheckDomain("localhost"); len(result.Listings) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+// every lookup takes delay
+
+type slowResolver struct {
+	*resolver.Zone
+	delay time.Duration
+}
+
+func (r slowResolver) LookupIP(network, host string) ([]net.IP, error) {
+	time.Sleep(r.delay)
+	return r.Zone.LookupIP(network, host)
+}
+
+func TestCheckParallel(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddIP("2.0.0.127.one.example", "127.0.0.2")
+	zone.AddIP("2.0.0.127.two.example", "127.0.0.2")
+	checker := &Checker{
+		Resolver: slowResolver{zone, 200 * time.Millisecond},
+		Zones:    []Zone{{Zone: "one.example", Weight: 1}, {Zone: "two.example", Weight: 1}, {Zone: "three.example", Weight: 1}},
+	}
+	start := time.Now()
+	result := checker.CheckIP(net.ParseIP("127.0.0.2"))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("zones are not queried in parallel, check took %v", elapsed)
+	}
+	if !reflect.DeepEqual(result.Zones(), []string{"one.example", "two.example"}) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestAction(t *testing.T) {
+	listed := &Result{Score: 4, Listings: []*Listing{{Zone: "bl.example", Weight: 4}}}
+	tests := []struct {
+		result      *Result
+		reject, tag int
+		action      string
+	}{
+		{&Result{}, 1, 1, ACTION_NONE},
+		{listed, 4, 2, ACTION_REJECT},
+		{listed, 5, 2, ACTION_TAG},
+		{listed, 5, 0, ACTION_RECORD},
+		{listed, 0, 0, ACTION_RECORD},
+	}
+	for _, test := range tests {
+		if action := test.result.Action(test.reject, test.tag); action != test.action {
+			t.Errorf("%d/%d: expected %q, got %q", test.reject, test.tag, test.action, action)
+		}
+	}
+}
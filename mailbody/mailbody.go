@@ -0,0 +1,173 @@
+// Package mailbody keeps data of received emails. Small emails stay in
+// memory, bigger ones are written to temp file, so emails waiting for
+// storage workers don't exhaust memory. Parser, scanners and storage
+// read body through io.ReaderAt.
+package mailbody
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	DEFAULT_MEMORY_SIZE = 1048576 // 1 MB
+	TEMP_FILE_PREFIX    = "falcon-mail-"
+)
+
+// Body is written by smtpd session and read by storage worker after
+// envelope is queued
+type Body struct {
+	memorySize int64
+	tempDir    string
+
+	buf  []byte
+	size int64
+
+	path     string // file with data, empty if data is in memory
+	temp     bool   // file is removed on Close
+	file     *os.File
+	openOnce sync.Once
+	openErr  error
+}
+
+// New empty body, data above memory size is written to temp file in
+// temp directory (default directory for temp files if empty)
+
+func New(memorySize int64, tempDir string) *Body {
+	return &Body{memorySize: memorySize, tempDir: tempDir}
+}
+
+// FromBytes body with data in memory
+
+func FromBytes(data []byte) *Body {
+	return &Body{memorySize: int64(len(data)), buf: data, size: int64(len(data))}
+}
+
+// Open body with data in existing file, file is opened on first read
+// and isn't removed on Close
+
+func Open(path string) (*Body, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Body{path: path, size: info.Size()}, nil
+}
+
+// Write appends data, first write above memory size moves data to file
+
+func (b *Body) Write(p []byte) (int, error) {
+	if b.path == "" && b.size+int64(len(p)) > b.memorySize {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if b.path == "" {
+		b.buf = append(b.buf, p...)
+		b.size += int64(len(p))
+		return len(p), nil
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// move data from memory to temp file
+
+func (b *Body) spill() error {
+	file, err := ioutil.TempFile(b.tempDir, TEMP_FILE_PREFIX)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(b.buf); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	b.buf = nil
+	b.path, b.temp, b.file = file.Name(), true, file
+	return nil
+}
+
+func (b *Body) ReadAt(p []byte, off int64) (int, error) {
+	if b.path == "" {
+		if off >= int64(len(b.buf)) {
+			return 0, io.EOF
+		}
+		n := copy(p, b.buf[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if err := b.open(); err != nil {
+		return 0, err
+	}
+	if b.file == nil {
+		return 0, os.ErrClosed
+	}
+	return b.file.ReadAt(p, off)
+}
+
+func (b *Body) open() error {
+	b.openOnce.Do(func() {
+		if b.file == nil {
+			b.file, b.openErr = os.Open(b.path)
+		}
+	})
+	return b.openErr
+}
+
+func (b *Body) Size() int64 {
+	return b.size
+}
+
+// Reader of whole body, every reader has own position
+
+func (b *Body) Reader() *io.SectionReader {
+	return io.NewSectionReader(b, 0, b.size)
+}
+
+// Close releases data, temp file is removed
+
+func (b *Body) Close() error {
+	b.buf = nil
+	var err error
+	if b.file != nil {
+		err = b.file.Close()
+		b.file = nil
+	}
+	if b.temp {
+		if removeErr := os.Remove(b.path); removeErr != nil && err == nil {
+			err = removeErr
+		}
+		b.temp = false
+	}
+	return err
+}
+
+// WithPrefix returns data of r after prefix, e.g. email with new headers
+
+func WithPrefix(prefix []byte, r io.ReaderAt, size int64) *io.SectionReader {
+	return io.NewSectionReader(&prefixReader{prefix: prefix, r: r}, 0, int64(len(prefix))+size)
+}
+
+type prefixReader struct {
+	prefix []byte
+	r      io.ReaderAt
+}
+
+func (p *prefixReader) ReadAt(buf []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(p.prefix)) {
+		n = copy(buf, p.prefix[off:])
+		if n == len(buf) {
+			return n, nil
+		}
+		off = int64(len(p.prefix))
+	}
+	m, err := p.r.ReadAt(buf[n:], off-int64(len(p.prefix)))
+	return n + m, err
+}
@@ -0,0 +1,75 @@
+package mailbody
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpill(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "falcon-mailbody")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	b := New(8, tempDir)
+	b.Write([]byte("Subject:"))
+	if b.path != "" {
+		t.Fatalf("body within memory size is in file")
+	}
+	b.Write([]byte(" test\r\n\r\nbody\r\n"))
+	if !b.temp {
+		t.Fatalf("body above memory size isn't in temp file")
+	}
+	data, err := ioutil.ReadAll(b.Reader())
+	if err != nil || string(data) != "Subject: test\r\n\r\nbody\r\n" || b.Size() != int64(len(data)) {
+		t.Errorf("unexpected body %q (%d), err %v", data, b.Size(), err)
+	}
+	path := b.path
+	if err := b.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("temp file isn't removed")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	f, err := ioutil.TempFile("", "falcon-mailbody")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Subject: test\n\nbody\n")
+	f.Close()
+
+	b, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, _ := ioutil.ReadAll(b.Reader())
+	if string(data) != "Subject: test\n\nbody\n" {
+		t.Errorf("unexpected body %q", data)
+	}
+	b.Close()
+	// spool file is kept
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Errorf("file is removed: %v", err)
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	body := "Subject: test\n\nbody\n"
+	r := WithPrefix([]byte("Received: by test\n"), strings.NewReader(body), int64(len(body)))
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "Received: by test\nSubject: test\n\nbody\n" {
+		t.Errorf("unexpected data %q, err %v", data, err)
+	}
+	// read across prefix end
+	buf := make([]byte, 6)
+	if n, _ := r.ReadAt(buf, 15); string(buf[:n]) != "st\nSub" {
+		t.Errorf("unexpected ReadAt %q", buf[:n])
+	}
+}
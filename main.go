@@ -22,6 +22,8 @@ func main() {
 	log.Debugf("Loaded config: %+v", globalConfig)
 	// start nginx proxy
 	proxy.StartNginxHTTPProxy(globalConfig)
+	// graceful shutdown
+	daemon.OnShutdown(protocol.Shutdown)
 	// start pop3 server
 	protocol.StartPop3Server(globalConfig)
 	// start smtp server
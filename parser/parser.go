@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bytes"
+	"errors"
 	"github.com/Polymail/go-falcon/go_multipart_pacthed"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
@@ -26,7 +27,8 @@ type ParsedAttachment struct {
 type ParsedEmail struct {
 	env       *smtpd.BasicEnvelope
 	MailboxID int
-	RawMail   []byte
+	RawMail   io.ReaderAt // data of envelope
+	RawSize   int64
 
 	Subject string
 	Date    time.Time
@@ -52,7 +54,7 @@ func extractFromToHeader(header string) mail.Address {
 func getFromOrToHeader(email *ParsedEmail, headerType string) mail.Address {
 	mailAddressRes := mail.Address{}
 
-	emailHeader := email.Headers.Get(headerType)
+	emailHeader := decodeRawHeader(email.Headers.Get(headerType))
 	if emailHeader != "" {
 		toEmail, err := mail.ParseAddress(emailHeader)
 		if err != nil {
@@ -138,18 +140,15 @@ func (email *ParsedEmail) parseEmailByType(headers textproto.MIMEHeader, pbody [
 		if err != nil {
 			log.Errorf("Failed parsing message of rfc822: %v", err)
 		} else {
-			mailBody, err := ioutil.ReadAll(msg.Body)
-			if err != nil {
+			email.Headers = msg.Header
+			if err := email.parseEmailBody(msg.Body); err != nil {
 				log.Errorf("Failed parsing message of rfc822: %v", err)
-			} else {
-				email.Headers = msg.Header
-				email.parseEmailBody(mailBody)
 			}
 		}
 	default:
 		// multipart
 		if strings.HasPrefix(contentTypeVal, "multipart/") {
-			email.parseMimeEmail(pbody, contentTypeParams["boundary"])
+			email.parseMimeEmail(bytes.NewReader(pbody), contentTypeParams["boundary"])
 		} else if contentDisposition != "" {
 			email.parseAttachment(headers, contentTypeVal, contentDispositionVal, contentTransferEncoding, contentTypeParams, contentDispositionParams, pbody)
 			// attachments without content disposition (sic!)
@@ -227,16 +226,15 @@ func (email *ParsedEmail) parsePlainEmail() {
 	email.parseEmailByType(textproto.MIMEHeader(email.Headers), email.EmailBody)
 }
 
-// parse plain email
+// parse mime email, parts are read one by one
 
-func (email *ParsedEmail) parseMimeEmail(pbody []byte, boundary string) {
+func (email *ParsedEmail) parseMimeEmail(body io.Reader, boundary string) {
 	if boundary == "" {
 		log.Errorf("Doesn't found boundary in MIME: %s", boundary)
 		return
 	}
 
-	bodyReader := bytes.NewReader(pbody)
-	reader := go_multipart_pacthed.NewReader(bodyReader, boundary)
+	reader := go_multipart_pacthed.NewReader(body, boundary)
 
 	for {
 		p, err := reader.NextPart()
@@ -252,10 +250,9 @@ func (email *ParsedEmail) parseMimeEmail(pbody []byte, boundary string) {
 	}
 }
 
-// parse body
+// parse body, only body of plain email is read in memory
 
-func (email *ParsedEmail) parseEmailBody(body []byte) {
-	email.EmailBody = body
+func (email *ParsedEmail) parseEmailBody(body io.Reader) error {
 	mimeVersion := email.Headers.Get("Mime-Version")
 	contentType := email.Headers.Get("Content-Type")
 	if contentType == "" {
@@ -264,31 +261,36 @@ func (email *ParsedEmail) parseEmailBody(body []byte) {
 	contentTypeVal, contentTypeParams, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		log.Errorf("Invalid ContentType: %v", err)
-		return
+		return nil
 	}
 	if mimeVersion != "" && strings.HasPrefix(strings.ToLower(contentTypeVal), "multipart/") && contentTypeParams["boundary"] != "" {
-		email.parseMimeEmail(email.EmailBody, contentTypeParams["boundary"])
-	} else {
-		email.parsePlainEmail()
+		email.parseMimeEmail(body, contentTypeParams["boundary"])
+		return nil
+	}
+	email.EmailBody, err = ioutil.ReadAll(body)
+	if err != nil {
+		return err
 	}
+	email.parsePlainEmail()
+	return nil
 }
 
 // parse email
 
 func ParseMail(env *smtpd.BasicEnvelope) (*ParsedEmail, error) {
-	email := &ParsedEmail{env: env, MailboxID: env.MailboxID}
-	msg, err := mail.ReadMessage(bytes.NewBuffer(email.env.MailBody))
+	if env.MailBody == nil {
+		return nil, errors.New("Email without data")
+	}
+	email := &ParsedEmail{env: env, MailboxID: env.MailboxID, RawMail: env.MailBody, RawSize: env.MailBody.Size()}
+	msg, err := mail.ReadMessage(env.MailBody.Reader())
 	if err != nil {
 		log.Errorf("Failed parsing ReadMessage: %v", err)
 		return nil, err
 	}
-	mailBody, err := ioutil.ReadAll(msg.Body)
-	if err != nil {
+	email.parseEmailHeaders(msg)
+	if err = email.parseEmailBody(msg.Body); err != nil {
 		log.Errorf("Failed parsing ReadAll: %v", err)
 		return nil, err
 	}
-	email.RawMail = email.env.MailBody
-	email.parseEmailHeaders(msg)
-	email.parseEmailBody(mailBody)
 	return email, nil
 }
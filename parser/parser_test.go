@@ -3,6 +3,7 @@ package parser
 import (
 	"encoding/json"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/mailbody"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
@@ -1080,7 +1081,7 @@ func (s *ParserSuite) TestGoodMailParser(c *C) {
 		}
 		testBody := strings.Replace(string(RawBody), "\n", "\r\n", -1)
 		// parse email
-		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: []byte(testBody)}
+		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: mailbody.FromBytes([]byte(testBody))}
 		email, err := ParseMail(envelop)
 		c.Assert(err, IsNil)
 		if email == nil || err != nil {
@@ -1132,7 +1133,7 @@ func (s *ParserSuite) BenchmarkParser(c *C) {
 		}
 		testBody := strings.Replace(string(RawBody), "\n", "\r\n", -1)
 		// parse email
-		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: []byte(testBody)}
+		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: mailbody.FromBytes([]byte(testBody))}
 		_, mailErr := ParseMail(envelop)
 		if mailErr != nil {
 			c.Errorf("Error in parsing email: %v", err)
@@ -1146,7 +1147,7 @@ func (s *ParserSuite) TestBadMailParser(c *C) {
 	for _, mail := range badMailTypeTests {
 		testBody := strings.Replace(mail.RawBody, "\n", "\r\n", -1)
 		// parse email
-		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: []byte(testBody)}
+		envelop := &smtpd.BasicEnvelope{MailboxID: 0, MailBody: mailbody.FromBytes([]byte(testBody))}
 		email, err := ParseMail(envelop)
 		c.Assert(err, NotNil)
 		if err == nil {
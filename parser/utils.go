@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/Polymail/go-falcon/iconv"
 	"github.com/Polymail/go-falcon/utils"
@@ -17,6 +18,7 @@ import (
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/encoding/traditionalchinese"
 	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
@@ -66,6 +68,17 @@ func fixInvalidEscapedAttachmentName(str string) string {
 
 // encode Mime
 
+// raw UTF-8 in headers (RFC 6532), invalid bytes are removed
+
+func decodeRawHeader(str string) string {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= utf8.RuneSelf {
+			return norm.NFC.String(utils.CheckAndFixUtf8(str))
+		}
+	}
+	return str
+}
+
 func MimeHeaderDecode(str string) string {
 	str = collapseAdjacentEncodings(str)
 	for _, word := range mimeHeaderRE.FindAllStringSubmatch(str, -1) {
@@ -68,3 +68,28 @@ func TestMimeHeaderDecode(t *testing.T) {
 		expectEq(t, header.To, decodedHeader, "Value of decoded header")
 	}
 }
+
+type fromToHeaderTest struct {
+	Header  string
+	Name    string
+	Address string
+}
+
+var fromToHeaderTests = []fromToHeaderTest{
+	{"Jörg Doe <jörg@example.com>", "Jörg Doe", "jörg@example.com"},
+	{"\"山田 太郎\" <太郎@例え.jp>", "山田 太郎", "太郎@例え.jp"},
+	{"=?utf-8?q?J=C3=B6rg_Doe?= <joerg@example.com>", "Jörg Doe", "joerg@example.com"},
+	// decomposed "ö" is normalized to NFC
+	{"Jo\u0308rg <jo\u0308rg@example.com>", "Jörg", "jörg@example.com"},
+	// invalid UTF-8 bytes are dropped
+	{"J\xf6rg <joerg@example.com>", "Jrg", "joerg@example.com"},
+}
+
+func TestGetFromOrToHeader(t *testing.T) {
+	for _, header := range fromToHeaderTests {
+		email := &ParsedEmail{Headers: map[string][]string{"From": {header.Header}}}
+		address := getFromOrToHeader(email, "From")
+		expectEq(t, header.Name, address.Name, "Name of From header")
+		expectEq(t, header.Address, address.Address, "Address of From header")
+	}
+}
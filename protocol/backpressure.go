@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+)
+
+const (
+	BACKPRESSURE_LOG_INTERVAL = 60 // seconds between warnings
+)
+
+var (
+	errInsufficientResources = smtpd.SMTPError("451 4.3.1 Error: insufficient system resources")
+)
+
+// backpressure refuses new emails while storage workers fall behind,
+// so sessions don't wait for full queue
+
+type backpressure struct {
+	queueHighWater int
+	spoolHighWater int
+	queueTimeout   time.Duration
+
+	mu         sync.Mutex
+	lastWarned time.Time
+}
+
+func newBackpressure(config *config.Config) *backpressure {
+	return &backpressure{
+		queueHighWater: config.Backpressure.Queue_High_Water,
+		spoolHighWater: config.Backpressure.Spool_High_Water,
+		queueTimeout:   time.Duration(config.Backpressure.Queue_Timeout) * time.Second,
+	}
+}
+
+// check queue and spool on MAIL FROM
+
+func (b *backpressure) checkMail() error {
+	if depth := len(SaveMailChan); depth >= b.queueHighWater {
+		b.warnf("Backpressure: %d emails in queue, high water mark %d", depth, b.queueHighWater)
+		return errInsufficientResources
+	}
+	if MailSpool != nil {
+		if pending := MailSpool.Pending(); pending >= b.spoolHighWater {
+			b.warnf("Backpressure: %d emails in spool, high water mark %d", pending, b.spoolHighWater)
+			return errInsufficientResources
+		}
+	}
+	return nil
+}
+
+// queue email for storage workers, wait for free place at most queue
+// timeout
+
+func (b *backpressure) queue(e *smtpd.BasicEnvelope) error {
+	e.QueuedAt = time.Now()
+	select {
+	case SaveMailChan <- e:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	select {
+	case SaveMailChan <- e:
+		return nil
+	case <-timer.C:
+	}
+	log.Errorf("Backpressure: queue is full for %v", b.queueTimeout)
+	// client sends email again, spool entry would be a duplicate
+	if MailSpool != nil {
+		if err := MailSpool.Remove(e.SpoolID); err != nil {
+			log.Errorf("Spool remove: %v", err)
+		}
+	}
+	return errInsufficientResources
+}
+
+// log warning once per interval
+
+func (b *backpressure) warnf(format string, args ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.lastWarned) < BACKPRESSURE_LOG_INTERVAL*time.Second {
+		return
+	}
+	b.lastWarned = time.Now()
+	log.Errorf(format, args...)
+}
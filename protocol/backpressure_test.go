@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spool"
+)
+
+// replaces queue and spool of server, restored by returned function
+
+func setupTestQueue(t *testing.T, size int) func() {
+	directory, err := ioutil.TempDir("", "falcon-spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	mailSpool, err := spool.Open(directory)
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatalf("Open: %v", err)
+	}
+	saveMailChan, savedSpool := SaveMailChan, MailSpool
+	SaveMailChan = make(chan *smtpd.BasicEnvelope, size)
+	MailSpool = mailSpool
+	return func() {
+		SaveMailChan, MailSpool = saveMailChan, savedSpool
+		os.RemoveAll(directory)
+	}
+}
+
+func newTestEnvelope(t *testing.T) *smtpd.BasicEnvelope {
+	e := &smtpd.BasicEnvelope{
+		MailboxID: 42,
+		From:      smtpd.NewMailAddress("from@example.com"),
+		Rcpts:     []smtpd.MailAddress{smtpd.NewMailAddress("to@example.com")},
+		MailBody:  mailbody.FromBytes([]byte("Subject: test\r\n\r\nbody\r\n")),
+	}
+	if err := MailSpool.Store(e); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	return e
+}
+
+func TestBackpressureCheckMail(t *testing.T) {
+	defer setupTestQueue(t, 3)()
+	serverConfig := config.NewConfig()
+	serverConfig.Backpressure.Queue_High_Water = 2
+	serverConfig.Backpressure.Spool_High_Water = 4
+	b := newBackpressure(serverConfig)
+
+	SaveMailChan <- newTestEnvelope(t)
+	if err := b.checkMail(); err != nil {
+		t.Errorf("Unexpected error below queue high water: %v", err)
+	}
+	SaveMailChan <- newTestEnvelope(t)
+	if err := b.checkMail(); err != errInsufficientResources {
+		t.Errorf("Expected insufficient resources at queue high water, got %v", err)
+	}
+
+	// queue is empty, but spool is full
+	<-SaveMailChan
+	<-SaveMailChan
+	newTestEnvelope(t)
+	if err := b.checkMail(); err != nil {
+		t.Errorf("Unexpected error below spool high water: %v", err)
+	}
+	newTestEnvelope(t)
+	if err := b.checkMail(); err != errInsufficientResources {
+		t.Errorf("Expected insufficient resources at spool high water, got %v", err)
+	}
+}
+
+func TestBackpressureQueueTimeout(t *testing.T) {
+	defer setupTestQueue(t, 1)()
+	serverConfig := config.NewConfig()
+	serverConfig.Backpressure.Queue_Timeout = 1
+	b := newBackpressure(serverConfig)
+
+	queued := newTestEnvelope(t)
+	if err := b.queue(queued); err != nil {
+		t.Fatalf("Unexpected error for free queue: %v", err)
+	}
+	if queued.QueuedAt.IsZero() {
+		t.Errorf("Queued time is not set")
+	}
+
+	// queue is full, entry is removed from spool after timeout
+	rejected := newTestEnvelope(t)
+	if err := b.queue(rejected); err != errInsufficientResources {
+		t.Errorf("Expected insufficient resources for full queue, got %v", err)
+	}
+	if pending := MailSpool.Pending(); pending != 1 {
+		t.Errorf("Expected 1 pending spool entry, got %d", pending)
+	}
+	if _, err := MailSpool.Load(rejected.SpoolID); err == nil {
+		t.Errorf("Spool entry %s is not removed", rejected.SpoolID)
+	}
+
+	// place is freed while waiting
+	go func() {
+		<-SaveMailChan
+	}()
+	if err := b.queue(newTestEnvelope(t)); err != nil {
+		t.Errorf("Unexpected error after queue is freed: %v", err)
+	}
+}
+
+func TestGetQueueStats(t *testing.T) {
+	defer setupTestQueue(t, 10)()
+	serverConfig := config.NewConfig()
+	serverConfig.Adapter.Workers_Size = 3
+	serverConfig.Backpressure.Queue_High_Water = 8
+	serverConfig.Backpressure.Spool_High_Water = 100
+
+	SaveMailChan <- newTestEnvelope(t)
+	newTestEnvelope(t)
+	stats := getQueueStats(serverConfig)
+	if stats.QueueDepth != 1 || stats.QueueSize != 10 || stats.QueueHighWater != 8 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+	if stats.SpoolDepth != 2 || stats.SpoolHighWater != 100 {
+		t.Errorf("Unexpected spool stats: %+v", stats)
+	}
+	if stats.Workers != 3 {
+		t.Errorf("Unexpected workers: %+v", stats)
+	}
+	// queue isn't empty and no email is taken from it
+	if stats.WorkerLag <= 0 {
+		t.Errorf("Expected worker lag for stuck queue, got %v", stats.WorkerLag)
+	}
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dnsbl"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/redisworker"
+)
+
+const (
+	DNSBL_CONNECTIONS_SIZE = 10000 // connect results in memory
+)
+
+// blocklists checks client address on connect and sender domain on
+// MAIL FROM. Connect result is reused on MAIL FROM, unless XCLIENT
+// changed client address.
+
+type blocklists struct {
+	checker     *dnsbl.Checker
+	rejectScore int
+	connections *cache.LRU // client address and port -> result of IP check
+}
+
+func newBlocklists(config *config.Config) *blocklists {
+	checker := &dnsbl.Checker{Resolver: config.Resolver, Zones: config.Dnsbl.Zones}
+	cacheTtl := time.Duration(config.Dnsbl.Cache_Ttl) * time.Second
+	if config.Redis.Enabled {
+		checker.Cache = &redisworker.DnsblCache{Config: config}
+	} else {
+		checker.Cache = cache.NewMemoryDnsblCache(cacheTtl)
+	}
+	return &blocklists{
+		checker:     checker,
+		rejectScore: config.Dnsbl.Reject_Score,
+		connections: cache.NewLRU(DNSBL_CONNECTIONS_SIZE, cacheTtl),
+	}
+}
+
+// reject client address before greeting
+
+func (b *blocklists) onNewConnection(c smtpd.Connection) error {
+	ip := connectionIP(c)
+	if ip == nil {
+		return nil
+	}
+	result := b.checker.CheckIP(ip)
+	b.connections.Set(c.Addr().String(), result)
+	return b.rejectError(ip, result)
+}
+
+// result of IP check on connect, address of connection is the same
+// until XCLIENT changes it
+
+func (b *blocklists) checkIP(c smtpd.Connection, ip net.IP) *dnsbl.Result {
+	if value, ok := b.connections.Get(c.Addr().String()); ok {
+		return value.(*dnsbl.Result)
+	}
+	return b.checker.CheckIP(ip)
+}
+
+// check client address and sender domain for new email
+
+func (b *blocklists) checkMail(c smtpd.Connection, from smtpd.MailAddress) (*dnsbl.Result, error) {
+	result := &dnsbl.Result{}
+	ip := connectionIP(c)
+	if ip != nil {
+		// connect result is shared, merge copies its listings
+		result.Merge(b.checkIP(c, ip))
+	}
+	if from != nil {
+		result.Merge(b.checker.CheckDomain(from.Hostname()))
+	}
+	if err := b.rejectError(ip, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (b *blocklists) rejectError(ip net.IP, result *dnsbl.Result) error {
+	if result.Action(b.rejectScore, 0) != dnsbl.ACTION_REJECT {
+		return nil
+	}
+	log.Infof("DNSBL: rejecting %v, score %d, listed in %s", ip, result.Score, strings.Join(result.Zones(), ", "))
+	return smtpd.SMTPError(fmt.Sprintf("554 5.7.1 Service unavailable; blocked using %s", strings.Join(result.Zones(), ", ")))
+}
+
+func connectionIP(c smtpd.Connection) net.IP {
+	if tcpAddr, ok := c.Addr().(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
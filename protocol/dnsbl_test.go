@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dnsbl"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+type testConnection struct {
+	addr net.Addr
+}
+
+func (c *testConnection) Addr() net.Addr {
+	return c.addr
+}
+
+// counts lookups of names
+
+type countingResolver struct {
+	*resolver.Zone
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (r *countingResolver) LookupIP(network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	r.lookups[host]++
+	r.mu.Unlock()
+	return r.Zone.LookupIP(network, host)
+}
+
+func TestBlocklistsReuseConnectResult(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddIP("2.0.0.127.bl.example", "127.0.0.2")
+	zone.AddFailure("3.0.0.127.bl.example")
+	r := &countingResolver{Zone: zone, lookups: make(map[string]int)}
+	serverConfig := config.NewConfig()
+	serverConfig.Resolver = r
+	serverConfig.Dnsbl.Zones = []dnsbl.Zone{{Zone: "bl.example", Weight: 1}}
+	serverConfig.Dnsbl.Cache_Ttl = 3600
+	b := newBlocklists(serverConfig)
+
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+		c := &testConnection{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}}
+		if err := b.onNewConnection(c); err != nil {
+			t.Fatalf("%s: unexpected connect error: %v", ip, err)
+		}
+		for i := 0; i < 2; i++ {
+			result, err := b.checkMail(c, smtpd.NewMailAddress("from@example.com"))
+			if err != nil {
+				t.Fatalf("%s: unexpected mail error: %v", ip, err)
+			}
+			if ip == "127.0.0.2" && result.Score != 1 {
+				t.Errorf("%s: unexpected result %+v", ip, result)
+			}
+		}
+	}
+	// failed lookup isn't cached, but connect result is reused
+	for name, lookups := range r.lookups {
+		if lookups != 1 {
+			t.Errorf("%s: expected 1 lookup, got %d", name, lookups)
+		}
+	}
+
+	// XCLIENT changes address, IP is checked again
+	c := &testConnection{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.3")}}
+	b.checkMail(c, nil)
+	if lookups := r.lookups["3.0.0.127.bl.example"]; lookups != 2 {
+		t.Errorf("expected new lookup for changed address, got %d lookups", lookups)
+	}
+}
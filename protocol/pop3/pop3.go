@@ -3,35 +3,58 @@ package pop3
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/protocol/proxyproto"
 	"github.com/Polymail/go-falcon/utils"
 	"io"
 	"net"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 )
 
+const (
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+	ErrServerClosed = errors.New("pop3: Server closed")
+)
+
 // Server is an SMTP server.
 type Server struct {
 	Addr         string        // TCP address to listen on, ":2525" if empty
+	TLSAddr      string        // TCP address for implicit TLS (POP3S), used by ListenAndServeTLS
 	Hostname     string        // optional Hostname to announce; "" to use system hostname
 	ReadTimeout  time.Duration // optional read timeout
 	WriteTimeout time.Duration // optional write timeout
 
 	TLSconfig *tls.Config // tls config
 
+	// ProxyNetworks are trusted load balancers, which send PROXY protocol
+	// header with real client address. Disabled if empty.
+	ProxyNetworks []*net.IPNet
+
 	ServerConfig *config.Config
 
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c Connection) error
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	sessions   map[*session]struct{}
+	inShutdown int32
 }
 
 // Connection is implemented by the SMTP library and provided to callers
@@ -65,14 +88,48 @@ func (srv *Server) ListenAndServe() error {
 	if e != nil {
 		return e
 	}
-	return srv.Serve(ln)
+	return srv.Serve(srv.proxyListener(ln))
+}
+
+// ListenAndServeTLS listens on srv.TLSAddr and serves connections, which
+// are wrapped in TLS from the first byte (POP3S, RFC 8314). It can run
+// alongside ListenAndServe, Shutdown stops both.
+func (srv *Server) ListenAndServeTLS() error {
+	if srv.TLSconfig == nil {
+		return errors.New("pop3: TLSconfig is not set")
+	}
+	addr := srv.TLSAddr
+	if addr == "" {
+		addr = ":995"
+	}
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	return srv.Serve(tls.NewListener(srv.proxyListener(ln), srv.TLSconfig))
+}
+
+// read PROXY header from trusted networks
+
+func (srv *Server) proxyListener(ln net.Listener) net.Listener {
+	if len(srv.ProxyNetworks) == 0 {
+		return ln
+	}
+	return proxyproto.NewListener(ln, srv.ProxyNetworks)
 }
 
 func (srv *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				log.Errorf("pop3: Accept error: %v", e)
 				continue
@@ -83,9 +140,95 @@ func (srv *Server) Serve(ln net.Listener) error {
 		if err != nil {
 			continue
 		}
+		srv.trackSession(sess, true)
 		go sess.serve()
 	}
-	panic("not reached")
+}
+
+// Shutdown gracefully stops the server. It closes all listeners, sends -ERR
+// to sessions waiting for a command and waits for running commands.
+// If ctx expires first, remaining connections are closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.mu.Lock()
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.interruptIdleSessions() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// track listener, return false if server is shutting down
+
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	if add {
+		srv.sessions[s] = struct{}{}
+	} else {
+		delete(srv.sessions, s)
+	}
+}
+
+// interrupt sessions waiting for command, return true if no sessions left
+
+func (srv *Server) interruptIdleSessions() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for s := range srv.sessions {
+		s.interruptIfIdle()
+	}
+	return len(srv.sessions) == 0
+}
+
+// close all sessions and wait until they finish
+
+func (srv *Server) closeSessions() {
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		s.closeConn()
+	}
+	srv.mu.Unlock()
+	for !srv.interruptIdleSessions() {
+		time.Sleep(shutdownPollInterval)
+	}
 }
 
 // SESSION
@@ -96,6 +239,9 @@ type session struct {
 	br  *bufio.Reader
 	bw  *bufio.Writer
 
+	mu   sync.Mutex // guards idle and rwc deadlines on shutdown
+	idle bool       // waiting for next command
+
 	authPlain        bool   // bool for 2 step plain auth
 	authLogin        bool   // bool for 2 step login auth
 	authApopLogin    string // bytes for apop login
@@ -152,25 +298,86 @@ func (s *session) Addr() net.Addr {
 	return s.rwc.RemoteAddr()
 }
 
+// wait for next command, return false if server is shutting down
+
+func (s *session) beginIdle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv.shuttingDown() {
+		return false
+	}
+	if s.srv.ReadTimeout != 0 {
+		s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+	}
+	s.idle = true
+	return true
+}
+
+func (s *session) endIdle() {
+	s.mu.Lock()
+	s.idle = false
+	s.mu.Unlock()
+}
+
+// unblock reading of next command on shutdown
+
+func (s *session) interruptIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle {
+		s.rwc.SetReadDeadline(time.Now())
+	}
+}
+
+func (s *session) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rwc.SetDeadline(time.Now())
+}
+
+// send error on graceful shutdown
+
+func (s *session) sendShutdown() {
+	s.sendlinef("-ERR [SYS/TEMP] server shutting down")
+}
+
 // parse commands to server
 
 func (s *session) serve() {
+	defer s.srv.trackSession(s, false)
 	defer s.rwc.Close()
+	// PROXY header is read before any deadline is set
+	if pc, ok := s.rwc.(*proxyproto.Conn); ok {
+		if _, err := pc.Header(); err != nil {
+			s.errorf("PROXY header: %v", err)
+			return
+		}
+	}
 	if onc := s.srv.OnNewConnection; onc != nil {
 		if err := onc(s); err != nil {
 			s.sendPOP3ErrorOrLinef(err, "-ERR connection rejected")
 			return
 		}
 	}
+	if s.srv.shuttingDown() {
+		s.sendShutdown()
+		return
+	}
 	s.clearAuthData()
 	s.authApopLogin = utils.GenerateProtocolCramMd5(s.srv.hostname())
 	s.sendf("+OK POP3 server ready %s\r\n", s.authApopLogin)
 	for {
-		if s.srv.ReadTimeout != 0 {
-			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		if !s.beginIdle() {
+			s.sendShutdown()
+			return
 		}
 		sl, err := s.br.ReadString('\n')
+		s.endIdle()
 		if err != nil {
+			if s.srv.shuttingDown() {
+				s.sendShutdown()
+				return
+			}
 			// client close connection
 			if io.EOF != err {
 				s.errorf("read error: %v", err)
@@ -233,7 +440,7 @@ func (s *session) handleCapa() {
 	s.sendlinef("+OK Capability list follows")
 	s.sendlinef("TOP")
 	s.sendlinef("SASL LOGIN PLAIN CRAM-MD5")
-	if s.srv.ServerConfig.Pop3.Tls {
+	if s.srv.ServerConfig.Pop3.Tls && !s.isTLS() {
 		s.sendlinef("STLS")
 	}
 	s.sendlinef(".")
@@ -540,6 +747,10 @@ func (s *session) handleApop(line string) {
 // handle StartTLS
 
 func (s *session) handleStartTLS() {
+	if s.isTLS() {
+		s.sendlinef("-ERR TLS already active")
+		return
+	}
 	if s.srv.ServerConfig.Pop3.Tls {
 		s.sendlinef("+OK Begin TLS negotiation")
 		var tlsConn *tls.Conn
@@ -548,7 +759,9 @@ func (s *session) handleStartTLS() {
 		if err != nil {
 			log.Errorf("Could not TLS handshake:%v", err)
 		} else {
+			s.mu.Lock()
 			s.rwc = net.Conn(tlsConn)
+			s.mu.Unlock()
 			s.br = bufio.NewReader(s.rwc)
 			s.bw = bufio.NewWriter(s.rwc)
 		}
@@ -558,6 +771,13 @@ func (s *session) handleStartTLS() {
 	}
 }
 
+// connection is encrypted by STLS or implicit TLS
+
+func (s *session) isTLS() bool {
+	_, ok := s.rwc.(*tls.Conn)
+	return ok
+}
+
 // check auth if need
 
 func (s *session) checkNeedAuth() bool {
@@ -1,20 +1,25 @@
 package protocol
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/mailbody"
 	"github.com/Polymail/go-falcon/protocol/pop3"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spool"
 	"github.com/Polymail/go-falcon/worker"
+	"sync"
 	"time"
 )
 
 const (
 	TCP_TIMEOUT        = 30
-	EMAIL_CHANNEL_SIZE = 200
+	EMAIL_CHANNEL_SIZE = config.EMAIL_QUEUE_SIZE
+	SHUTDOWN_TIMEOUT   = 60
 )
 
 type env struct {
@@ -23,6 +28,20 @@ type env struct {
 
 var (
 	SaveMailChan chan *smtpd.BasicEnvelope
+	MailSpool    *spool.Spool // nil if spool disabled
+	dnsblFilter  *blocklists  // nil if dnsbl disabled
+	pressure     *backpressure
+
+	memoryMailSize int64  // bigger emails are received to temp files
+	tempDir        string // directory of temp files
+
+	servers struct {
+		sync.Mutex
+		smtp    *smtpd.Server
+		pop3    *pop3.Server
+		workers *worker.Workers
+		done    chan struct{}
+	}
 )
 
 func (e *env) AddRecipient(rcpt smtpd.MailAddress) error {
@@ -36,13 +55,29 @@ func (e *env) AddRecipient(rcpt smtpd.MailAddress) error {
 }
 
 func (e *env) Close() error {
+	// store mail on disk before confirm it to client
+	if MailSpool != nil {
+		if err := MailSpool.Store(e.BasicEnvelope); err != nil {
+			return err
+		}
+	}
 	// send mail to storage workers
-	SaveMailChan <- e.BasicEnvelope
-	return nil
+	return pressure.queue(e.BasicEnvelope)
 }
 
 func onNewMail(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
-	return &env{new(smtpd.BasicEnvelope)}, nil
+	if err := pressure.checkMail(); err != nil {
+		return nil, err
+	}
+	e := &env{&smtpd.BasicEnvelope{MailBody: mailbody.New(memoryMailSize, tempDir)}}
+	if dnsblFilter != nil {
+		result, err := dnsblFilter.checkMail(c, from)
+		if err != nil {
+			return nil, err
+		}
+		e.Dnsbl = result
+	}
+	return e, nil
 }
 
 // load POP3 TLS certs
@@ -80,11 +115,12 @@ func goPop3Server(config *config.Config) {
 	log.Debugf("POP3 working on %s", serverBind)
 	// config server
 	s := &pop3.Server{
-		Addr:         serverBind,
-		Hostname:     config.Pop3.Hostname,
-		ServerConfig: config,
-		WriteTimeout: time.Duration(TCP_TIMEOUT) * time.Second,
-		ReadTimeout:  time.Duration(TCP_TIMEOUT) * time.Second,
+		Addr:          serverBind,
+		Hostname:      config.Pop3.Hostname,
+		ProxyNetworks: config.ProxyNetworks,
+		ServerConfig:  config,
+		WriteTimeout:  time.Duration(TCP_TIMEOUT) * time.Second,
+		ReadTimeout:   time.Duration(TCP_TIMEOUT) * time.Second,
 	}
 	// tls certs
 	if config.Pop3.Tls {
@@ -95,9 +131,23 @@ func goPop3Server(config *config.Config) {
 			s.TLSconfig = cert
 		}
 	}
+	servers.Lock()
+	servers.pop3 = s
+	servers.Unlock()
+	// implicit tls
+	if config.Pop3.Tls && config.Pop3.Tls_Port > 0 {
+		s.TLSAddr = fmt.Sprintf("%s:%d", config.Pop3.Host, config.Pop3.Tls_Port)
+		log.Debugf("POP3S working on %s", s.TLSAddr)
+		go func() {
+			error := s.ListenAndServeTLS()
+			if error != nil && error != pop3.ErrServerClosed {
+				log.Errorf("POP3S server: %v", error)
+			}
+		}()
+	}
 	// server
 	error := s.ListenAndServe()
-	if error != nil {
+	if error != nil && error != pop3.ErrServerClosed {
 		log.Errorf("POP3 server: %v", error)
 	}
 }
@@ -115,20 +165,48 @@ func StartPop3Server(config *config.Config) {
 func StartSmtpServer(config *config.Config) {
 	// create queue for emails
 	SaveMailChan = make(chan *smtpd.BasicEnvelope, EMAIL_CHANNEL_SIZE)
+	// spool for accepted emails
+	if config.Spool.Enabled {
+		mailSpool, err := spool.Open(config.Spool.Directory)
+		if err != nil {
+			log.Errorf("SMPTD spool: %v", err)
+			return
+		}
+		MailSpool = mailSpool
+	}
+	pressure = newBackpressure(config)
+	if config.Stats.Enabled {
+		go serveStats(config)
+	}
+	// data of received emails
+	memoryMailSize, tempDir = int64(config.Adapter.Memory_Mail_Size), config.Adapter.Temp_Dir
+	// dns block lists
+	if config.Dnsbl.Enabled {
+		dnsblFilter = newBlocklists(config)
+	}
 	// start parser and storage workers
-	worker.StartWorkers(config, SaveMailChan)
-	// server ip:port
-	serverBind := fmt.Sprintf("%s:%d", config.Adapter.Host, config.Adapter.Port)
+	workers := worker.StartWorkers(config, SaveMailChan, MailSpool)
+	// server ip:port or unix socket
+	serverBind, serverNetwork := fmt.Sprintf("%s:%d", config.Adapter.Host, config.Adapter.Port), "tcp"
+	if config.Adapter.Unix_Socket != "" {
+		serverBind, serverNetwork = config.Adapter.Unix_Socket, "unix"
+	}
 	// debug info
-	log.Debugf("SMPTD working on %s", serverBind)
+	log.Debugf("SMPTD (%s) working on %s", config.Adapter.Protocol, serverBind)
 	// config server
 	s := &smtpd.Server{
-		Addr:         serverBind,
-		Hostname:     config.Adapter.Hostname,
-		OnNewMail:    onNewMail,
-		ServerConfig: config,
-		WriteTimeout: time.Duration(TCP_TIMEOUT) * time.Second,
-		ReadTimeout:  time.Duration(TCP_TIMEOUT) * time.Second,
+		Addr:          serverBind,
+		Network:       serverNetwork,
+		Hostname:      config.Adapter.Hostname,
+		Lmtp:          config.IsLmtp(),
+		OnNewMail:     onNewMail,
+		ProxyNetworks: config.ProxyNetworks,
+		ServerConfig:  config,
+		WriteTimeout:  time.Duration(TCP_TIMEOUT) * time.Second,
+		ReadTimeout:   time.Duration(TCP_TIMEOUT) * time.Second,
+	}
+	if dnsblFilter != nil {
+		s.OnNewConnection = dnsblFilter.onNewConnection
 	}
 	// tls certs
 	if config.Adapter.Tls {
@@ -139,9 +217,67 @@ func StartSmtpServer(config *config.Config) {
 			s.TLSconfig = cert
 		}
 	}
+	servers.Lock()
+	servers.smtp = s
+	servers.workers = workers
+	servers.done = make(chan struct{})
+	done := servers.done
+	servers.Unlock()
+	// implicit tls
+	if config.Adapter.Tls && config.Adapter.Tls_Port > 0 {
+		s.TLSAddr = fmt.Sprintf("%s:%d", config.Adapter.Host, config.Adapter.Tls_Port)
+		log.Debugf("SMTPS working on %s", s.TLSAddr)
+		go func() {
+			error := s.ListenAndServeTLS()
+			if error != nil && error != smtpd.ErrServerClosed {
+				log.Errorf("SMTPS server: %v", error)
+			}
+		}()
+	}
 	// server
 	error := s.ListenAndServe()
+	if error == smtpd.ErrServerClosed {
+		// wait until queued emails are stored
+		<-done
+		return
+	}
 	if error != nil {
 		log.Errorf("SMPTD server: %v", error)
 	}
 }
+
+// graceful shutdown: stop accepting connections, finish DATA transfers
+// and store all queued emails by workers
+
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(SHUTDOWN_TIMEOUT)*time.Second)
+	defer cancel()
+
+	servers.Lock()
+	defer servers.Unlock()
+	// concurrently, so slow POP3 sessions don't take time of DATA
+	// transfers
+	var pop3Done sync.WaitGroup
+	if servers.pop3 != nil {
+		pop3Done.Add(1)
+		go func() {
+			defer pop3Done.Done()
+			if err := servers.pop3.Shutdown(ctx); err != nil {
+				log.Errorf("POP3 shutdown: %v", err)
+			}
+		}()
+	}
+	if servers.smtp != nil {
+		if err := servers.smtp.Shutdown(ctx); err != nil {
+			log.Errorf("SMPTD shutdown: %v", err)
+		}
+		// no more sessions and retries, which can write in channel
+		servers.workers.StopRetries()
+		close(SaveMailChan)
+		log.Infof("Waiting for storage workers, %d emails in queue", len(SaveMailChan))
+		servers.workers.Wait()
+		close(servers.done)
+	}
+	pop3Done.Wait()
+	log.Infof("Shutdown completed")
+}
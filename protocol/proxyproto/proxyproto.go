@@ -0,0 +1,249 @@
+// Package proxyproto reads HAProxy PROXY protocol headers (v1 and v2),
+// which load balancers send before client data, so servers see the real
+// client address instead of the balancer's one.
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_TIMEOUT = 10 * time.Second
+	MAX_V1_LENGTH  = 107 // including CRLF
+
+	v2CmdLocal  = 0x0
+	v2CmdProxy  = 0x1
+	v2FamInet   = 0x1
+	v2FamInet6  = 0x2
+	v2LenInet   = 12
+	v2LenInet6  = 36
+	v2HeaderLen = 16
+)
+
+var (
+	ErrNoProxyHeader = errors.New("proxyproto: PROXY header is missing")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Header is parsed PROXY header. Addresses are nil if balancer sends
+// own connection (v1 UNKNOWN, v2 LOCAL, e.g. health checks).
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ReadHeader reads v1 or v2 header from beginning of connection
+func ReadHeader(br *bufio.Reader) (*Header, error) {
+	signature, err := br.Peek(len(v2Signature))
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrNoProxyHeader
+		}
+		return nil, err
+	}
+	if bytes.Equal(signature, v2Signature) {
+		return readV2Header(br)
+	}
+	if bytes.HasPrefix(signature, v1Prefix) {
+		return readV1Header(br)
+	}
+	return nil, ErrNoProxyHeader
+}
+
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+
+func readV1Header(br *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, MAX_V1_LENGTH)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidHeader
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= MAX_V1_LENGTH {
+			return nil, ErrInvalidHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	srcIp, dstIp := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := parsePort(fields[4])
+	dstPort, dstErr := parsePort(fields[5])
+	if srcIp == nil || dstIp == nil || srcErr != nil || dstErr != nil {
+		return nil, ErrInvalidHeader
+	}
+	isV4 := fields[1] == "TCP4"
+	if (srcIp.To4() != nil) != isV4 || (dstIp.To4() != nil) != isV4 {
+		return nil, ErrInvalidHeader
+	}
+	header.Source = &net.TCPAddr{IP: srcIp, Port: srcPort}
+	header.Destination = &net.TCPAddr{IP: dstIp, Port: dstPort}
+	return header, nil
+}
+
+// binary header: signature, version and command, family, length, addresses
+
+func readV2Header(br *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	command, family := fixed[12]&0x0f, fixed[13]>>4
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	header := &Header{Version: 2}
+	switch command {
+	case v2CmdLocal:
+		return header, nil
+	case v2CmdProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	switch family {
+	case v2FamInet:
+		if len(payload) < v2LenInet {
+			return nil, ErrInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case v2FamInet6:
+		if len(payload) < v2LenInet6 {
+			return nil, ErrInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	// unix sockets and unspecified family keep balancer address
+	return header, nil
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return 0, ErrInvalidHeader
+	}
+	return p, nil
+}
+
+// Listener reads PROXY header from connections of trusted networks,
+// other connections are returned as is
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: ln, Trusted: trusted}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !IsTrusted(c.RemoteAddr(), l.Trusted) {
+		return c, nil
+	}
+	// header is read in session goroutine, so slow balancer
+	// doesn't block Accept
+	return &Conn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// IsTrusted returns true if addr is in one of networks
+
+func IsTrusted(addr net.Addr, networks []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn reads PROXY header on first Read or RemoteAddr call. Header is
+// required, connection without valid header fails on Read and Write.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+	c.header, c.err = ReadHeader(c.br)
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// Header returns PROXY header, reading it if needed
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// RemoteAddr returns client address from PROXY header
+func (c *Conn) RemoteAddr() net.Addr {
+	if header, err := c.Header(); err == nil && header.Source != nil {
+		return header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns address, which client connected to
+func (c *Conn) LocalAddr() net.Addr {
+	if header, err := c.Header(); err == nil && header.Destination != nil {
+		return header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,97 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+type headerTest struct {
+	Header string
+	Source string // empty if header has no address, "error" if invalid
+	Rest   string
+}
+
+var headerTests = []headerTest{
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 25\r\nEHLO", "192.168.0.1:56324", "EHLO"},
+	{"PROXY TCP6 2001:db8::1 2001:db8::2 4000 25\r\n", "[2001:db8::1]:4000", ""},
+	{"PROXY UNKNOWN\r\nEHLO", "", "EHLO"},
+	{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", ""},
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "error", ""},
+	{"PROXY TCP4 2001:db8::1 192.168.0.11 56324 25\r\n", "error", ""},
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 70000\r\n", "error", ""},
+	{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 25\n", "error", ""},
+	{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "error", ""},
+	{"EHLO client.test\r\n", "error", ""},
+	// v2 PROXY TCP4 127.0.0.1:1234 -> 127.0.0.2:25
+	{string(v2Signature) + "\x21\x11\x00\x0c\x7f\x00\x00\x01\x7f\x00\x00\x02\x04\xd2\x00\x19EHLO", "127.0.0.1:1234", "EHLO"},
+	// v2 PROXY TCP6 ::1:1234 -> ::2:25 with TLV
+	{string(v2Signature) + "\x21\x21\x00\x28" + strings.Repeat("\x00", 15) + "\x01" + strings.Repeat("\x00", 15) + "\x02\x04\xd2\x00\x19\x03\x00\x01\x00", "[::1]:1234", ""},
+	// v2 LOCAL
+	{string(v2Signature) + "\x20\x00\x00\x00EHLO", "", "EHLO"},
+	// v2 invalid version
+	{string(v2Signature) + "\x11\x11\x00\x0c\x7f\x00\x00\x01\x7f\x00\x00\x02\x04\xd2\x00\x19", "error", ""},
+	// v2 short address
+	{string(v2Signature) + "\x21\x11\x00\x04\x7f\x00\x00\x01", "error", ""},
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, test := range headerTests {
+		br := bufio.NewReader(strings.NewReader(test.Header))
+		header, err := ReadHeader(br)
+		if test.Source == "error" {
+			if err == nil {
+				t.Errorf("Expected error for %q, got: %+v", test.Header, header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.Header, err)
+			continue
+		}
+		if (test.Source == "" && header.Source != nil) || (test.Source != "" && (header.Source == nil || header.Source.String() != test.Source)) {
+			t.Errorf("Unexpected source for %q: %v", test.Header, header.Source)
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if string(rest) != test.Rest {
+			t.Errorf("Unexpected data after header %q: %q", test.Header, rest)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	_, untrusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	for _, networks := range [][]*net.IPNet{{trusted}, {untrusted}} {
+		proxyLn := NewListener(ln, networks)
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 25\r\nEHLO\r\n"))
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if networks[0] == trusted {
+			if conn.RemoteAddr().String() != "192.168.0.1:56324" || line != "EHLO\r\n" {
+				t.Errorf("Unexpected trusted connection: %v %q", conn.RemoteAddr(), line)
+			}
+		} else {
+			if !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") || !strings.HasPrefix(line, "PROXY") {
+				t.Errorf("Header is accepted from untrusted network: %v %q", conn.RemoteAddr(), line)
+			}
+		}
+		conn.Close()
+		client.Close()
+	}
+}
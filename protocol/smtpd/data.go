@@ -0,0 +1,148 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// DATA ends only on <CRLF>.<CRLF> (RFC 5321 s4.1.1.4), so bare LF or CR
+// around dot can't end message early and smuggle commands in it
+// (SMTP smuggling). Bare line endings are normalized to CRLF or make
+// message invalid.
+
+const (
+	DATA_NORMALIZE = "normalize" // bare CR and LF become CRLF
+	DATA_REJECT    = "reject"    // bare CR and LF make message invalid
+
+	DATA_BUFFER_SIZE = 4096
+)
+
+type dataReader struct {
+	br            *bufio.Reader
+	rejectBare    bool
+	maxLineLength int // characters without CRLF, 0 for no limit
+	maxHeaders    int // header fields, 0 for no limit
+
+	err  error  // first problem of message, message is read to its end
+	out  []byte // data, which isn't returned by Read yet
+	done bool   // <CRLF>.<CRLF> is read
+
+	cr         bool // last byte was CR, line ending is not known yet
+	lineStart  bool // after CRLF, dot is stuffing or end of data
+	dot        bool // line is only dot so far
+	lineLength int
+	inHeaders  bool
+	headers    int
+}
+
+func newDataReader(br *bufio.Reader, mode string, maxLineLength, maxHeaders int) *dataReader {
+	return &dataReader{
+		br:            br,
+		rejectBare:    mode == DATA_REJECT,
+		maxLineLength: maxLineLength,
+		maxHeaders:    maxHeaders,
+		out:           make([]byte, 0, DATA_BUFFER_SIZE),
+		lineStart:     true,
+		inHeaders:     true,
+	}
+}
+
+// Read returns dot-unstuffed data with CRLF line endings, io.EOF after
+// end of data. Nothing is returned after message became invalid.
+
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.out) < len(p) && !r.done {
+		c, err := r.br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if len(r.out) == 0 {
+				return 0, err
+			}
+			break
+		}
+		r.readByte(c)
+	}
+	if len(r.out) == 0 && r.done {
+		return 0, io.EOF
+	}
+	n := copy(p, r.out)
+	r.out = r.out[:copy(r.out, r.out[n:])]
+	return n, nil
+}
+
+func (r *dataReader) readByte(c byte) {
+	if r.cr {
+		r.cr = false
+		if c == '\n' {
+			if r.dot {
+				r.done = true
+				return
+			}
+			r.endLine()
+			r.lineStart = true
+			return
+		}
+		r.bareLineEnding("550 5.6.0 Error: bare <CR> received")
+	}
+	switch c {
+	case '\r':
+		r.cr = true
+		return
+	case '\n':
+		r.bareLineEnding("550 5.6.0 Error: bare <LF> received")
+		return
+	}
+	if r.lineStart && c == '.' {
+		// stuffing dot or end of data
+		r.lineStart, r.dot = false, true
+		return
+	}
+	r.lineStart, r.dot = false, false
+	if r.lineLength == 0 && r.inHeaders && c != ' ' && c != '\t' {
+		r.headers++
+		if r.maxHeaders > 0 && r.headers > r.maxHeaders {
+			r.fail("550 5.6.0 Error: too many header fields")
+		}
+	}
+	r.lineLength++
+	if r.maxLineLength > 0 && r.lineLength == r.maxLineLength+1 {
+		r.fail(fmt.Sprintf("550 5.6.0 Error: line longer than %d characters", r.maxLineLength))
+	}
+	r.emit(c)
+}
+
+// bare CR or LF ends line, but not line of SMTP, so dot after it isn't
+// end of data
+
+func (r *dataReader) bareLineEnding(reply string) {
+	if r.rejectBare {
+		r.fail(reply)
+	}
+	r.lineStart, r.dot = false, false
+	r.endLine()
+}
+
+func (r *dataReader) endLine() {
+	if r.lineLength == 0 {
+		// empty line ends headers
+		r.inHeaders = false
+	}
+	r.lineLength = 0
+	r.emit('\r', '\n')
+}
+
+func (r *dataReader) emit(data ...byte) {
+	if r.err == nil {
+		r.out = append(r.out, data...)
+	}
+}
+
+func (r *dataReader) fail(reply string) {
+	if r.err == nil {
+		r.err = SMTPError(reply)
+		r.out = r.out[:0]
+	}
+}
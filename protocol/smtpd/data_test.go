@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// end of data variants from SMTP smuggling research, none of them ends
+// DATA, smuggled commands stay in message
+var smugglingPayloads = []struct {
+	payload string
+	bare    bool // has bare CR or LF
+}{
+	{"\n.\n", true},
+	{"\n.\r\n", true},
+	{"\r\n.\n", true},
+	{"\r.\r", true},
+	{"\r.\r\n", true},
+	{"\r\n.\r", true},
+	{"\r\n\x00.\r\n", false},
+}
+
+const smuggledCommands = "MAIL FROM:<admin@example.com>\r\nRCPT TO:<to@example.com>\r\nDATA\r\nFrom: admin@example.com\r\n\r\nsmuggled\r\n.\r\n"
+
+func readData(input, mode string, maxLineLength, maxHeaders int) (string, error, string) {
+	br := bufio.NewReader(strings.NewReader(input))
+	r := newDataReader(br, mode, maxLineLength, maxHeaders)
+	data, err := ioutil.ReadAll(r)
+	if err == nil {
+		err = r.err
+	}
+	rest, _ := ioutil.ReadAll(br)
+	return string(data), err, string(rest)
+}
+
+func TestDataSmuggling(t *testing.T) {
+	for _, test := range smugglingPayloads {
+		input := "Subject: test\r\n\r\nbody" + test.payload + smuggledCommands + "QUIT\r\n"
+		data, err, rest := readData(input, DATA_NORMALIZE, 998, 100)
+		if err != nil || rest != "QUIT\r\n" {
+			t.Errorf("%q: unexpected end of data, err %v, rest %q", test.payload, err, rest)
+		}
+		if !strings.Contains(data, "\r\nMAIL FROM:<admin@example.com>\r\n") || strings.Contains(strings.Replace(data, "\r\n", "", -1), "\n") {
+			t.Errorf("%q: unexpected data %q", test.payload, data)
+		}
+		_, err, rest = readData(input, DATA_REJECT, 998, 100)
+		if rest != "QUIT\r\n" || (err != nil) != test.bare {
+			t.Errorf("%q: reject mode err %v, rest %q", test.payload, err, rest)
+		}
+	}
+}
+
+func TestDataReader(t *testing.T) {
+	tests := []struct {
+		input         string
+		maxLineLength int
+		maxHeaders    int
+		data          string
+		err           string
+	}{
+		{".\r\n", 0, 0, "", ""},
+		{"Subject: test\r\n\r\n..dot\r\n.\r\n", 0, 0, "Subject: test\r\n\r\n.dot\r\n", ""},
+		{"Subject: test\n\nbody\r\n.\r\n", 0, 0, "Subject: test\r\n\r\nbody\r\n", ""},
+		{"Subject: " + strings.Repeat("a", 989) + "\r\n.\r\n", 998, 0, "Subject: " + strings.Repeat("a", 989) + "\r\n", ""},
+		{"Subject: " + strings.Repeat("a", 990) + "\r\n.\r\n", 998, 0, "", "550 5.6.0 Error: line longer than 998 characters"},
+		{"A: 1\r\nB: 2\r\n folded\r\n\r\nC: 3\r\n.\r\n", 0, 2, "A: 1\r\nB: 2\r\n folded\r\n\r\nC: 3\r\n", ""},
+		{"A: 1\r\nB: 2\r\nC: 3\r\n\r\n.\r\n", 0, 2, "", "550 5.6.0 Error: too many header fields"},
+	}
+	for _, test := range tests {
+		data, err, _ := readData(test.input, DATA_NORMALIZE, test.maxLineLength, test.maxHeaders)
+		// data of invalid message doesn't matter
+		if (test.err == "" && data != test.data) || (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%q: expected %q (%q), got %q (%v)", test.input, test.data, test.err, data, err)
+		}
+	}
+	// connection closed before end of data
+	if _, err, _ := readData("Subject: test\r\n", DATA_NORMALIZE, 0, 0); err == nil {
+		t.Errorf("unexpected end of data without error")
+	}
+}
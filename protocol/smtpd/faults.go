@@ -0,0 +1,197 @@
+package smtpd
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// Fault rules let inbox pretend to be a difficult receiver. Connect
+// rules apply when inbox becomes known: on greeting after XCLIENT LOGIN
+// or on AUTH reply.
+
+const (
+	FAULT_STAGE_CONNECT     = "connect"
+	FAULT_STAGE_MAIL        = "mail"
+	FAULT_STAGE_RCPT        = "rcpt"
+	FAULT_STAGE_DATA        = "data"
+	FAULT_STAGE_END_OF_DATA = "end_of_data"
+
+	FAULT_ACTION_REPLY = "reply" // answer with rule code
+	FAULT_ACTION_DROP  = "drop"  // close connection without reply
+	FAULT_ACTION_DELAY = "delay" // delay reply, command continues
+
+	FAULT_MAX_DELAY = 600 // seconds
+)
+
+// fault rules of session inboxes, loaded once for inbox
+
+type sessionFaults struct {
+	rules map[int][]storage.FaultRule // inbox -> rules
+	rolls map[faultRoll]bool          // rule of inbox -> applies to current message
+}
+
+type faultRoll struct {
+	mailboxId int
+	index     int
+}
+
+// apply fault rules of inbox for stage, return true if command is
+// answered by rule (reply is sent or connection is dropped)
+
+func (s *session) injectFault(stage string, mailboxId int) bool {
+	reply, drop := s.evalFault(stage, mailboxId)
+	s.sendFault(stage, reply, drop)
+	return reply != "" || drop
+}
+
+func (s *session) sendFault(stage, reply string, drop bool) {
+	if reply != "" {
+		if stage == FAULT_STAGE_END_OF_DATA && s.srv.Lmtp {
+			// LMTP replies for each recipient
+			for range s.rcpts {
+				s.sendlinef("%s", reply)
+			}
+		} else {
+			s.sendlinef("%s", reply)
+		}
+	}
+	if drop {
+		s.dropped = true
+		s.rwc.Close()
+	}
+}
+
+// apply fault rules of every inbox of envelope for stage. LMTP
+// recipients of inbox, which replies with error, are rejected and
+// others continue. Return true if command is answered.
+
+func (s *session) injectEnvelopeFault(stage string) bool {
+	for _, mailboxId := range s.envelopeMailboxIds() {
+		if !s.srv.Lmtp {
+			if s.injectFault(stage, mailboxId) {
+				return true
+			}
+			continue
+		}
+		reply, drop := s.evalFault(stage, mailboxId)
+		if drop {
+			// 421 or dropped connection ends session for all recipients
+			s.sendFault(stage, reply, drop)
+			return true
+		}
+		if reply != "" {
+			s.rejectMailbox(mailboxId, SMTPError(reply))
+		}
+	}
+	return false
+}
+
+// evaluate fault rules of inbox for stage, delay rules wait here. Return
+// reply of rule, drop is true if connection is closed (after reply, if
+// it isn't empty).
+
+func (s *session) evalFault(stage string, mailboxId int) (string, bool) {
+	if !s.srv.ServerConfig.Faults.Enabled || mailboxId == 0 {
+		return "", false
+	}
+	rules := s.getInboxFaults(mailboxId)
+	for i, rule := range rules {
+		if rule.Stage != stage || !s.faultApplies(mailboxId, i, rule) {
+			continue
+		}
+		switch rule.Action {
+		case FAULT_ACTION_DELAY:
+			delay := rule.Delay
+			if delay > FAULT_MAX_DELAY {
+				delay = FAULT_MAX_DELAY
+			}
+			log.Debugf("fault: delay %s of inbox %d for %d seconds", stage, mailboxId, delay)
+			s.sleep(time.Duration(delay) * time.Second)
+		case FAULT_ACTION_DROP:
+			log.Debugf("fault: drop connection on %s of inbox %d", stage, mailboxId)
+			return "", true
+		case FAULT_ACTION_REPLY:
+			reply := faultReply(rule)
+			if reply == "" {
+				log.Errorf("fault: invalid reply code %d of inbox %d", rule.Code, mailboxId)
+				continue
+			}
+			log.Debugf("fault: reply %q on %s of inbox %d", reply, stage, mailboxId)
+			// server closes channel after 421 (RFC 5321 s3.8)
+			return reply, rule.Code == 421
+		default:
+			log.Errorf("fault: unknown action %q of inbox %d", rule.Action, mailboxId)
+		}
+	}
+	return "", false
+}
+
+// percentage rules are decided once per message
+
+func (s *session) faultApplies(mailboxId, index int, rule storage.FaultRule) bool {
+	if rule.Percent <= 0 || rule.Percent >= 100 {
+		return true
+	}
+	if s.faults.rolls == nil {
+		s.faults.rolls = make(map[faultRoll]bool)
+	}
+	roll := faultRoll{mailboxId: mailboxId, index: index}
+	applies, ok := s.faults.rolls[roll]
+	if !ok {
+		applies = rand.Intn(100) < rule.Percent
+		s.faults.rolls[roll] = applies
+	}
+	return applies
+}
+
+// rules from cache or database, no rules on error
+
+func (s *session) getInboxFaults(mailboxId int) []storage.FaultRule {
+	if rules, ok := s.faults.rules[mailboxId]; ok {
+		return rules
+	}
+	config := s.srv.ServerConfig
+	rules, ok := config.FaultsCache.GetInboxFaults(mailboxId)
+	if !ok {
+		var err error
+		rules, err = config.DbPool.GetInboxFaults(mailboxId)
+		if err != nil {
+			return nil
+		}
+		config.FaultsCache.StoreInboxFaults(mailboxId, rules)
+	}
+	if s.faults.rules == nil {
+		s.faults.rules = make(map[int][]storage.FaultRule)
+	}
+	s.faults.rules[mailboxId] = rules
+	return rules
+}
+
+// text without line breaks, so rule can't add reply lines
+
+func replyText(text string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+}
+
+// reply line of rule, empty if code isn't 4xx or 5xx
+
+func faultReply(rule storage.FaultRule) string {
+	switch {
+	case rule.Code >= 400 && rule.Code < 500:
+		if rule.Message == "" {
+			return fmt.Sprintf("%d 4.3.0 Error: temporary failure", rule.Code)
+		}
+	case rule.Code >= 500 && rule.Code < 600:
+		if rule.Message == "" {
+			return fmt.Sprintf("%d 5.3.0 Error: permanent failure", rule.Code)
+		}
+	default:
+		return ""
+	}
+	return fmt.Sprintf("%d %s", rule.Code, replyText(rule.Message))
+}
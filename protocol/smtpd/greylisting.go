@@ -0,0 +1,76 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/redisworker"
+)
+
+const (
+	GREYLIST_IPV4_PREFIX = 24
+	GREYLIST_IPV6_PREFIX = 64
+)
+
+// greylist recipient, returns false if RCPT was rejected with 451
+
+func (s *session) checkGreylist(rcpt MailAddress, mailboxId int) bool {
+	if !s.srv.ServerConfig.Greylisting.Enabled {
+		return true
+	}
+	if mailboxId > 0 {
+		inboxSettings, err := s.getInboxSettings(mailboxId)
+		if err == nil && inboxSettings.GreylistingDisabled {
+			return true
+		}
+	}
+	tcpAddr, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	triplet := greylistTriplet(tcpAddr.IP, s.from, rcpt)
+	wait, err := redisworker.CheckGreylist(s.srv.ServerConfig, triplet)
+	if err != nil {
+		// redis problem shouldn't stop emails
+		log.Errorf("greylisting: %v", err)
+		return true
+	}
+	if wait > 0 {
+		log.Debugf("greylisting %s, retry in %d seconds", triplet, wait)
+		s.sendlinef("451 4.7.1 <%s>: Recipient address rejected: Greylisted, try again in %d seconds", rcpt.Email(), wait)
+		return false
+	}
+	return true
+}
+
+// inbox of recipient from address mode, otherwise inbox of session.
+// Authenticated session stores other recipients in own inbox, like the
+// envelope does.
+
+func (s *session) rcptMailboxId(mailboxId int) int {
+	if mailboxId > 0 {
+		return mailboxId
+	}
+	if s.authMailboxId > 0 {
+		return s.authMailboxId
+	}
+	return s.mailboxId
+}
+
+// triplet of client network, envelope sender and recipient
+
+func greylistTriplet(ip net.IP, from, rcpt MailAddress) string {
+	var network *net.IPNet
+	if ip4 := ip.To4(); ip4 != nil {
+		network = &net.IPNet{IP: ip4.Mask(net.CIDRMask(GREYLIST_IPV4_PREFIX, 32)), Mask: net.CIDRMask(GREYLIST_IPV4_PREFIX, 32)}
+	} else {
+		network = &net.IPNet{IP: ip.Mask(net.CIDRMask(GREYLIST_IPV6_PREFIX, 128)), Mask: net.CIDRMask(GREYLIST_IPV6_PREFIX, 128)}
+	}
+	sender := ""
+	if from != nil {
+		sender = strings.ToLower(from.Email())
+	}
+	return fmt.Sprintf("%s_<%s>_<%s>", network, sender, strings.ToLower(rcpt.Email()))
+}
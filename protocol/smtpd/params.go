@@ -0,0 +1,183 @@
+package smtpd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ESMTP parameters of MAIL FROM (RFC 1870, RFC 6152, RFC 3461)
+
+type MailParams struct {
+	Size  int    // declared message size, 0 if not provided
+	Body  string // 7BIT, 8BITMIME, BINARYMIME (RFC 3030)
+	Ret   string // DSN: FULL or HDRS
+	EnvID string // DSN: envelope id, decoded from xtext
+
+	SmtpUtf8 bool // SMTPUTF8 (RFC 6531)
+}
+
+// ESMTP parameters of RCPT TO (RFC 3461)
+
+type RcptParams struct {
+	Notify []string // DSN: NEVER or SUCCESS, FAILURE, DELAY
+	Orcpt  string   // DSN: original recipient, "addr-type;address"
+}
+
+const (
+	MAX_ENVID_LENGTH = 100
+	MAX_ORCPT_LENGTH = 500
+)
+
+// parse "KEY=value KEY2" list into map with uppercase keys
+
+func parseEsmtpParams(line string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(line) {
+		key, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			key, value = param[:i], param[i+1:]
+		}
+		if !isEsmtpKeyword(key) {
+			return nil, SMTPError(fmt.Sprintf("501 5.5.4 Error: invalid parameter %q", param))
+		}
+		key = strings.ToUpper(key)
+		if _, ok := params[key]; ok {
+			return nil, SMTPError(fmt.Sprintf("501 5.5.4 Error: duplicate parameter %s", key))
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// parse MAIL FROM parameters, maxSize is 0 if size is not limited
+
+func parseMailParams(line string, maxSize int) (*MailParams, error) {
+	params, err := parseEsmtpParams(line)
+	if err != nil {
+		return nil, err
+	}
+	mailParams := &MailParams{}
+	for key, value := range params {
+		switch key {
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return nil, SMTPError("501 5.5.4 Error: invalid SIZE parameter")
+			}
+			if maxSize > 0 && size > maxSize {
+				return nil, SMTPError("552 5.3.4 Error: message size exceeds fixed limit")
+			}
+			mailParams.Size = size
+		case "BODY":
+			value = strings.ToUpper(value)
+			if value != "7BIT" && value != "8BITMIME" && value != "BINARYMIME" {
+				return nil, SMTPError("501 5.5.4 Error: invalid BODY parameter")
+			}
+			mailParams.Body = value
+		case "RET":
+			value = strings.ToUpper(value)
+			if value != "FULL" && value != "HDRS" {
+				return nil, SMTPError("501 5.5.4 Error: invalid RET parameter")
+			}
+			mailParams.Ret = value
+		case "ENVID":
+			envId, ok := xtextDecode(value)
+			if !ok || len(envId) == 0 || len(value) > MAX_ENVID_LENGTH {
+				return nil, SMTPError("501 5.5.4 Error: invalid ENVID parameter")
+			}
+			mailParams.EnvID = envId
+		case "SMTPUTF8":
+			if value != "" {
+				return nil, SMTPError("501 5.5.4 Error: SMTPUTF8 has no value")
+			}
+			mailParams.SmtpUtf8 = true
+		case "AUTH":
+			// RFC 4954, sender identity is not used
+		default:
+			return nil, SMTPError(fmt.Sprintf("555 5.5.4 Error: unsupported parameter %s", key))
+		}
+	}
+	return mailParams, nil
+}
+
+// parse RCPT TO parameters
+
+func parseRcptParams(line string) (*RcptParams, error) {
+	params, err := parseEsmtpParams(line)
+	if err != nil {
+		return nil, err
+	}
+	rcptParams := &RcptParams{}
+	for key, value := range params {
+		switch key {
+		case "NOTIFY":
+			notify := strings.Split(strings.ToUpper(value), ",")
+			for _, n := range notify {
+				switch n {
+				case "SUCCESS", "FAILURE", "DELAY":
+				case "NEVER":
+					if len(notify) > 1 {
+						return nil, SMTPError("501 5.5.4 Error: NOTIFY=NEVER can't be combined")
+					}
+				default:
+					return nil, SMTPError("501 5.5.4 Error: invalid NOTIFY parameter")
+				}
+			}
+			rcptParams.Notify = notify
+		case "ORCPT":
+			i := strings.IndexByte(value, ';')
+			if i <= 0 || len(value) > MAX_ORCPT_LENGTH {
+				return nil, SMTPError("501 5.5.4 Error: invalid ORCPT parameter")
+			}
+			address, ok := xtextDecode(value[i+1:])
+			if !ok || len(address) == 0 {
+				return nil, SMTPError("501 5.5.4 Error: invalid ORCPT parameter")
+			}
+			rcptParams.Orcpt = strings.ToLower(value[:i]) + ";" + address
+		default:
+			return nil, SMTPError(fmt.Sprintf("555 5.5.4 Error: unsupported parameter %s", key))
+		}
+	}
+	return rcptParams, nil
+}
+
+// esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+
+func isEsmtpKeyword(key string) bool {
+	if len(key) == 0 || key[0] == '-' {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// decode xtext (RFC 3461), "+XX" is hex encoded char
+
+func xtextDecode(value string) (string, bool) {
+	var decoded []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(value) {
+				return "", false
+			}
+			b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			if err != nil || strings.ToUpper(value[i+1:i+3]) != value[i+1:i+3] {
+				return "", false
+			}
+			decoded = append(decoded, byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", false
+		default:
+			decoded = append(decoded, c)
+		}
+	}
+	return string(decoded), true
+}
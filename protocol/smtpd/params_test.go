@@ -0,0 +1,70 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+type paramsTest struct {
+	Line  string
+	Reply string // expected reply prefix, empty if valid
+}
+
+var mailParamsTests = []paramsTest{
+	{"", ""},
+	{"SIZE=1000 BODY=8BITMIME", ""},
+	{"size=1000 body=7bit RET=HDRS ENVID=QQ314159 AUTH=<>", ""},
+	{"SIZE=1025", "552 5.3.4"},
+	{"SIZE=abc", "501 5.5.4"},
+	{"BODY=BINARY", "501 5.5.4"},
+	{"BODY=BINARYMIME", ""},
+	{"RET=ALL", "501 5.5.4"},
+	{"ENVID=a+2", "501 5.5.4"},
+	{"SIZE=1 SIZE=2", "501 5.5.4"},
+	{"SMTPUTF8", ""},
+	{"SMTPUTF8=yes", "501 5.5.4"},
+	{"XFOO=bar", "555 5.5.4"},
+}
+
+func TestParseMailParams(t *testing.T) {
+	for _, test := range mailParamsTests {
+		_, err := parseMailParams(test.Line, 1024)
+		checkParamsError(t, test, err)
+	}
+	params, _ := parseMailParams(" SIZE=100 RET=full ENVID=a+2Bb", 1024)
+	if params.Size != 100 || params.Ret != "FULL" || params.EnvID != "a+b" {
+		t.Errorf("Unexpected MAIL parameters: %+v", params)
+	}
+}
+
+var rcptParamsTests = []paramsTest{
+	{"NOTIFY=SUCCESS,FAILURE,DELAY", ""},
+	{"NOTIFY=NEVER ORCPT=rfc822;to@example.com", ""},
+	{"NOTIFY=NEVER,SUCCESS", "501 5.5.4"},
+	{"NOTIFY=ALWAYS", "501 5.5.4"},
+	{"ORCPT=to@example.com", "501 5.5.4"},
+	{"SIZE=100", "555 5.5.4"},
+}
+
+func TestParseRcptParams(t *testing.T) {
+	for _, test := range rcptParamsTests {
+		_, err := parseRcptParams(test.Line)
+		checkParamsError(t, test, err)
+	}
+	params, _ := parseRcptParams("notify=success,delay ORCPT=RFC822;to+2Bx@example.com")
+	if len(params.Notify) != 2 || params.Notify[1] != "DELAY" || params.Orcpt != "rfc822;to+x@example.com" {
+		t.Errorf("Unexpected RCPT parameters: %+v", params)
+	}
+}
+
+func checkParamsError(t *testing.T, test paramsTest, err error) {
+	if test.Reply == "" {
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.Line, err)
+		}
+		return
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), test.Reply) {
+		t.Errorf("Expected %q for %q, got: %v", test.Reply, test.Line, err)
+	}
+}
@@ -5,59 +5,122 @@ package smtpd
 
 import (
 	"fmt"
-	"github.com/garyburd/redigo/redis"
+	"net"
+	"time"
+
 	"github.com/Polymail/go-falcon/log"
-	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/ratelimit"
+	"github.com/Polymail/go-falcon/storage"
 )
 
-func (s *session) getInboxRateLimit(mailboxId int) (int, error) {
-	inboxSettings, err := redisworker.GetCachedInboxSettings(s.srv.ServerConfig, mailboxId)
-	if err != nil || 0 == inboxSettings.MaxMessages || 0 == inboxSettings.RateLimit {
-		// inbox setting from database
-		inboxSettings, err = s.srv.ServerConfig.DbPool.GeInboxSettings(mailboxId)
-		// check settings
-		if err == nil {
-			// cache setting in redis
-			redisworker.StoreCachedInboxSettings(s.srv.ServerConfig, mailboxId, inboxSettings)
-		}
+// rate limit of inbox settings, default rate limit if settings aren't
+// available
+
+func (s *session) getInboxRateLimit(mailboxId int) int {
+	inboxSettings, err := s.getInboxSettings(mailboxId)
+	if err != nil {
+		return s.srv.ServerConfig.Adapter.Rate_Limit
 	}
-	return inboxSettings.RateLimit, err
+	return inboxSettings.RateLimit
 }
 
-func (s *session) redisIsSessionBlocked() bool {
-	if !s.srv.ServerConfig.Redis.Enabled {
-		return false
+func (s *session) getInboxSettings(mailboxId int) (storage.InboxSettings, error) {
+	inboxSettings, ok := s.srv.ServerConfig.SettingsCache.GetInboxSettings(mailboxId)
+	if ok && 0 != inboxSettings.MaxMessages && 0 != inboxSettings.RateLimit {
+		return inboxSettings, nil
 	}
+	// inbox setting from database
+	inboxSettings, err := s.srv.ServerConfig.DbPool.GeInboxSettings(mailboxId)
+	// check settings
+	if err == nil {
+		// cache setting
+		s.srv.ServerConfig.SettingsCache.StoreInboxSettings(mailboxId, inboxSettings)
+	}
+	return inboxSettings, err
+}
 
-	redisCon := s.srv.ServerConfig.RedisPool.Get()
-	defer redisCon.Close()
+// count message in rate limits of session, reply and return false if
+// limit is exceeded. Client network limit closes connection with 421,
+// other limits reject message with 450. Every inbox of envelope has own
+// limits, LMTP rejects only recipients of exceeded inbox.
 
-	redisKey := s.redisRateLimitKey()
-	emailsKeyCount, err := redis.Int(redisCon.Do("INCR", redisKey))
-	if err == nil {
-		if 1 == emailsKeyCount {
-			// ttl of key begin
-			redisKeyTTL := 1
-			if s.rateLimit > 10 {
-				redisKeyTTL = 10
-			}
-			// ttl of key end
-			_, err = redisCon.Do("EXPIRE", redisKey, redisKeyTTL)
-			if err != nil {
-				log.Errorf("redisRateLimits EXPIRE error: %v", err)
-			}
+func (s *session) checkRateLimits() bool {
+	if s.srv.ServerConfig.RateLimiter == nil {
+		return true
+	}
+	subject := ratelimit.Subject{AuthMailboxID: s.authMailboxId}
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		subject.IP = tcpAddr.IP
+	}
+	if s.from != nil {
+		subject.Sender = s.from.Email()
+	}
+	limits := ratelimit.Limits(s.srv.ServerConfig.Rate_Limits.Policies, subject)
+	if !s.srv.Lmtp {
+		// message is counted only if all limits allow it
+		for _, mailboxId := range s.envelopeMailboxIds() {
+			limits = append(limits, s.inboxLimits(mailboxId)...)
 		}
-	} else {
-		log.Errorf("redisRateLimits INCR error: %v", err)
+		if limit, seconds := s.exceededLimit(limits); limit != nil {
+			s.rejectRateLimit(limit, seconds)
+			return false
+		}
+		return true
 	}
-
-	if err != nil || emailsKeyCount <= s.rateLimit {
+	if limit, seconds := s.exceededLimit(limits); limit != nil {
+		s.rejectRateLimit(limit, seconds)
 		return false
 	}
-
+	for _, mailboxId := range s.envelopeMailboxIds() {
+		if limit, seconds := s.exceededLimit(s.inboxLimits(mailboxId)); limit != nil {
+			s.rejectMailbox(mailboxId, rateLimitError(limit, seconds))
+		}
+	}
 	return true
 }
 
-func (s *session) redisRateLimitKey() string {
-	return fmt.Sprintf("rate-inbox-limits-%d", s.mailboxId)
+// inbox scope limits of inbox
+
+func (s *session) inboxLimits(mailboxId int) []ratelimit.Limit {
+	policies := s.srv.ServerConfig.Rate_Limits.Policies
+	if len(policies) == 0 {
+		return nil
+	}
+	return ratelimit.Limits(policies, ratelimit.Subject{
+		MailboxID:      mailboxId,
+		InboxRateLimit: s.getInboxRateLimit(mailboxId),
+	})
+}
+
+// count message in limits, return exceeded limit and seconds until
+// message fits
+
+func (s *session) exceededLimit(limits []ratelimit.Limit) (*ratelimit.Limit, int) {
+	limit, retry, err := s.srv.ServerConfig.RateLimiter.Allow(limits)
+	if err != nil {
+		// redis problem shouldn't stop emails
+		log.Errorf("rate limits: %v", err)
+		return nil, 0
+	}
+	if limit == nil {
+		return nil, 0
+	}
+	// round up, client shouldn't retry too early
+	seconds := int((retry + time.Second - 1) / time.Second)
+	log.Debugf("rate limit %s exceeded, retry in %d seconds", limit.Key, seconds)
+	return limit, seconds
+}
+
+func (s *session) rejectRateLimit(limit *ratelimit.Limit, seconds int) {
+	if limit.Scope == ratelimit.SCOPE_IP {
+		s.sendlinef("421 4.7.0 %s Error: too many messages from your network, try again in %d seconds", s.srv.hostname(), seconds)
+		s.dropped = true
+		s.rwc.Close()
+		return
+	}
+	s.handleError(rateLimitError(limit, seconds))
+}
+
+func rateLimitError(limit *ratelimit.Limit, seconds int) error {
+	return SMTPError(fmt.Sprintf("450 4.7.1 Error: too many messages by %s, try again in %d seconds", limit.Scope, seconds))
 }
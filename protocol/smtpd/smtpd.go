@@ -2,46 +2,66 @@
 // its behavior.
 package smtpd
 
-// TODO:
-//  -- send 421 to connected clients on graceful server shutdown (s3.8)
-//
-
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dnsbl"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/protocol/proxyproto"
+	"github.com/Polymail/go-falcon/spf"
 	"github.com/Polymail/go-falcon/utils"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
 	"io"
 	"io/ioutil"
 	"net"
-	"net/textproto"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	UNIX_SOCKET_MODE = 0660
+
+	shutdownPollInterval = 100 * time.Millisecond
 )
 
 var (
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:[\s*]?<(.+)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:[\s*]?<(.*)>`)
-	nginxRE    = regexp.MustCompile(`(?i)(.*) LOGIN=(\d+) (.*)`)
+	// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+	ErrServerClosed = errors.New("smtpd: Server closed")
+
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:[\s*]?<([^>]+)>(.*)`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:[\s*]?<([^>]*)>(.*)`)
 )
 
 // Server is an SMTP server.
 type Server struct {
 	Addr         string        // TCP address to listen on, ":2525" if empty
+	TLSAddr      string        // TCP address for implicit TLS (SMTPS), used by ListenAndServeTLS
+	Network      string        // "tcp" or "unix" (Addr is socket path), "tcp" if empty
 	Hostname     string        // optional Hostname to announce; "" to use system hostname
+	Lmtp         bool          // speak LMTP (RFC 2033) instead of SMTP
 	ReadTimeout  time.Duration // optional read timeout
 	WriteTimeout time.Duration // optional write timeout
 
 	TLSconfig *tls.Config // tls config
 
+	// ProxyNetworks are trusted load balancers, which send PROXY protocol
+	// header with real client address. Disabled if empty.
+	ProxyNetworks []*net.IPNet
+
 	ServerConfig *config.Config
 
 	// OnNewConnection, if non-nil, is called on new connections.
@@ -51,6 +71,12 @@ type Server struct {
 	// OnNewMail must be defined and is called when a new message beings.
 	// (when a MAIL FROM line arrives)
 	OnNewMail func(c Connection, from MailAddress) (Envelope, error)
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	sessions   map[*session]struct{}
+	inShutdown int32
+	shutdownCh chan struct{} // closed on shutdown, stops reply delays
 }
 
 // MailAddress is defined by
@@ -72,16 +98,44 @@ type Envelope interface {
 	AddMailboxId(mailboxId int) error
 	AddSender(from MailAddress) error
 	AddRecipient(rcpt MailAddress) error
+	RemoveRecipient(rcpt MailAddress) error // recipient is rejected after RCPT (LMTP)
+	AddRecipientMailbox(rcpt MailAddress, mailboxId int) error
+	AddMailParams(params *MailParams) error
+	AddRecipientParams(rcpt MailAddress, params *RcptParams) error
+	AddSpfReport(report *spf.Report) error
+	AddSpfHeloReport(report *spf.Report) error
+	AddTrace(trace *Trace) error
 	BeginData() error
-	Write(line []byte) error
+	Write(chunk []byte) error // append chunk of data, chunk is reused after call
+	Discard() error           // drop data of envelope, which isn't closed
 	Close() error
 }
 
+// DeliveryReporter is implemented by envelopes, which can wait until
+// message is stored. LMTP uses it to reply for each recipient after DATA.
+type DeliveryReporter interface {
+	ExpectDelivery()       // called before Close
+	WaitDelivery() []error // result for each recipient, nil if stored
+}
+
 type BasicEnvelope struct {
-	MailboxID int
-	From      MailAddress
-	Rcpts     []MailAddress
-	MailBody  []byte
+	MailboxID       int // inbox for recipients without own inbox
+	From            MailAddress
+	Rcpts           []MailAddress
+	RcptMailboxes   map[string]int        // recipient email -> inbox (email address mode)
+	StoredMailboxes []int                 // inboxes, which already have this email
+	MailParams      MailParams            // ESMTP parameters of MAIL FROM
+	RcptParams      map[string]RcptParams // recipient email -> ESMTP parameters of RCPT TO
+	Spf             *spf.Report           // SPF of client address, nil if not checked
+	SpfHelo         *spf.Report           // SPF of HELO host, nil if not checked
+	Dnsbl           *dnsbl.Result         // block list listings, nil if not checked
+	Trace           *Trace                // session info for Received header
+	MailBody        *mailbody.Body        // data of email, nil before DATA
+	SpoolID         string                // id of spool entry, empty if spool disabled
+	QueuedAt        time.Time             // when email was queued for storage workers
+	Attempts        int                   // failed storing attempts of spool entry
+
+	delivery chan map[int]error // result of storing by inbox, nil if nobody waits for it
 }
 
 func (e *BasicEnvelope) AddMailboxId(mailboxId int) error {
@@ -89,6 +143,74 @@ func (e *BasicEnvelope) AddMailboxId(mailboxId int) error {
 	return nil
 }
 
+func (e *BasicEnvelope) AddRecipientMailbox(rcpt MailAddress, mailboxId int) error {
+	if e.RcptMailboxes == nil {
+		e.RcptMailboxes = make(map[string]int)
+	}
+	e.RcptMailboxes[rcpt.Email()] = mailboxId
+	return nil
+}
+
+func (e *BasicEnvelope) AddMailParams(params *MailParams) error {
+	e.MailParams = *params
+	return nil
+}
+
+func (e *BasicEnvelope) AddRecipientParams(rcpt MailAddress, params *RcptParams) error {
+	if e.RcptParams == nil {
+		e.RcptParams = make(map[string]RcptParams)
+	}
+	e.RcptParams[rcpt.Email()] = *params
+	return nil
+}
+
+func (e *BasicEnvelope) AddSpfReport(report *spf.Report) error {
+	e.Spf = report
+	return nil
+}
+
+func (e *BasicEnvelope) AddSpfHeloReport(report *spf.Report) error {
+	e.SpfHelo = report
+	return nil
+}
+
+func (e *BasicEnvelope) AddTrace(trace *Trace) error {
+	e.Trace = trace
+	return nil
+}
+
+// RcptMailboxID returns inbox of recipient, 0 if email has no inbox for it
+
+func (e *BasicEnvelope) RcptMailboxID(rcpt MailAddress) int {
+	if mailboxId, ok := e.RcptMailboxes[rcpt.Email()]; ok {
+		return mailboxId
+	}
+	return e.MailboxID
+}
+
+// MailboxIDs returns distinct inboxes, which should receive this email
+
+func (e *BasicEnvelope) MailboxIDs() []int {
+	var mailboxIds []int
+	seen := make(map[int]bool)
+	for _, mailboxId := range e.StoredMailboxes {
+		seen[mailboxId] = true
+	}
+	add := func(mailboxId int) {
+		if mailboxId > 0 && !seen[mailboxId] {
+			seen[mailboxId] = true
+			mailboxIds = append(mailboxIds, mailboxId)
+		}
+	}
+	for _, rcpt := range e.Rcpts {
+		add(e.RcptMailboxID(rcpt))
+	}
+	if len(e.Rcpts) == 0 {
+		add(e.MailboxID)
+	}
+	return mailboxIds
+}
+
 func (e *BasicEnvelope) AddSender(from MailAddress) error {
 	e.From = from
 	return nil
@@ -99,25 +221,86 @@ func (e *BasicEnvelope) AddRecipient(rcpt MailAddress) error {
 	return nil
 }
 
+func (e *BasicEnvelope) RemoveRecipient(rcpt MailAddress) error {
+	rcpts := e.Rcpts[:0]
+	for _, r := range e.Rcpts {
+		if r.Email() != rcpt.Email() {
+			rcpts = append(rcpts, r)
+		}
+	}
+	e.Rcpts = rcpts
+	delete(e.RcptMailboxes, rcpt.Email())
+	delete(e.RcptParams, rcpt.Email())
+	return nil
+}
+
 func (e *BasicEnvelope) BeginData() error {
 	if len(e.Rcpts) == 0 {
 		return SMTPError("554 5.5.1 Error: no valid recipients")
 	}
-	if e.MailboxID <= 0 {
+	if len(e.MailboxIDs()) == 0 {
 		return SMTPError("554 5.5.1 Error: no inbox for this email")
 	}
 	return nil
 }
 
-func (e *BasicEnvelope) Write(line []byte) error {
-	e.MailBody = line
-	return nil
+// Write appends chunk to body, body without configured memory size is
+// created with default one
+
+func (e *BasicEnvelope) Write(chunk []byte) error {
+	if e.MailBody == nil {
+		e.MailBody = mailbody.New(mailbody.DEFAULT_MEMORY_SIZE, "")
+	}
+	_, err := e.MailBody.Write(chunk)
+	return err
+}
+
+func (e *BasicEnvelope) Discard() error {
+	if e.MailBody == nil {
+		return nil
+	}
+	return e.MailBody.Close()
 }
 
 func (e *BasicEnvelope) Close() error {
 	return nil
 }
 
+func (e *BasicEnvelope) ExpectDelivery() {
+	e.delivery = make(chan map[int]error, 1)
+}
+
+// DeliveryExpected returns true if session waits for result of storing
+
+func (e *BasicEnvelope) DeliveryExpected() bool {
+	return e.delivery != nil
+}
+
+// Delivered is called by storage worker with result of storing by inbox
+
+func (e *BasicEnvelope) Delivered(results map[int]error) {
+	if e.delivery != nil {
+		e.delivery <- results
+	}
+}
+
+func (e *BasicEnvelope) WaitDelivery() []error {
+	results := make([]error, len(e.Rcpts))
+	if e.delivery == nil {
+		return results
+	}
+	mailboxResults := <-e.delivery
+	for i, rcpt := range e.Rcpts {
+		mailboxId := e.RcptMailboxID(rcpt)
+		if mailboxId <= 0 {
+			results[i] = SMTPError(fmt.Sprintf("550 5.1.1 <%s> Error: no inbox for this recipient", rcpt.Email()))
+			continue
+		}
+		results[i] = mailboxResults[mailboxId]
+	}
+	return results
+}
+
 // SERVER
 
 func (srv *Server) hostname() string {
@@ -142,18 +325,66 @@ func (srv *Server) ListenAndServe() error {
 	if addr == "" {
 		addr = ":2525"
 	}
+	network := srv.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		// remove stale socket from previous run
+		os.Remove(addr)
+	}
+	ln, e := net.Listen(network, addr)
+	if e != nil {
+		return e
+	}
+	if network == "unix" {
+		if e = os.Chmod(addr, UNIX_SOCKET_MODE); e != nil {
+			ln.Close()
+			return e
+		}
+	}
+	return srv.Serve(srv.proxyListener(ln))
+}
+
+// ListenAndServeTLS listens on srv.TLSAddr and serves connections, which
+// are wrapped in TLS from the first byte (SMTPS, RFC 8314). It can run
+// alongside ListenAndServe, Shutdown stops both.
+func (srv *Server) ListenAndServeTLS() error {
+	if srv.TLSconfig == nil {
+		return errors.New("smtpd: TLSconfig is not set")
+	}
+	addr := srv.TLSAddr
+	if addr == "" {
+		addr = ":465"
+	}
 	ln, e := net.Listen("tcp", addr)
 	if e != nil {
 		return e
 	}
-	return srv.Serve(ln)
+	return srv.Serve(tls.NewListener(srv.proxyListener(ln), srv.TLSconfig))
+}
+
+// read PROXY header from trusted networks
+
+func (srv *Server) proxyListener(ln net.Listener) net.Listener {
+	if len(srv.ProxyNetworks) == 0 {
+		return ln
+	}
+	return proxyproto.NewListener(ln, srv.ProxyNetworks)
 }
 
 func (srv *Server) Serve(ln net.Listener) error {
 	defer ln.Close()
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
 	for {
 		rw, e := ln.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				log.Errorf("smtpd: Accept error: %v", e)
 				continue
@@ -164,9 +395,114 @@ func (srv *Server) Serve(ln net.Listener) error {
 		if err != nil {
 			continue
 		}
+		srv.trackSession(sess, true)
 		go sess.serve()
 	}
-	panic("not reached")
+}
+
+// Shutdown gracefully stops the server. It closes all listeners, sends 421
+// to sessions waiting for a command and waits for sessions which are in
+// the middle of DATA. If ctx expires first, remaining connections are closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.mu.Lock()
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	if srv.shutdownCh == nil {
+		srv.shutdownCh = make(chan struct{})
+	}
+	select {
+	case <-srv.shutdownCh:
+	default:
+		close(srv.shutdownCh)
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.interruptIdleSessions() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// channel, which is closed on shutdown
+
+func (srv *Server) shutdownChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdownCh == nil {
+		srv.shutdownCh = make(chan struct{})
+	}
+	return srv.shutdownCh
+}
+
+// track listener, return false if server is shutting down
+
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	if add {
+		srv.sessions[s] = struct{}{}
+	} else {
+		delete(srv.sessions, s)
+	}
+}
+
+// interrupt sessions waiting for command, return true if no sessions left
+
+func (srv *Server) interruptIdleSessions() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for s := range srv.sessions {
+		s.interruptIfIdle()
+	}
+	return len(srv.sessions) == 0
+}
+
+// close all sessions and wait until they finish
+
+func (srv *Server) closeSessions() {
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		s.closeConn()
+	}
+	srv.mu.Unlock()
+	for !srv.interruptIdleSessions() {
+		time.Sleep(shutdownPollInterval)
+	}
 }
 
 // SESSION
@@ -177,22 +513,41 @@ type session struct {
 	br  *bufio.Reader
 	bw  *bufio.Writer
 
-	env Envelope // current envelope, or nil
+	mu   sync.Mutex // guards idle and rwc deadlines on shutdown
+	idle bool       // waiting for next command
+
+	env        Envelope      // current envelope, or nil
+	from       MailAddress   // sender of current envelope
+	rcpts      []MailAddress // accepted recipients of current envelope
+	rcptBoxes  []int         // inbox of each accepted recipient, 0 if unknown
+	rcptErrors []error       // LMTP reply of recipient, which is rejected after RCPT
+	binaryMime bool          // BODY=BINARYMIME, only BDAT is allowed
+	smtpUtf8   bool          // SMTPUTF8, non-ASCII addresses are allowed
+	inData     bool          // DATA or BDAT is started, data isn't queued yet
+	bdatSize   int64         // received BDAT octets
 
 	helloType string
 	helloHost string
+	spfHelo   *spf.Report // SPF of HELO host, checked once for host
+
+	xclient xclientAttrs // client attributes forwarded by proxy
 
 	authPlain        bool   // bool for 2 step plain auth
 	authLogin        bool   // bool for 2 step login auth
 	authCramMd5Login string // bytes for cram-md5 login
 
-	mailboxId    int    // id of mailbox
-	maxMessages  int    // max messages
-	authUsername string // auth login
-	authPassword string // auth password
+	mailboxId     int    // id of mailbox
+	authMailboxId int    // id of mailbox from AUTH or XCLIENT
+	maxMessages   int    // max messages
+	authUsername  string // auth login
+	authPassword  string // auth password
+
+	faults  sessionFaults // fault rules of inbox
+	dropped bool          // connection is closed by fault rule or rate limit
 
-	rateLimit int  // rate limit from db
-	isBlocked bool // is session blocked
+	command     string        // verb of current command, empty for greeting
+	delayed     bool          // first reply of current command is delayed
+	tarpitDelay time.Duration // grows after protocol errors and failed AUTH
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
@@ -205,8 +560,6 @@ func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 		authLogin:        false,
 		authCramMd5Login: "",
 		mailboxId:        0,
-		rateLimit:        srv.ServerConfig.Adapter.Rate_Limit,
-		isBlocked:        false,
 	}
 	return
 }
@@ -216,10 +569,12 @@ func (s *session) errorf(format string, args ...interface{}) {
 }
 
 func (s *session) sendf(format string, args ...interface{}) {
+	reply := fmt.Sprintf(format, args...)
+	s.sleep(s.replyDelay(reply))
 	if s.srv.WriteTimeout != 0 {
 		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
 	}
-	fmt.Fprintf(s.bw, format, args...)
+	s.bw.WriteString(reply)
 	s.bw.Flush()
 }
 
@@ -235,29 +590,98 @@ func (s *session) sendSMTPErrorOrLinef(err error, format string, args ...interfa
 	s.sendlinef(format, args...)
 }
 
+// Addr returns client address, forwarded by XCLIENT if proxy sent it
+
 func (s *session) Addr() net.Addr {
+	if s.xclient.addr != nil {
+		return s.xclient.addr
+	}
 	return s.rwc.RemoteAddr()
 }
 
+// wait for next command, return false if server is shutting down
+
+func (s *session) beginIdle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv.shuttingDown() {
+		return false
+	}
+	if s.srv.ReadTimeout != 0 {
+		s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+	}
+	s.idle = true
+	return true
+}
+
+func (s *session) endIdle() {
+	s.mu.Lock()
+	s.idle = false
+	s.mu.Unlock()
+}
+
+// unblock reading of next command on shutdown
+
+func (s *session) interruptIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle {
+		s.rwc.SetReadDeadline(time.Now())
+	}
+}
+
+func (s *session) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rwc.SetDeadline(time.Now())
+}
+
+// send 421 on graceful shutdown (s3.8)
+
+func (s *session) sendShutdown() {
+	s.sendlinef("421 4.3.2 %s Service shutting down, closing transmission channel", s.srv.hostname())
+}
+
 // parse commands to server
 
 func (s *session) serve() {
+	defer s.srv.trackSession(s, false)
 	defer s.rwc.Close()
+	// drop data of unfinished envelope
+	defer s.resetEnvelope()
+	// PROXY header is read before any deadline is set
+	if pc, ok := s.rwc.(*proxyproto.Conn); ok {
+		if _, err := pc.Header(); err != nil {
+			s.errorf("PROXY header: %v", err)
+			return
+		}
+	}
 	if onc := s.srv.OnNewConnection; onc != nil {
 		if err := onc(s); err != nil {
 			s.sendSMTPErrorOrLinef(err, "554 connection rejected")
 			return
 		}
 	}
+	if s.srv.shuttingDown() {
+		s.sendShutdown()
+		return
+	}
 	s.sendf("220 %s %s\r\n", s.srv.ServerConfig.Adapter.Welcome_Msg, s.srv.hostname())
 	for {
-		if s.srv.ReadTimeout != 0 {
-			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+		if !s.beginIdle() {
+			s.sendShutdown()
+			return
 		}
 		sl, err := s.br.ReadString('\n')
+		s.endIdle()
 		if err != nil {
+			if s.srv.shuttingDown() {
+				s.resetEnvelope()
+				s.sendShutdown()
+				return
+			}
 			// client close connection
-			if io.EOF != err {
+			if io.EOF != err && !s.dropped {
 				s.errorf("read error: %v", err)
 				s.resetEnvelope()
 			}
@@ -270,9 +694,23 @@ func (s *session) serve() {
 		}
 
 		log.Debugf("Command from client %s", line)
+		if !s.authPlain && !s.authLogin && s.authCramMd5Login == "" {
+			// AUTH continuation lines are part of AUTH command
+			s.command, s.delayed = line.Verb(), false
+		}
 
 		switch line.Verb() {
-		case "HELO", "EHLO", "LHLO":
+		case "HELO", "EHLO":
+			if s.srv.Lmtp {
+				s.sendlinef("500 5.5.1 Error: use LHLO in LMTP mode")
+				continue
+			}
+			s.handleHello(line.Verb(), line.Arg())
+		case "LHLO":
+			if !s.srv.Lmtp {
+				s.sendlinef("500 5.5.1 Error: LHLO is only for LMTP")
+				continue
+			}
 			s.handleHello(line.Verb(), line.Arg())
 		case "QUIT":
 			s.sendlinef("221 2.0.0 Bye")
@@ -290,19 +728,23 @@ func (s *session) serve() {
 				s.sendlinef("501 5.1.7 Bad sender address syntax")
 				continue
 			}
-			s.handleMailFrom(m[1])
+			s.handleMailFrom(m[1], m[2])
 		case "RCPT":
 			s.handleRcpt(line)
 		case "DATA":
 			s.handleData()
+		case "BDAT":
+			if !s.handleBdat(line.Arg()) {
+				return
+			}
 		case "VRFY", "EXPN":
 			s.sendlinef("252 send some mail, i'll try my best")
 		case "HELP":
 			s.sendlinef("214-This server supports the following commands:")
-			s.sendlinef("214 HELO EHLO STARTTLS RCPT DATA RSET MAIL QUIT HELP AUTH VRFY NOOP")
+			s.sendlinef("214 HELO EHLO STARTTLS RCPT DATA BDAT RSET MAIL QUIT HELP AUTH VRFY NOOP")
 		case "XCLIENT":
-			// Nginx sends this
-			s.handleNginx(line.Arg())
+			// Nginx and other proxies send this
+			s.handleXclient(line.Arg())
 		case "AUTH":
 			s.handleAuth(line.Arg())
 		case "STARTTLS":
@@ -340,14 +782,21 @@ func (s *session) checkSeveralSteps(line cmdLine) bool {
 func (s *session) handleHello(greeting, host string) {
 	s.helloType = greeting
 	s.helloHost = host
-	fmt.Fprintf(s.bw, "250-%s\r\n", s.srv.hostname())
-	extensions := []string{}
+	s.spfHelo = nil
+	if s.xclient.helo != "" {
+		// proxy sends own HELO after XCLIENT
+		s.helloHost = s.xclient.helo
+	}
+	extensions := []string{"250-" + s.srv.hostname()}
 	if s.srv.ServerConfig.Adapter.Auth {
 		extensions = append(extensions, "250-AUTH LOGIN PLAIN CRAM-MD5")
 	}
-	if s.srv.ServerConfig.Adapter.Tls {
+	if s.srv.ServerConfig.Adapter.Tls && !s.isTLS() {
 		extensions = append(extensions, "250-STARTTLS")
 	}
+	if s.isXclientAllowed() {
+		extensions = append(extensions, "250-XCLIENT "+XCLIENT_ATTRIBUTES)
+	}
 	// size end
 	extensions = append(extensions,
 		"250-DSN",
@@ -355,27 +804,31 @@ func (s *session) handleHello(greeting, host string) {
 		fmt.Sprintf("250-SIZE %d", s.srv.ServerConfig.Adapter.Max_Mail_Size),
 		"250-ENHANCEDSTATUSCODES",
 		"250-8BITMIME",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
 		"250 HELP",
 	)
-	for _, ext := range extensions {
-		fmt.Fprintf(s.bw, "%s\r\n", ext)
-	}
-	s.bw.Flush()
+	s.sendf("%s\r\n", strings.Join(extensions, "\r\n"))
 }
 
 // Handle mail from
 
-func (s *session) handleMailFrom(email string) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
-
+func (s *session) handleMailFrom(email, paramsLine string) {
 	if s.env != nil {
 		s.sendlinef("503 5.5.1 Error: nested MAIL command")
 		return
 	}
-	log.Debugf("mail from: %q", email)
+	log.Debugf("mail from: %q %q", email, paramsLine)
+	params, err := parseMailParams(paramsLine, s.srv.ServerConfig.Adapter.Max_Mail_Size)
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.5.4 Error: invalid parameters")
+		return
+	}
+	if err := checkAddressEncoding(email, params.SmtpUtf8); err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.1.7 Bad sender address syntax")
+		return
+	}
 	cb := s.srv.OnNewMail
 	if cb == nil {
 		log.Errorf("smtp: Server.OnNewMail is nil; rejecting MAIL FROM")
@@ -383,31 +836,69 @@ func (s *session) handleMailFrom(email string) {
 		return
 	}
 	s.resetEnvelope()
+	if s.injectFault(FAULT_STAGE_MAIL, s.authMailboxId) {
+		return
+	}
 	fromEmail := addrString(email)
 	env, err := cb(s, fromEmail)
 	if err != nil {
 		log.Errorf("rejecting MAIL FROM %q: %v", email, err)
-		// TODO: send it back to client if warranted, like above
+		s.sendSMTPErrorOrLinef(err, "451 4.3.0 Error: sender rejected")
 		return
 	}
 	s.env = env
+	s.from = fromEmail
+	s.binaryMime = params.Body == "BINARYMIME"
+	s.smtpUtf8 = params.SmtpUtf8
 	s.env.AddSender(fromEmail)
+	s.env.AddMailParams(params)
+	if s.srv.ServerConfig.Spf.Enabled {
+		report := s.checkSpf(fromEmail)
+		s.env.AddSpfReport(report)
+		if report.Identity == spf.IDENTITY_HELO {
+			s.spfHelo = report
+		}
+		s.env.AddSpfHeloReport(s.checkSpfHelo())
+	}
 	s.sendlinef("250 2.1.0 Ok")
 }
 
+// check SPF of client address for MAIL FROM, HELO host is checked for
+// null sender
+
+func (s *session) checkSpf(from MailAddress) *spf.Report {
+	var ip net.IP
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	report := spf.Check(s.srv.ServerConfig.Resolver, ip, from.Email(), s.helloHost)
+	log.Debugf("SPF %s for %s: %s (%s)", report.Identity, report.Domain, report.Result, report.Explanation)
+	return report
+}
+
+// check SPF of HELO host once for session or next HELO
+
+func (s *session) checkSpfHelo() *spf.Report {
+	if s.spfHelo != nil {
+		return s.spfHelo
+	}
+	var ip net.IP
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	s.spfHelo = spf.CheckHelo(s.srv.ServerConfig.Resolver, ip, s.helloHost)
+	log.Debugf("SPF %s for %s: %s (%s)", s.spfHelo.Identity, s.spfHelo.Domain, s.spfHelo.Result, s.spfHelo.Explanation)
+	return s.spfHelo
+}
+
 // Handle to in mail
 
 func (s *session) handleRcpt(line cmdLine) {
-	// TODO: 4.1.1.11.  If the server SMTP does not recognize or
-	// cannot implement one or more of the parameters associated
-	// qwith a particular MAIL FROM or RCPT TO command, it will return
-	// code 555.
-
 	if s.env == nil {
 		s.sendlinef("503 5.5.1 Error: need MAIL command")
 		return
 	}
-	if s.checkNeedAuthOrBlocked() {
+	if s.checkNeedAuth() {
 		return
 	}
 
@@ -419,40 +910,51 @@ func (s *session) handleRcpt(line cmdLine) {
 		return
 	}
 
+	params, err := parseRcptParams(m[2])
+	if err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.5.4 Error: invalid parameters")
+		return
+	}
+	if err := checkAddressEncoding(m[1], s.smtpUtf8); err != nil {
+		s.sendSMTPErrorOrLinef(err, "501 5.1.3 Bad recipient address syntax")
+		return
+	}
+
 	rcptEmail := addrString(m[1])
+	mailboxId := 0
 	if s.srv.ServerConfig.Email_Address_Mode.Enabled {
-		s.handleToAddressMode(rcptEmail)
+		mailboxId, err = s.handleToAddressMode(rcptEmail)
+		if err != nil {
+			s.sendSMTPErrorOrLinef(err, "451 4.3.0 Error: try again later")
+			return
+		}
+	}
+	rcptBox := s.rcptMailboxId(mailboxId)
+	if !s.checkGreylist(rcptEmail, rcptBox) {
+		return
 	}
-	err := s.env.AddRecipient(rcptEmail)
+	if s.injectFault(FAULT_STAGE_RCPT, rcptBox) {
+		return
+	}
+	err = s.env.AddRecipient(rcptEmail)
 	if err != nil {
 		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
 		return
 	}
-	s.sendlinef("250 2.1.0 Ok")
-}
-
-// Handle nginx
-
-func (s *session) handleNginx(line string) {
-	if s.srv.ServerConfig.Proxy.Enabled || s.srv.ServerConfig.Proxy.Proxy_Mode {
-		if s.srv.ServerConfig.Adapter.Auth {
-			if nginxRE.MatchString(line) {
-				res := nginxRE.FindStringSubmatch(line)
-				if len(res) == 4 {
-					mailboxId, err := strconv.Atoi(res[2])
-					if err == nil {
-						s.setMailboxIdHook(mailboxId)
-						s.sendlinef("250 2.0.0 OK")
-						return
-					}
-				}
-			}
-		} else {
-			s.sendlinef("250 2.0.0 OK")
+	if err := s.env.AddRecipientParams(rcptEmail, params); err != nil {
+		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
+		return
+	}
+	if mailboxId > 0 {
+		if err := s.env.AddRecipientMailbox(rcptEmail, mailboxId); err != nil {
+			s.sendSMTPErrorOrLinef(err, "550 bad recipient")
 			return
 		}
 	}
-	s.sendlinef("535 5.7.1 authentication failed")
+	s.rcpts = append(s.rcpts, rcptEmail)
+	s.rcptBoxes = append(s.rcptBoxes, rcptBox)
+	s.rcptErrors = append(s.rcptErrors, nil)
+	s.sendlinef("250 2.1.0 Ok")
 }
 
 // Handle data
@@ -462,40 +964,51 @@ func (s *session) handleData() {
 		s.sendlinef("503 5.5.1 Error: need RCPT command")
 		return
 	}
-	// rate limit
-	s.isBlocked = s.redisIsSessionBlocked()
-	// is need to block?
-	if s.checkNeedAuthOrBlocked() {
+	if s.inData || s.binaryMime {
+		s.sendlinef("503 5.5.1 Error: DATA is not allowed with BDAT or BINARYMIME")
 		return
-	} else {
-		// store mailbox id in envelop
-		if s.mailboxId > 0 {
-			s.env.AddMailboxId(s.mailboxId)
-		}
 	}
-
-	if err := s.env.BeginData(); err != nil {
-		s.handleError(err)
+	if !s.beginData() {
 		return
 	}
 
 	s.sendlinef("354 Go ahead")
-
-	data := &bytes.Buffer{}
-	reader := textproto.NewReader(s.br).DotReader()
+	// replies after data have own delay
+	s.command, s.delayed = TARPIT_END_OF_DATA, false
+
+	// data is streamed to envelope
+	s.inData = true
+	data := &envelopeWriter{env: s.env}
+	dataConfig := &s.srv.ServerConfig.Data
+	reader := newDataReader(s.br, dataConfig.Bare_Line_Endings, dataConfig.Max_Line_Length, dataConfig.Max_Headers)
 	_, err := io.CopyN(data, reader, int64(s.srv.ServerConfig.Adapter.Max_Mail_Size))
 
 	if err == io.EOF {
-		s.env.Write(data.Bytes())
-		s.env.Close()
+		if reader.err != nil {
+			log.Errorf("smtpd: invalid DATA: %v, inbox: %v", reader.err, s.mailboxId)
+			s.sendSMTPErrorOrLinef(reader.err, "550 5.6.0 Error: invalid message")
+			s.resetEnvelope()
+			return
+		}
+		s.closeEnvelope()
+		return
+	}
+
+	if data.err != nil {
+		log.Errorf("smtpd: DATA write error: %v, inbox: %v", data.err, s.mailboxId)
+		if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+			s.resetEnvelope()
+			return
+		}
+		s.sendSMTPErrorOrLinef(data.err, "451 4.3.0 Error: queue file write error")
 		s.resetEnvelope()
-		s.sendlinef("250 2.0.0 Ok: queued")
 		return
 	}
 
 	if err != nil {
 		// Network error, ignore (or just exit)
 		log.Errorf("smtpd: DATA not EOF error: %v+, inbox: %v", err, s.mailboxId)
+		s.resetEnvelope()
 		return
 	}
 
@@ -515,21 +1028,268 @@ func (s *session) handleData() {
 	s.resetEnvelope()
 }
 
+// check limits and start data of envelope, reply with error and
+// return false if email can't be accepted
+
+func (s *session) beginData() bool {
+	if s.checkNeedAuth() {
+		return false
+	} else {
+		// store mailbox id in envelop, recipients in email
+		// address mode have own inboxes
+		if s.authMailboxId > 0 {
+			s.env.AddMailboxId(s.authMailboxId)
+		}
+	}
+
+	if err := s.env.BeginData(); err != nil {
+		s.handleError(err)
+		return false
+	}
+	if !s.checkRateLimits() {
+		return false
+	}
+	if s.injectEnvelopeFault(FAULT_STAGE_DATA) {
+		return false
+	}
+	if s.allRejected() {
+		// LMTP recipients are rejected by their inboxes
+		s.handleError(s.rcptErrors[0])
+		return false
+	}
+	s.env.AddTrace(s.trace())
+	return true
+}
+
+// queue received email and reply to client
+
+func (s *session) closeEnvelope() {
+	if s.injectEnvelopeFault(FAULT_STAGE_END_OF_DATA) {
+		s.resetEnvelope()
+		return
+	}
+	if s.srv.Lmtp {
+		s.closeLmtpEnvelope()
+		return
+	}
+	if err := s.env.Close(); err != nil {
+		log.Errorf("smtpd: queue error: %v, inbox: %v", err, s.mailboxId)
+		s.sendSMTPErrorOrLinef(err, "451 4.3.0 Error: queue file write error")
+		s.resetEnvelope()
+		return
+	}
+	// data belongs to storage worker now
+	s.inData = false
+	s.resetEnvelope()
+	s.sendlinef("250 2.0.0 Ok: queued")
+}
+
+// Handle BDAT chunk (RFC 3030), chunk is always read from connection,
+// return false on network error
+
+func (s *session) handleBdat(arg string) bool {
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		s.sendlinef("501 5.5.4 Syntax: BDAT <size> [LAST]")
+		return true
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		// size is unknown, client and server are out of sync
+		s.sendlinef("501 5.5.4 Error: invalid chunk size")
+		return false
+	}
+	if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "LAST")) {
+		return s.discardBdat(size, "501 5.5.4 Syntax: BDAT <size> [LAST]")
+	}
+	last := len(args) == 2
+
+	if s.env == nil {
+		return s.discardBdat(size, "503 5.5.1 Error: need RCPT command")
+	}
+	if !s.inData {
+		if !s.beginData() {
+			// error is already sent, drop the chunk
+			_, err := io.CopyN(ioutil.Discard, s.br, size)
+			return err == nil
+		}
+		s.inData = true
+	}
+
+	maxSize := int64(s.srv.ServerConfig.Adapter.Max_Mail_Size)
+	if maxSize > 0 && s.bdatSize+size > maxSize {
+		log.Errorf("smtpd: Too big message for: %v", s.mailboxId)
+		s.resetEnvelope()
+		return s.discardBdat(size, "552 5.3.4 Message exceeded max message size of %d bytes", maxSize)
+	}
+	data := &envelopeWriter{env: s.env}
+	written, err := io.CopyN(data, s.br, size)
+	if data.err != nil {
+		log.Errorf("smtpd: BDAT write error: %v, inbox: %v", data.err, s.mailboxId)
+		s.resetEnvelope()
+		// rest of chunk is read from connection
+		return s.discardBdat(size-written, "451 4.3.0 Error: queue file write error")
+	}
+	if err != nil {
+		log.Errorf("smtpd: BDAT error: %v, inbox: %v", err, s.mailboxId)
+		s.resetEnvelope()
+		return false
+	}
+	s.bdatSize += size
+
+	if !last {
+		s.sendlinef("250 2.0.0 Ok: %d octets received", size)
+		return true
+	}
+	s.closeEnvelope()
+	return true
+}
+
+// read and drop chunk, then reply with error
+
+func (s *session) discardBdat(size int64, format string, args ...interface{}) bool {
+	if _, err := io.CopyN(ioutil.Discard, s.br, size); err != nil {
+		return false
+	}
+	s.sendlinef(format, args...)
+	return true
+}
+
+// LMTP reply for each accepted recipient (RFC 2033 s4.2)
+
+func (s *session) closeLmtpEnvelope() {
+	if s.allRejected() {
+		s.sendLmtpReplies(nil, "")
+		s.resetEnvelope()
+		return
+	}
+	reporter, ok := s.env.(DeliveryReporter)
+	if ok {
+		reporter.ExpectDelivery()
+	}
+	if err := s.env.Close(); err != nil {
+		log.Errorf("lmtp: queue error: %v, inbox: %v", err, s.mailboxId)
+		results := make([]error, len(s.rcpts))
+		for i := range results {
+			results[i] = err
+		}
+		s.sendLmtpReplies(results, "queue file write error")
+		s.resetEnvelope()
+		return
+	}
+	// data belongs to storage worker now
+	s.inData = false
+	var results []error
+	if ok {
+		results = reporter.WaitDelivery()
+	}
+	s.sendLmtpReplies(results, "delivery failed")
+	s.resetEnvelope()
+}
+
+// reply for each recipient, results are for recipients in envelope,
+// which aren't rejected before
+
+func (s *session) sendLmtpReplies(results []error, failure string) {
+	next := 0
+	for i, rcpt := range s.rcpts {
+		if s.rcptErrors[i] != nil {
+			s.sendSMTPErrorOrLinef(s.rcptErrors[i], "451 4.3.0 <%s> Error: rejected", rcpt.Email())
+			continue
+		}
+		var err error
+		if next < len(results) {
+			err = results[next]
+		}
+		next++
+		if err == nil {
+			s.sendlinef("250 2.1.5 <%s> Ok: delivered", rcpt.Email())
+		} else {
+			s.sendSMTPErrorOrLinef(err, "451 4.3.0 <%s> Error: %s", rcpt.Email(), failure)
+		}
+	}
+}
+
+// distinct inboxes of recipients, which aren't rejected
+
+func (s *session) envelopeMailboxIds() []int {
+	var mailboxIds []int
+	seen := make(map[int]bool)
+	for i, mailboxId := range s.rcptBoxes {
+		if mailboxId > 0 && s.rcptErrors[i] == nil && !seen[mailboxId] {
+			seen[mailboxId] = true
+			mailboxIds = append(mailboxIds, mailboxId)
+		}
+	}
+	return mailboxIds
+}
+
+// reject LMTP recipients of inbox, they are removed from envelope and
+// get err after DATA
+
+func (s *session) rejectMailbox(mailboxId int, err error) {
+	for i, rcpt := range s.rcpts {
+		if s.rcptBoxes[i] != mailboxId || s.rcptErrors[i] != nil {
+			continue
+		}
+		s.rcptErrors[i] = err
+		if removeErr := s.env.RemoveRecipient(rcpt); removeErr != nil {
+			log.Errorf("lmtp: remove recipient error: %v, inbox: %v", removeErr, mailboxId)
+		}
+	}
+}
+
+// all recipients are rejected by their inboxes
+
+func (s *session) allRejected() bool {
+	for _, err := range s.rcptErrors {
+		if err == nil {
+			return false
+		}
+	}
+	return len(s.rcptErrors) > 0
+}
+
 func (s *session) resetEnvelope() {
+	if s.env != nil && s.inData {
+		// data of envelope, which isn't queued
+		if err := s.env.Discard(); err != nil {
+			log.Errorf("smtpd: discard error: %v, inbox: %v", err, s.mailboxId)
+		}
+	}
 	s.env = nil
+	s.from = nil
+	s.faults.rolls = nil
+	s.rcpts = nil
+	s.rcptBoxes = nil
+	s.rcptErrors = nil
+	s.binaryMime = false
+	s.smtpUtf8 = false
+	s.inData = false
+	s.bdatSize = 0
+}
+
+// envelope as io.Writer, error of envelope is kept apart from read errors
+
+type envelopeWriter struct {
+	env Envelope
+	err error
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	if w.err = w.env.Write(p); w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
 }
 
-// check auth if need and not blocked
+// check auth if need
 
-func (s *session) checkNeedAuthOrBlocked() bool {
+func (s *session) checkNeedAuth() bool {
 	if s.srv.ServerConfig.Adapter.Auth && 0 == s.mailboxId {
 		s.sendlinef("530 5.7.0 Authentication required")
 		return true
 	}
-	if s.isBlocked {
-		s.sendlinef("550 5.7.0 Requested action not taken: too many emails per second")
-		return true
-	}
 	return false
 }
 
@@ -542,19 +1302,26 @@ func (s *session) authByDB(authMethod string) {
 			s.sendlinef("535 5.7.1 authentication failed")
 			return
 		}
-		s.setMailboxIdHook(mailboxId)
+		// inbox, which refuses session, doesn't authenticate it
+		if s.injectFault(FAULT_STAGE_CONNECT, mailboxId) {
+			return
+		}
+		s.setAuthMailboxId(mailboxId)
 	}
 	s.sendlinef("235 2.0.0 OK, go ahead")
 }
 
+// mailbox of authenticated session
+
+func (s *session) setAuthMailboxId(mailboxId int) {
+	s.authMailboxId = mailboxId
+	s.setMailboxIdHook(mailboxId)
+}
+
 // sucess set mailbox id
 
 func (s *session) setMailboxIdHook(mailboxId int) {
 	s.mailboxId = mailboxId
-	// get rate limit
-	if rateLimit, err := s.getInboxRateLimit(s.mailboxId); err == nil {
-		s.rateLimit = rateLimit
-	}
 }
 
 // plain auth
@@ -669,6 +1436,10 @@ func (s *session) handleAuth(auth string) {
 // handle StartTLS
 
 func (s *session) handleStartTLS() {
+	if s.isTLS() {
+		s.sendlinef("503 5.5.1 Error: TLS already active")
+		return
+	}
 	if s.srv.ServerConfig.Adapter.Tls {
 		s.sendlinef("220 2.0.0 Ready to start TLS")
 		var tlsConn *tls.Conn
@@ -677,7 +1448,9 @@ func (s *session) handleStartTLS() {
 		if err != nil {
 			log.Errorf("Could not TLS handshake:%v", err)
 		} else {
+			s.mu.Lock()
 			s.rwc = net.Conn(tlsConn)
+			s.mu.Unlock()
 			s.br = bufio.NewReader(s.rwc)
 			s.bw = bufio.NewWriter(s.rwc)
 		}
@@ -687,22 +1460,47 @@ func (s *session) handleStartTLS() {
 	}
 }
 
-// Handle TO address for auth by address
+// connection is encrypted by STARTTLS or implicit TLS
+
+func (s *session) isTLS() bool {
+	_, ok := s.rwc.(*tls.Conn)
+	return ok
+}
+
+// Handle TO address for auth by address, return inbox of recipient.
+// Authenticated session stores emails for other domains in own inbox
+// (returns 0), other recipients are rejected.
 
-func (s *session) handleToAddressMode(rcptEmail MailAddress) {
+func (s *session) handleToAddressMode(rcptEmail MailAddress) (int, error) {
 	username := rcptEmail.Username()
 	hostname := rcptEmail.Hostname()
-	if len(hostname) > 0 && posInSlice(s.srv.ServerConfig.Email_Address_Mode.Domains, hostname) > -1 && len(username) > 0 {
-		mailboxId, err := s.srv.ServerConfig.DbPool.CheckAddressMode(username)
-		if err == nil && mailboxId > 0 {
-			s.setMailboxIdHook(mailboxId)
+	if len(hostname) == 0 || posInSlice(s.srv.ServerConfig.Email_Address_Mode.Domains, hostname) == -1 {
+		if s.authMailboxId > 0 {
+			return 0, nil
 		}
+		return 0, SMTPError("550 5.7.1 relay denied")
 	}
+	if len(username) == 0 {
+		return 0, SMTPError("550 5.1.1 user unknown")
+	}
+	mailboxId, err := s.srv.ServerConfig.AddressMode.CheckAddressMode(username)
+	if err != nil {
+		return 0, SMTPError("451 4.3.0 Error: try again later")
+	}
+	if mailboxId <= 0 {
+		return 0, SMTPError("550 5.1.1 user unknown")
+	}
+	s.setMailboxIdHook(mailboxId)
+	return mailboxId, nil
 }
 
+// domains are compared in normalized form, so punycode and unicode
+// forms of IDN are equal
+
 func posInSlice(slice []string, value string) int {
+	value = NormalizeDomain(value)
 	for p, v := range slice {
-		if v == value {
+		if NormalizeDomain(v) == value {
 			return p
 		}
 	}
@@ -724,22 +1522,27 @@ func (s *session) handleError(err error) {
 
 type addrString string
 
+// NewMailAddress returns MailAddress for email, as provided by client
+func NewMailAddress(email string) MailAddress {
+	return addrString(email)
+}
+
 func (a addrString) Email() string {
 	return string(a)
 }
 
 func (a addrString) Hostname() string {
 	e := string(a)
-	if idx := strings.Index(e, "@"); idx != -1 {
-		return strings.ToLower(e[idx+1:])
+	if idx := strings.LastIndex(e, "@"); idx != -1 {
+		return NormalizeDomain(e[idx+1:])
 	}
 	return ""
 }
 
 func (a addrString) Username() string {
 	e := string(a)
-	if idx := strings.Index(e, "@"); idx != -1 {
-		username := strings.ToLower(e[0:idx])
+	if idx := strings.LastIndex(e, "@"); idx != -1 {
+		username := NormalizeLocalPart(e[0:idx])
 		if sidx := strings.Index(username, "+"); sidx != -1 {
 			return username[0:sidx]
 		} else {
@@ -749,6 +1552,40 @@ func (a addrString) Username() string {
 	return ""
 }
 
+// NormalizeDomain returns lowercase unicode form of domain (RFC 5891),
+// punycode labels are decoded
+
+func NormalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if unicodeDomain, err := idna.Lookup.ToUnicode(domain); err == nil {
+		return unicodeDomain
+	}
+	return strings.ToLower(norm.NFC.String(domain))
+}
+
+// NormalizeLocalPart returns lowercase NFC form of UTF-8 local part (RFC 6531)
+
+func NormalizeLocalPart(username string) string {
+	return strings.ToLower(norm.NFC.String(username))
+}
+
+// non-ASCII address is allowed only with SMTPUTF8 (RFC 6531 s3.5)
+
+func checkAddressEncoding(email string, smtpUtf8 bool) error {
+	if !utf8.ValidString(email) {
+		return SMTPError("553 5.6.7 Error: address is not valid UTF-8")
+	}
+	for i := 0; i < len(email); i++ {
+		if email[i] >= utf8.RuneSelf {
+			if !smtpUtf8 {
+				return SMTPError("553 5.6.7 Error: non-ASCII address requires SMTPUTF8")
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 // COMMAND LINE
 
 type cmdLine string
@@ -757,6 +1594,9 @@ func (cl cmdLine) checkValid() error {
 	if !strings.HasSuffix(string(cl), "\r\n") {
 		return errors.New(`line doesn't end in \r\n`)
 	}
+	if strings.ContainsAny(string(cl[:len(cl)-2]), "\r\n") {
+		return errors.New(`bare \r or \n in line`)
+	}
 	// Check for verbs defined not to have an argument
 	// (RFC 5321 s4.1.1)
 	switch cl.Verb() {
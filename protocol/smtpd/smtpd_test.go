@@ -0,0 +1,1009 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/ratelimit"
+	"github.com/Polymail/go-falcon/resolver"
+	"github.com/Polymail/go-falcon/spf"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// test envelope accepts emails without storage
+
+type testEnvelope struct {
+	BasicEnvelope
+	closed chan *testEnvelope
+}
+
+func (e *testEnvelope) BeginData() error {
+	if len(e.Rcpts) == 0 {
+		return SMTPError("554 5.5.1 Error: no valid recipients")
+	}
+	return nil
+}
+
+func (e *testEnvelope) Close() error {
+	e.closed <- e
+	return nil
+}
+
+func newTestConfig() *config.Config {
+	serverConfig := config.NewConfig()
+	serverConfig.Adapter.Hostname = "falcon.test"
+	serverConfig.Adapter.Welcome_Msg = "Falcon Mail Server"
+	serverConfig.Adapter.Max_Mail_Size = 1024
+	serverConfig.Adapter.Rate_Limit = 100
+	return serverConfig
+}
+
+func startTestServer(t *testing.T, serverConfig *config.Config, options ...func(srv *Server)) (*Server, chan *testEnvelope, string) {
+	closed := make(chan *testEnvelope, 10)
+	srv := &Server{
+		Hostname:     serverConfig.Adapter.Hostname,
+		ServerConfig: serverConfig,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			return &testEnvelope{BasicEnvelope: BasicEnvelope{MailboxID: 1}, closed: closed}, nil
+		},
+	}
+	for _, option := range options {
+		option(srv)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve(ln)
+	return srv, closed, ln.Addr().String()
+}
+
+func mailBody(t *testing.T, env *testEnvelope) string {
+	if env.MailBody == nil {
+		return ""
+	}
+	data, err := ioutil.ReadAll(env.MailBody.Reader())
+	if err != nil {
+		t.Fatalf("Read body: %v", err)
+	}
+	return string(data)
+}
+
+func dialTestServer(t *testing.T, addr string) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	expectReply(t, conn, "220 ")
+	return conn
+}
+
+func sendCommand(t *testing.T, conn *textproto.Conn, command, expect string) {
+	if err := conn.PrintfLine("%s", command); err != nil {
+		t.Fatalf("Send %q: %v", command, err)
+	}
+	expectReply(t, conn, expect)
+}
+
+// read reply (skipping multiline parts) and check its prefix
+
+func expectReply(t *testing.T, conn *textproto.Conn, expect string) string {
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatalf("Expected %q, got error: %v", expect, err)
+		}
+		if len(line) > 3 && line[3] == '-' {
+			continue
+		}
+		if !strings.HasPrefix(line, expect) {
+			t.Fatalf("Expected %q, got %q", expect, line)
+		}
+		return line
+	}
+}
+
+func TestShutdownIdleSession(t *testing.T) {
+	srv, _, addr := startTestServer(t, newTestConfig())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "EHLO client.test", "250 ")
+
+	done := make(chan error)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+	expectReply(t, conn, "421 4.3.2")
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Listener is not closed after shutdown")
+	}
+}
+
+func TestShutdownWaitsForData(t *testing.T) {
+	srv, closed, addr := startTestServer(t, newTestConfig())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	conn.PrintfLine("Subject: test")
+
+	done := make(chan error)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+	time.Sleep(2 * shutdownPollInterval)
+
+	conn.PrintfLine("")
+	conn.PrintfLine("body")
+	sendCommand(t, conn, ".", "250 ")
+	expectReply(t, conn, "421 4.3.2")
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	env := <-closed
+	if body := mailBody(t, env); !strings.Contains(body, "body") {
+		t.Errorf("Unexpected mail body: %q", body)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv, _, addr := startTestServer(t, newTestConfig())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*shutdownPollInterval)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got: %v", err)
+	}
+}
+
+func TestLmtpDataReplies(t *testing.T) {
+	srv, closed, addr := startTestServer(t, newTestConfig(), func(srv *Server) {
+		srv.Lmtp = true
+	})
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "EHLO client.test", "500 ")
+	sendCommand(t, conn, "LHLO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<first@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<second@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	go func() {
+		env := <-closed
+		env.Delivered(map[int]error{})
+	}()
+	conn.PrintfLine("Subject: test")
+	conn.PrintfLine("")
+	sendCommand(t, conn, ".", "250 2.1.5 <first@example.com>")
+	expectReply(t, conn, "250 2.1.5 <second@example.com>")
+
+	// failed delivery
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<first@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	go func() {
+		env := <-closed
+		env.Delivered(map[int]error{1: SMTPError("554 5.6.0 Error: invalid message")})
+	}()
+	sendCommand(t, conn, ".", "554 5.6.0")
+}
+
+func TestLmtpUnixSocket(t *testing.T) {
+	directory, err := ioutil.TempDir("", "falcon-lmtp")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+	socket := filepath.Join(directory, "lmtp.sock")
+
+	srv := &Server{
+		Addr:         socket,
+		Network:      "unix",
+		Lmtp:         true,
+		Hostname:     "falcon.test",
+		ServerConfig: newTestConfig(),
+	}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+
+	var conn *textproto.Conn
+	for i := 0; i < 50 && conn == nil; i++ {
+		conn, err = textproto.Dial("unix", socket)
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if conn == nil {
+		t.Fatalf("Dial unix socket: %v", err)
+	}
+	defer conn.Close()
+	expectReply(t, conn, "220 ")
+	sendCommand(t, conn, "LHLO client.test", "250 ")
+}
+
+func TestEnvelopeMailboxIDs(t *testing.T) {
+	env := &BasicEnvelope{MailboxID: 7}
+	first, second, third := NewMailAddress("first@example.com"), NewMailAddress("second@example.com"), NewMailAddress("third@example.com")
+	for _, rcpt := range []MailAddress{first, second, third} {
+		env.AddRecipient(rcpt)
+	}
+	env.AddRecipientMailbox(first, 3)
+	env.AddRecipientMailbox(second, 3)
+	ids := env.MailboxIDs()
+	if len(ids) != 2 || ids[0] != 3 || ids[1] != 7 {
+		t.Errorf("Unexpected inboxes: %v", ids)
+	}
+	env.StoredMailboxes = []int{3}
+	ids = env.MailboxIDs()
+	if len(ids) != 1 || ids[0] != 7 {
+		t.Errorf("Unexpected inboxes after store: %v", ids)
+	}
+
+	env.ExpectDelivery()
+	env.Delivered(map[int]error{7: SMTPError("451 4.3.0 Error: storage")})
+	results := env.WaitDelivery()
+	if results[0] != nil || results[1] != nil || results[2] == nil {
+		t.Errorf("Unexpected delivery results: %v", results)
+	}
+}
+
+func TestAddressModeRelayDenied(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Email_Address_Mode.Enabled = true
+	serverConfig.Email_Address_Mode.Domains = []string{"falcon.test"}
+	srv, _, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "550 5.7.1 relay denied")
+	sendCommand(t, conn, "RCPT TO:<@FALCON.test>", "550 5.1.1 user unknown")
+	sendCommand(t, conn, "DATA", "554 ")
+}
+
+// address mode lookup without database
+
+type testAddressMode map[string]int
+
+func (m testAddressMode) CheckAddressMode(username string) (int, error) {
+	if username == "broken" {
+		return 0, errors.New("connection refused")
+	}
+	return m[username], nil
+}
+
+func TestAddressModeLookup(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Email_Address_Mode.Enabled = true
+	serverConfig.Email_Address_Mode.Domains = []string{"falcon.test"}
+	serverConfig.AddressMode = testAddressMode{"known": 5}
+	serverConfig.SettingsCache.StoreInboxSettings(5, storage.InboxSettings{MaxMessages: 100, RateLimit: 100})
+	srv, closed, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<missing@falcon.test>", "550 5.1.1 user unknown")
+	sendCommand(t, conn, "RCPT TO:<broken@falcon.test>", "451 4.3.0 Error: try again later")
+	sendCommand(t, conn, "RCPT TO:<known@falcon.test>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "250 ")
+	select {
+	case env := <-closed:
+		if len(env.Rcpts) != 1 || env.RcptMailboxes[env.Rcpts[0].Email()] != 5 {
+			t.Errorf("Unexpected recipients %v, inboxes %v", env.Rcpts, env.RcptMailboxes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Envelope is not closed")
+	}
+}
+
+func TestEsmtpParams(t *testing.T) {
+	srv, closed, addr := startTestServer(t, newTestConfig())
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "EHLO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com> SIZE=2048", "552 5.3.4")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com> XFOO", "555 5.5.4")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com> SIZE=100 RET=HDRS ENVID=id1", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com> NOTIFY=FAILURE ORCPT=rfc822;to@example.com", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	sendCommand(t, conn, ".", "250 ")
+	env := <-closed
+	if env.MailParams.Ret != "HDRS" || env.MailParams.EnvID != "id1" {
+		t.Errorf("Unexpected MAIL parameters: %+v", env.MailParams)
+	}
+	if rcpt := env.RcptParams["to@example.com"]; len(rcpt.Notify) != 1 || rcpt.Orcpt != "rfc822;to@example.com" {
+		t.Errorf("Unexpected RCPT parameters: %+v", env.RcptParams)
+	}
+}
+
+// send BDAT command with chunk, chunk is not followed by CRLF
+
+func sendBdat(t *testing.T, conn *textproto.Conn, chunk string, last bool, expect string) {
+	command := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		command += " LAST"
+	}
+	if _, err := conn.W.WriteString(command + "\r\n" + chunk); err != nil {
+		t.Fatalf("Send %q: %v", command, err)
+	}
+	conn.W.Flush()
+	expectReply(t, conn, expect)
+}
+
+func TestBdat(t *testing.T) {
+	srv, closed, addr := startTestServer(t, newTestConfig())
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "EHLO client.test", "250 ")
+	sendBdat(t, conn, "test", true, "503 5.5.1")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com> BODY=BINARYMIME", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "503 5.5.1")
+	sendBdat(t, conn, "Subject: test\r\n", false, "250 2.0.0")
+	sendBdat(t, conn, "\r\n\x00\r\n.\n", true, "250 2.0.0 Ok: queued")
+	env := <-closed
+	if body := mailBody(t, env); body != "Subject: test\r\n\r\n\x00\r\n.\n" {
+		t.Errorf("Unexpected mail body: %q", body)
+	}
+
+	// chunks are larger than Max_Mail_Size together
+	chunk := strings.Repeat("a", 600)
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendBdat(t, conn, chunk, false, "250 2.0.0")
+	sendBdat(t, conn, chunk, true, "552 5.3.4")
+	sendCommand(t, conn, "NOOP", "250 ")
+}
+
+func TestDataSpill(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "falcon-smtpd")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	srv, closed, addr := startTestServer(t, newTestConfig(), func(srv *Server) {
+		onNewMail := srv.OnNewMail
+		srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) {
+			env, err := onNewMail(c, from)
+			env.(*testEnvelope).MailBody = mailbody.New(16, tempDir)
+			return env, err
+		}
+	})
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	tempFiles := func() int {
+		files, _ := ioutil.ReadDir(tempDir)
+		return len(files)
+	}
+
+	sendCommand(t, conn, "EHLO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	conn.PrintfLine("Subject: test")
+	conn.PrintfLine("")
+	conn.PrintfLine("body above memory size")
+	sendCommand(t, conn, ".", "250 ")
+	env := <-closed
+	if body := mailBody(t, env); body != "Subject: test\r\n\r\nbody above memory size\r\n" {
+		t.Errorf("Unexpected mail body: %q", body)
+	}
+	if tempFiles() != 1 {
+		t.Errorf("Body is not in temp file")
+	}
+	env.MailBody.Close()
+	if tempFiles() != 0 {
+		t.Errorf("Temp file is not removed on Close")
+	}
+
+	// unfinished BDAT data is dropped
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendBdat(t, conn, strings.Repeat("a", 32), false, "250 2.0.0")
+	if tempFiles() != 1 {
+		t.Errorf("BDAT chunk is not in temp file")
+	}
+	sendCommand(t, conn, "RSET", "250 ")
+	if tempFiles() != 0 {
+		t.Errorf("Temp file is not removed on RSET")
+	}
+}
+
+func TestSmtpSmuggling(t *testing.T) {
+	for _, mode := range []string{DATA_NORMALIZE, DATA_REJECT} {
+		serverConfig := newTestConfig()
+		serverConfig.Data.Bare_Line_Endings = mode
+		srv, closed, addr := startTestServer(t, serverConfig)
+		conn := dialTestServer(t, addr)
+		sendCommand(t, conn, "EHLO client.test", "250 ")
+		for _, test := range smugglingPayloads {
+			sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+			sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+			sendCommand(t, conn, "DATA", "354 ")
+			conn.W.WriteString("Subject: test\r\n\r\nbody" + test.payload + smuggledCommands)
+			conn.W.Flush()
+			if mode == DATA_REJECT && test.bare {
+				expectReply(t, conn, "550 5.6.0")
+			} else {
+				expectReply(t, conn, "250 2.0.0 Ok: queued")
+				env := <-closed
+				if body := mailBody(t, env); !strings.Contains(body, "MAIL FROM:<admin@example.com>") {
+					t.Errorf("%s %q: unexpected mail body: %q", mode, test.payload, body)
+				}
+			}
+			// smuggled commands are not answered
+			sendCommand(t, conn, "NOOP", "250 2.0.0 OK")
+			if len(closed) != 0 {
+				t.Errorf("%s %q: smuggled email is accepted", mode, test.payload)
+			}
+		}
+		conn.Close()
+		srv.Shutdown(context.Background())
+	}
+}
+
+func TestSmtpUtf8(t *testing.T) {
+	srv, closed, addr := startTestServer(t, newTestConfig())
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "EHLO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<jörg@example.com>", "553 5.6.7")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<jörg@example.com>", "553 5.6.7")
+	sendCommand(t, conn, "RSET", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<jörg@example.com> SMTPUTF8", "250 ")
+	sendCommand(t, conn, "RCPT TO:<太郎@例え.jp>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	sendCommand(t, conn, ".", "250 ")
+	env := <-closed
+	if env.From.Email() != "jörg@example.com" || env.Rcpts[0].Email() != "太郎@例え.jp" {
+		t.Errorf("Unexpected addresses: %v %v", env.From, env.Rcpts)
+	}
+}
+
+type addressTest struct {
+	Email    string
+	Username string
+	Hostname string
+}
+
+var addressTests = []addressTest{
+	{"User+tag@Example.COM", "user", "example.com"},
+	{"Jörg@BÜCHER.example", "jörg", "bücher.example"},
+	{"jörg@xn--bcher-kva.example", "jörg", "bücher.example"},
+	{"user@example.com.", "user", "example.com"},
+}
+
+func TestMailAddress(t *testing.T) {
+	for _, test := range addressTests {
+		address := NewMailAddress(test.Email)
+		if address.Username() != test.Username || address.Hostname() != test.Hostname {
+			t.Errorf("Unexpected address %q: %q %q", test.Email, address.Username(), address.Hostname())
+		}
+	}
+	if posInSlice([]string{"example.com", "xn--bcher-kva.example"}, "Bücher.example") != 1 {
+		t.Errorf("Punycode domain doesn't match unicode domain")
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../../examples/test.pem", "../../examples/test.key")
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+	serverConfig := newTestConfig()
+	serverConfig.Adapter.Tls = true
+	srv, closed, _ := startTestServer(t, serverConfig, func(srv *Server) {
+		srv.TLSconfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+	defer srv.Shutdown(context.Background())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve(tls.NewListener(ln, srv.TLSconfig))
+
+	tlsConn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn := textproto.NewConn(tlsConn)
+	defer conn.Close()
+	expectReply(t, conn, "220 ")
+	if err := conn.PrintfLine("EHLO client.test"); err != nil {
+		t.Fatalf("Send EHLO: %v", err)
+	}
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatalf("Read EHLO reply: %v", err)
+		}
+		if strings.Contains(line, "STARTTLS") {
+			t.Errorf("STARTTLS is advertised on TLS connection")
+		}
+		if line[3] == ' ' {
+			break
+		}
+	}
+	sendCommand(t, conn, "STARTTLS", "503 ")
+
+	// trace for Received header
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "250 ")
+	trace := (<-closed).Trace
+	if trace == nil || trace.Protocol != "ESMTPS" || trace.TLSVersion == "" || trace.Helo != "client.test" || trace.ClientIP != "127.0.0.1" || trace.QueueID == "" {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	remoteAddr := make(chan string, 1)
+	srv, _, _ := startTestServer(t, newTestConfig(), func(srv *Server) {
+		srv.ProxyNetworks = []*net.IPNet{trusted}
+		srv.OnNewConnection = func(c Connection) error {
+			remoteAddr <- c.Addr().String()
+			return nil
+		}
+	})
+	defer srv.Shutdown(context.Background())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve(srv.proxyListener(ln))
+
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.PrintfLine("PROXY TCP4 192.168.0.1 192.168.0.11 56324 25")
+	expectReply(t, conn, "220 ")
+	if addr := <-remoteAddr; addr != "192.168.0.1:56324" {
+		t.Errorf("Unexpected client address: %s", addr)
+	}
+}
+
+func TestXclient(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Proxy.Enabled = true
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	serverConfig.XclientNetworks = []*net.IPNet{loopback}
+	remoteAddr := make(chan string, 1)
+	srv, _, addr := startTestServer(t, serverConfig, func(srv *Server) {
+		srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) {
+			remoteAddr <- c.Addr().String()
+			return &BasicEnvelope{}, nil
+		}
+	})
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.PrintfLine("EHLO proxy.test")
+	line := ""
+	for !strings.HasPrefix(line, "250 ") {
+		line = expectReply(t, conn, "250")
+	}
+	sendCommand(t, conn, "XCLIENT ADDR=192.0.2.1 FOO=bar", "501 5.5.4")
+	sendCommand(t, conn, "XCLIENT ADDR=IPV6:192.0.2.1", "501 5.5.4")
+	sendCommand(t, conn, "XCLIENT ADDR=192.0.2.1 PORT=4000 NAME=[UNAVAILABLE] HELO=mx+2Eexample.com PROTO=ESMTP", "220 ")
+	sendCommand(t, conn, "EHLO proxy.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	if a := <-remoteAddr; a != "192.0.2.1:4000" {
+		t.Errorf("Unexpected client address: %s", a)
+	}
+	sendCommand(t, conn, "XCLIENT ADDR=IPV6:2001:db8::1", "503 5.5.1")
+	sendCommand(t, conn, "RSET", "250 ")
+	sendCommand(t, conn, "XCLIENT ADDR=IPV6:2001:db8::1", "220 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	if a := <-remoteAddr; a != "[2001:db8::1]:4000" {
+		t.Errorf("Unexpected client address: %s", a)
+	}
+}
+
+func TestXclientUntrusted(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Proxy.Enabled = true
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	serverConfig.XclientNetworks = []*net.IPNet{network}
+	srv, _, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	conn.PrintfLine("EHLO client.test")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatalf("Read EHLO reply: %v", err)
+		}
+		if strings.Contains(line, "XCLIENT") {
+			t.Errorf("XCLIENT is advertised to untrusted client")
+		}
+		if line[3] == ' ' {
+			break
+		}
+	}
+	sendCommand(t, conn, "XCLIENT ADDR=192.0.2.1", "550 5.7.0")
+}
+
+func TestSpf(t *testing.T) {
+	zone := resolver.NewZone()
+	zone.AddTXT("example.com", "v=spf1 ip4:127.0.0.0/8 -all")
+	zone.AddTXT("client.test", "v=spf1 -all")
+	serverConfig := newTestConfig()
+	serverConfig.Spf.Enabled = true
+	serverConfig.Resolver = zone
+	srv, closed, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	tests := []struct {
+		from     string
+		identity string
+		result   spf.Result
+	}{
+		{"from@example.com", spf.IDENTITY_MAILFROM, spf.PASS},
+		{"from@example.org", spf.IDENTITY_MAILFROM, spf.NONE},
+		{"", spf.IDENTITY_HELO, spf.FAIL},
+	}
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	for _, test := range tests {
+		sendCommand(t, conn, "MAIL FROM:<"+test.from+">", "250 ")
+		sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+		sendCommand(t, conn, "DATA", "354 ")
+		sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "250 ")
+		env := <-closed
+		if env.Spf == nil || env.Spf.Identity != test.identity || env.Spf.Result != test.result {
+			t.Errorf("%q: expected %s %s, got %+v", test.from, test.identity, test.result, env.Spf)
+		}
+		if env.SpfHelo == nil || env.SpfHelo.Identity != spf.IDENTITY_HELO || env.SpfHelo.Domain != "client.test" || env.SpfHelo.Result != spf.FAIL {
+			t.Errorf("%q: unexpected helo report %+v", test.from, env.SpfHelo)
+		}
+	}
+}
+
+func TestMailFromRejected(t *testing.T) {
+	srv, _, addr := startTestServer(t, newTestConfig(), func(srv *Server) {
+		srv.OnNewMail = func(c Connection, from MailAddress) (Envelope, error) {
+			if from.Hostname() == "blocked.example" {
+				return nil, SMTPError("554 5.7.1 Service unavailable; blocked using dbl.example")
+			}
+			return nil, errors.New("database is down")
+		}
+	})
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@blocked.example>", "554 5.7.1 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "451 4.3.0 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "503 ")
+}
+
+func TestGreylistTriplet(t *testing.T) {
+	tests := []struct {
+		ip, from, triplet string
+	}{
+		{"192.0.2.77", "From@Example.com", "192.0.2.0/24_<from@example.com>_<to@example.com>"},
+		{"::ffff:192.0.2.1", "", "192.0.2.0/24_<>_<to@example.com>"},
+		{"2001:db8:1:2:3:4:5:6", "from@example.com", "2001:db8:1:2::/64_<from@example.com>_<to@example.com>"},
+	}
+	for _, test := range tests {
+		var from MailAddress
+		if test.from != "" {
+			from = addrString(test.from)
+		}
+		if triplet := greylistTriplet(net.ParseIP(test.ip), from, addrString("To@example.com")); triplet != test.triplet {
+			t.Errorf("%s: expected %s, got %s", test.ip, test.triplet, triplet)
+		}
+	}
+}
+
+func TestFaultConnect(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Adapter.Auth = true
+	serverConfig.Faults.Enabled = true
+	serverConfig.Proxy.Enabled = true
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	serverConfig.XclientNetworks = []*net.IPNet{loopback}
+	for mailboxId, code := range map[int]int{7: 550, 8: 421} {
+		serverConfig.SettingsCache.StoreInboxSettings(mailboxId, storage.InboxSettings{MaxMessages: 10, RateLimit: 10})
+		serverConfig.FaultsCache.StoreInboxFaults(mailboxId, []storage.FaultRule{{Stage: FAULT_STAGE_CONNECT, Action: FAULT_ACTION_REPLY, Code: code}})
+	}
+	srv, _, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "HELO proxy.test", "250 ")
+	sendCommand(t, conn, "XCLIENT LOGIN=7", "550 5.3.0")
+	// refused inbox isn't authenticated
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "530 5.7.0")
+	sendCommand(t, conn, "RSET", "250 ")
+	sendCommand(t, conn, "XCLIENT LOGIN=8", "421 4.3.0")
+	if line, err := conn.ReadLine(); err == nil {
+		t.Errorf("connection isn't closed after 421, got %q", line)
+	}
+}
+
+// address mode with inboxes 5, 6 and 7, first inbox fails at DATA and
+// second at end of data
+
+func newMultiInboxConfig() *config.Config {
+	serverConfig := newTestConfig()
+	serverConfig.Email_Address_Mode.Enabled = true
+	serverConfig.Email_Address_Mode.Domains = []string{"falcon.test"}
+	serverConfig.AddressMode = testAddressMode{"first": 5, "second": 6, "third": 7}
+	for _, mailboxId := range []int{5, 6, 7} {
+		serverConfig.SettingsCache.StoreInboxSettings(mailboxId, storage.InboxSettings{MaxMessages: 10, RateLimit: 10})
+		serverConfig.FaultsCache.StoreInboxFaults(mailboxId, nil)
+	}
+	serverConfig.FaultsCache.StoreInboxFaults(5, []storage.FaultRule{{Stage: FAULT_STAGE_DATA, Action: FAULT_ACTION_REPLY, Code: 552, Message: "5.2.2 Mailbox full"}})
+	serverConfig.FaultsCache.StoreInboxFaults(6, []storage.FaultRule{{Stage: FAULT_STAGE_END_OF_DATA, Action: FAULT_ACTION_REPLY, Code: 452}})
+	return serverConfig
+}
+
+func TestFaultAllInboxes(t *testing.T) {
+	serverConfig := newMultiInboxConfig()
+	serverConfig.Faults.Enabled = true
+	srv, _, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	// inbox of last recipient has no rules
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<first@falcon.test>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<third@falcon.test>", "250 ")
+	sendCommand(t, conn, "DATA", "552 5.2.2 Mailbox full")
+	sendCommand(t, conn, "RSET", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<second@falcon.test>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<third@falcon.test>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "452 4.3.0")
+}
+
+func TestLmtpFaultAllInboxes(t *testing.T) {
+	serverConfig := newMultiInboxConfig()
+	serverConfig.Faults.Enabled = true
+	srv, closed, addr := startTestServer(t, serverConfig, func(srv *Server) {
+		srv.Lmtp = true
+	})
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+	sendCommand(t, conn, "LHLO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<first@falcon.test>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<second@falcon.test>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<third@falcon.test>", "250 ")
+	sendCommand(t, conn, "DATA", "354 ")
+	delivered := make(chan *testEnvelope, 1)
+	go func() {
+		env := <-closed
+		env.Delivered(map[int]error{})
+		delivered <- env
+	}()
+	sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "552 5.2.2 Mailbox full")
+	expectReply(t, conn, "452 4.3.0")
+	expectReply(t, conn, "250 2.1.5 <third@falcon.test>")
+	env := <-delivered
+	if len(env.Rcpts) != 1 || env.Rcpts[0].Email() != "third@falcon.test" {
+		t.Errorf("Unexpected recipients of stored email: %v", env.Rcpts)
+	}
+
+	// every recipient is rejected at DATA
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<first@falcon.test>", "250 ")
+	sendCommand(t, conn, "DATA", "552 5.2.2 Mailbox full")
+}
+
+func TestRateLimitAllInboxes(t *testing.T) {
+	for _, lmtp := range []bool{false, true} {
+		serverConfig := newMultiInboxConfig()
+		serverConfig.Rate_Limits.Policies = []ratelimit.Policy{{Scope: ratelimit.SCOPE_INBOX, Window: "hour", Limit: 1}}
+		srv, closed, addr := startTestServer(t, serverConfig, func(srv *Server) {
+			srv.Lmtp = lmtp
+		})
+		go func() {
+			for env := range closed {
+				env.Delivered(map[int]error{})
+			}
+		}()
+		conn := dialTestServer(t, addr)
+		if lmtp {
+			sendCommand(t, conn, "LHLO client.test", "250 ")
+		} else {
+			sendCommand(t, conn, "HELO client.test", "250 ")
+		}
+		sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+		sendCommand(t, conn, "RCPT TO:<first@falcon.test>", "250 ")
+		sendCommand(t, conn, "DATA", "354 ")
+		sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "250 ")
+		// limit of first inbox is exceeded, it isn't last recipient
+		sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+		sendCommand(t, conn, "RCPT TO:<first@falcon.test>", "250 ")
+		sendCommand(t, conn, "RCPT TO:<third@falcon.test>", "250 ")
+		if lmtp {
+			sendCommand(t, conn, "DATA", "354 ")
+			sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "450 4.7.1 Error: too many messages by inbox")
+			expectReply(t, conn, "250 2.1.5 <third@falcon.test>")
+		} else {
+			sendCommand(t, conn, "DATA", "450 4.7.1 Error: too many messages by inbox")
+		}
+		conn.Close()
+		srv.Shutdown(context.Background())
+	}
+}
+
+func TestFaultReply(t *testing.T) {
+	tests := []struct {
+		rule  storage.FaultRule
+		reply string
+	}{
+		{storage.FaultRule{Code: 451}, "451 4.3.0 Error: temporary failure"},
+		{storage.FaultRule{Code: 552, Message: "5.2.2 Mailbox full\r\n250 Ok"}, "552 5.2.2 Mailbox full  250 Ok"},
+		{storage.FaultRule{Code: 250}, ""},
+	}
+	for _, test := range tests {
+		if reply := faultReply(test.rule); reply != test.reply {
+			t.Errorf("%d: expected %q, got %q", test.rule.Code, test.reply, reply)
+		}
+	}
+}
+
+func TestFaultApplies(t *testing.T) {
+	s := &session{}
+	always := storage.FaultRule{Stage: FAULT_STAGE_RCPT, Percent: 100}
+	half := storage.FaultRule{Stage: FAULT_STAGE_RCPT, Percent: 50}
+	if !s.faultApplies(7, 0, always) {
+		t.Errorf("expected rule for every message")
+	}
+	// decision is kept for all commands of message
+	applies := s.faultApplies(7, 1, half)
+	for i := 0; i < 10; i++ {
+		if s.faultApplies(7, 1, half) != applies {
+			t.Fatalf("decision changed for same message")
+		}
+	}
+	count := 0
+	for i := 0; i < 1000; i++ {
+		s.resetEnvelope()
+		if s.faultApplies(7, 1, half) {
+			count++
+		}
+	}
+	if count < 350 || count > 650 {
+		t.Errorf("expected about half of messages, got %d of 1000", count)
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Tarpit.Enabled = true
+	serverConfig.Tarpit.Command_Delays = map[string]int{"noop": 200}
+	serverConfig.Tarpit.Error_Delay = 100
+	serverConfig.Tarpit.Max_Delay = 250
+	srv, _, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	timeCommand := func(command, expect string) time.Duration {
+		start := time.Now()
+		sendCommand(t, conn, command, expect)
+		return time.Since(start)
+	}
+	if d := timeCommand("NOOP", "250 "); d < 200*time.Millisecond {
+		t.Errorf("NOOP reply wasn't delayed: %v", d)
+	}
+	if d := timeCommand("RSET", "250 "); d > 100*time.Millisecond {
+		t.Errorf("RSET reply was delayed: %v", d)
+	}
+	// every error increases tarpit
+	if d := timeCommand("RCPT TO:<to@example.com>", "503 "); d < 100*time.Millisecond {
+		t.Errorf("error reply wasn't delayed: %v", d)
+	}
+	if d := timeCommand("RSET", "250 "); d < 100*time.Millisecond {
+		t.Errorf("reply after error wasn't delayed: %v", d)
+	}
+	timeCommand("RCPT TO:<to@example.com>", "503 ")
+	timeCommand("RCPT TO:<to@example.com>", "503 ")
+	// limited by max delay
+	if d := timeCommand("NOOP", "250 "); d < 250*time.Millisecond || d > time.Second {
+		t.Errorf("unexpected NOOP delay: %v", d)
+	}
+}
+
+func TestTarpitData(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Tarpit.Enabled = true
+	serverConfig.Tarpit.Command_Delays = map[string]int{"data": 200}
+	serverConfig.Tarpit.Max_Delay = 1000
+	srv, closed, addr := startTestServer(t, serverConfig)
+	defer srv.Shutdown(context.Background())
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "HELO client.test", "250 ")
+	sendCommand(t, conn, "MAIL FROM:<from@example.com>", "250 ")
+	sendCommand(t, conn, "RCPT TO:<to@example.com>", "250 ")
+	start := time.Now()
+	sendCommand(t, conn, "DATA", "354 ")
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("354 reply wasn't delayed: %v", d)
+	}
+	// end of data has own delay
+	start = time.Now()
+	sendCommand(t, conn, "Subject: test\r\n\r\nbody\r\n.", "250 ")
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("reply after data was delayed: %v", d)
+	}
+	<-closed
+}
+
+func TestTarpitShutdown(t *testing.T) {
+	serverConfig := newTestConfig()
+	serverConfig.Tarpit.Enabled = true
+	serverConfig.Tarpit.Command_Delays = map[string]int{"noop": 60000}
+	serverConfig.Tarpit.Max_Delay = 60000
+	srv, _, addr := startTestServer(t, serverConfig)
+	conn := dialTestServer(t, addr)
+	defer conn.Close()
+
+	// delay is limited by WriteTimeout and ends on shutdown
+	start := time.Now()
+	if err := conn.PrintfLine("NOOP"); err != nil {
+		t.Fatalf("Send NOOP: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	expectReply(t, conn, "250 ")
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("shutdown waited for delay: %v", d)
+	}
+}
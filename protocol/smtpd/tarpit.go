@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	TARPIT_GREETING    = "connect"     // key of greeting in command delays
+	TARPIT_END_OF_DATA = "end_of_data" // key of replies after DATA
+)
+
+// delay of reply: configured delay of command and tarpit of session,
+// which grows with every protocol error (500-504) and failed AUTH.
+// Only first reply of command is delayed, e.g. 354 of DATA or first
+// LMTP reply after data. Delay is limited by max delay and WriteTimeout.
+
+func (s *session) replyDelay(reply string) time.Duration {
+	tarpit := &s.srv.ServerConfig.Tarpit
+	if !tarpit.Enabled {
+		return 0
+	}
+	switch {
+	case strings.HasPrefix(reply, "535"):
+		s.tarpitDelay += time.Duration(tarpit.Auth_Error_Delay) * time.Millisecond
+	case isProtocolError(reply):
+		s.tarpitDelay += time.Duration(tarpit.Error_Delay) * time.Millisecond
+	}
+	if s.delayed {
+		return 0
+	}
+	s.delayed = true
+	command := strings.ToLower(s.command)
+	if command == "" {
+		command = TARPIT_GREETING
+	}
+	delay := time.Duration(tarpit.Command_Delays[command])*time.Millisecond + s.tarpitDelay
+	if maxDelay := time.Duration(tarpit.Max_Delay) * time.Millisecond; maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	if s.srv.WriteTimeout > 0 && delay > s.srv.WriteTimeout {
+		delay = s.srv.WriteTimeout
+	}
+	return delay
+}
+
+// sleep, which ends on server shutdown
+
+func (s *session) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.srv.shutdownChan():
+	}
+}
+
+// syntax and sequence errors: 500, 501, 502, 503, 504
+
+func isProtocolError(reply string) bool {
+	return len(reply) > 3 && reply[0] == '5' && reply[1] == '0' && reply[2] >= '0' && reply[2] <= '4'
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+)
+
+// Trace describes how email was received, storage prepends Received
+// header (RFC 5321 s4.4) with it
+type Trace struct {
+	Helo          string
+	ClientIP      string
+	ClientName    string // client hostname, forwarded by XCLIENT
+	ServerName    string
+	Protocol      string // WITH protocol type (RFC 3848, RFC 6531)
+	TLSVersion    string // empty without TLS
+	TLSCipher     string
+	AuthMailboxID int // inbox of AUTH, 0 if not authenticated
+	QueueID       string
+	ReceivedAt    time.Time
+}
+
+// trace of current session, called when email data begins
+
+func (s *session) trace() *Trace {
+	t := &Trace{
+		Helo:          s.helloHost,
+		ClientName:    s.xclient.name,
+		ServerName:    s.srv.hostname(),
+		AuthMailboxID: s.authMailboxId,
+		QueueID:       newQueueID(),
+		ReceivedAt:    time.Now(),
+	}
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		t.ClientIP = tcpAddr.IP.String()
+	}
+	if tlsConn, ok := s.rwc.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		t.TLSVersion = tls.VersionName(state.Version)
+		t.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	// protocol: SMTP, ESMTP, LMTP with UTF8 prefix and S, A suffixes
+	protocol := "SMTP"
+	switch {
+	case s.srv.Lmtp:
+		protocol = "LMTP"
+	case s.xclient.proto != "":
+		protocol = s.xclient.proto
+	case strings.EqualFold(s.helloType, "EHLO"):
+		protocol = "ESMTP"
+	}
+	if s.smtpUtf8 {
+		protocol = "UTF8" + strings.TrimPrefix(protocol, "E")
+	}
+	if t.TLSVersion != "" {
+		protocol += "S"
+	}
+	if s.authMailboxId > 0 {
+		protocol += "A"
+	}
+	t.Protocol = protocol
+	return t
+}
+
+func newQueueID() string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return strings.ToUpper(hex.EncodeToString(random))
+}
@@ -0,0 +1,223 @@
+package smtpd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+// XCLIENT (Postfix compatible), proxy forwards client attributes.
+// See http://www.postfix.org/XCLIENT_README.html
+
+const (
+	XCLIENT_ATTRIBUTES = "NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT"
+
+	xclientUnavailable = "[UNAVAILABLE]"
+	xclientTempUnavail = "[TEMPUNAVAIL]"
+)
+
+// client attributes forwarded by XCLIENT
+
+type xclientAttrs struct {
+	name     string   // client hostname
+	addr     net.Addr // client address
+	proto    string   // SMTP or ESMTP
+	helo     string   // client HELO
+	destAddr net.Addr // server address, client connected to
+}
+
+// XCLIENT is allowed only for trusted proxies. Original peer is checked,
+// not address forwarded by previous XCLIENT
+
+func (s *session) isXclientAllowed() bool {
+	if !s.srv.ServerConfig.Proxy.Enabled && !s.srv.ServerConfig.Proxy.Proxy_Mode {
+		return false
+	}
+	tcpAddr, ok := s.rwc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range s.srv.ServerConfig.XclientNetworks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle XCLIENT
+
+func (s *session) handleXclient(line string) {
+	if !s.isXclientAllowed() {
+		s.sendlinef("550 5.7.0 Error: insufficient authorization")
+		return
+	}
+	if s.env != nil {
+		s.sendlinef("503 5.5.1 Error: MAIL transaction in progress")
+		return
+	}
+	attrs := strings.Fields(line)
+	if len(attrs) == 0 {
+		s.sendlinef("501 5.5.4 Syntax: XCLIENT attribute=value [attribute=value ...]")
+		return
+	}
+	// parse all attributes first, nothing is changed on error
+	forwarded := s.xclient
+	login, hasLogin := "", false
+	for _, attr := range attrs {
+		i := strings.IndexByte(attr, '=')
+		if i <= 0 {
+			s.sendlinef("501 5.5.4 Error: bad XCLIENT attribute %q", attr)
+			return
+		}
+		name := strings.ToUpper(attr[:i])
+		value, ok := xtextDecode(attr[i+1:])
+		if !ok {
+			s.sendlinef("501 5.5.4 Error: bad %s syntax", name)
+			return
+		}
+		unavailable := value == xclientUnavailable || value == xclientTempUnavail
+		switch name {
+		case "NAME":
+			forwarded.name = ""
+			if !unavailable {
+				forwarded.name = value
+			}
+		case "ADDR":
+			port := xclientPort(forwarded.addr)
+			forwarded.addr = nil
+			if !unavailable {
+				ip := parseXclientIP(value)
+				if ip == nil {
+					s.sendlinef("501 5.5.4 Error: bad ADDR syntax")
+					return
+				}
+				forwarded.addr = &net.TCPAddr{IP: ip, Port: port}
+			}
+		case "PORT":
+			if !unavailable {
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 0 || port > 65535 {
+					s.sendlinef("501 5.5.4 Error: bad PORT syntax")
+					return
+				}
+				forwarded.addr = withXclientPort(forwarded.addr, s.rwc.RemoteAddr(), port)
+			}
+		case "PROTO":
+			forwarded.proto = ""
+			if !unavailable {
+				value = strings.ToUpper(value)
+				if value != "SMTP" && value != "ESMTP" {
+					s.sendlinef("501 5.5.4 Error: bad PROTO syntax")
+					return
+				}
+				forwarded.proto = value
+			}
+		case "HELO":
+			forwarded.helo = ""
+			if !unavailable {
+				forwarded.helo = value
+			}
+		case "LOGIN":
+			login, hasLogin = value, true
+			if unavailable {
+				login = ""
+			}
+		case "DESTADDR":
+			port := xclientPort(forwarded.destAddr)
+			forwarded.destAddr = nil
+			if !unavailable {
+				ip := parseXclientIP(value)
+				if ip == nil {
+					s.sendlinef("501 5.5.4 Error: bad DESTADDR syntax")
+					return
+				}
+				forwarded.destAddr = &net.TCPAddr{IP: ip, Port: port}
+			}
+		case "DESTPORT":
+			if !unavailable {
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 0 || port > 65535 {
+					s.sendlinef("501 5.5.4 Error: bad DESTPORT syntax")
+					return
+				}
+				forwarded.destAddr = withXclientPort(forwarded.destAddr, s.rwc.LocalAddr(), port)
+			}
+		default:
+			s.sendlinef("501 5.5.4 Error: bad XCLIENT attribute name: %s", name)
+			return
+		}
+	}
+	mailboxId := 0
+	if hasLogin && login != "" && s.srv.ServerConfig.Adapter.Auth {
+		// nginx sends inbox id as login
+		id, err := strconv.Atoi(login)
+		if err != nil || id <= 0 {
+			s.sendlinef("535 5.7.1 authentication failed")
+			return
+		}
+		mailboxId = id
+	}
+
+	// session starts again with forwarded attributes
+	s.resetEnvelope()
+	s.clearAuthData()
+	s.xclient = forwarded
+	s.helloType, s.helloHost = "", forwarded.helo
+	s.spfHelo = nil
+	if !hasLogin {
+		// session keeps inbox of previous login
+		mailboxId = s.authMailboxId
+	}
+	if hasLogin || mailboxId > 0 {
+		s.authMailboxId, s.mailboxId = 0, 0
+	}
+	log.Debugf("XCLIENT: client %v (%s), helo %q", s.Addr(), forwarded.name, forwarded.helo)
+	// inbox, which refuses session, doesn't authenticate it
+	if s.injectFault(FAULT_STAGE_CONNECT, mailboxId) {
+		return
+	}
+	if mailboxId > 0 {
+		s.setAuthMailboxId(mailboxId)
+	}
+	s.sendlinef("220 %s %s", s.srv.ServerConfig.Adapter.Welcome_Msg, s.srv.hostname())
+}
+
+// address is IPv4 or "IPV6:" with IPv6 address
+
+func parseXclientIP(value string) net.IP {
+	if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+		ip := net.ParseIP(value[5:])
+		if ip == nil || ip.To4() != nil {
+			return nil
+		}
+		return ip
+	}
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil {
+		return nil
+	}
+	return ip
+}
+
+func xclientPort(addr net.Addr) int {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.Port
+	}
+	return 0
+}
+
+// set port of forwarded address, connection address is used if ADDR is not forwarded
+
+func withXclientPort(addr, connAddr net.Addr, port int) net.Addr {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		tcpAddr, ok = connAddr.(*net.TCPAddr)
+		if !ok {
+			return addr
+		}
+	}
+	return &net.TCPAddr{IP: tcpAddr.IP, Port: port, Zone: tcpAddr.Zone}
+}
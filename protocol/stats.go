@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/worker"
+)
+
+// queue stats for operators. Worker lag is time the last stored email
+// waited in queue, or time since last email was taken, if queue is
+// stuck.
+
+type queueStats struct {
+	QueueDepth     int     `json:"queue_depth"`
+	QueueSize      int     `json:"queue_size"`
+	QueueHighWater int     `json:"queue_high_water"`
+	SpoolDepth     int     `json:"spool_depth"`
+	SpoolHighWater int     `json:"spool_high_water"`
+	Workers        int     `json:"workers"`
+	BusyWorkers    int     `json:"busy_workers"`
+	WorkerLag      float64 `json:"worker_lag"` // seconds
+	Stored         int64   `json:"stored"`
+	Failed         int64   `json:"failed"`
+}
+
+func getQueueStats(config *config.Config) queueStats {
+	workerStats := worker.GetStats()
+	stats := queueStats{
+		QueueDepth:     len(SaveMailChan),
+		QueueSize:      cap(SaveMailChan),
+		QueueHighWater: config.Backpressure.Queue_High_Water,
+		SpoolHighWater: config.Backpressure.Spool_High_Water,
+		Workers:        config.Adapter.Workers_Size,
+		BusyWorkers:    workerStats.Busy,
+		Stored:         workerStats.Stored,
+		Failed:         workerStats.Failed,
+	}
+	if MailSpool != nil {
+		stats.SpoolDepth = MailSpool.Pending()
+	}
+	lag := workerStats.LastWait
+	if stats.QueueDepth > 0 {
+		if stuck := time.Since(workerStats.LastDequeue); stuck > lag {
+			lag = stuck
+		}
+	}
+	stats.WorkerLag = lag.Seconds()
+	return stats
+}
+
+// stats http server
+
+func serveStats(config *config.Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getQueueStats(config))
+	})
+	serverBind := fmt.Sprintf("%s:%d", config.Stats.Host, config.Stats.Port)
+	log.Debugf("Stats working on %s", serverBind)
+	if err := http.ListenAndServe(serverBind, mux); err != nil {
+		log.Errorf("Stats server: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MEMORY_SWEEP_INTERVAL = time.Minute
+)
+
+// MemoryLimiter keeps sliding window of every limit in process. Window
+// counts messages of current and previous fixed window, previous one is
+// weighted by its part, which is still in sliding window.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+type window struct {
+	length   time.Duration
+	start    time.Time // start of current fixed window
+	previous int       // messages of previous fixed window
+	current  int       // messages of current fixed window
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{windows: make(map[string]*window), lastSweep: time.Now()}
+}
+
+func (l *MemoryLimiter) Allow(limits []Limit) (*Limit, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	var (
+		rejected *Limit
+		retry    time.Duration
+	)
+	windows := make([]*window, len(limits))
+	for i := range limits {
+		w := l.window(&limits[i], now)
+		windows[i] = w
+		if wait := w.wait(now, limits[i].Capacity); wait > 0 {
+			if rejected == nil || wait > retry {
+				rejected, retry = &limits[i], wait
+			}
+		}
+	}
+	if rejected != nil {
+		return rejected, retry, nil
+	}
+	// message is counted only if all limits allow it
+	for _, w := range windows {
+		w.current++
+	}
+	return nil, 0, nil
+}
+
+// window of limit, moved to now
+
+func (l *MemoryLimiter) window(limit *Limit, now time.Time) *window {
+	w, ok := l.windows[limit.Key]
+	if !ok || w.length != limit.Window {
+		w = &window{length: limit.Window}
+		l.windows[limit.Key] = w
+	}
+	w.advance(now)
+	return w
+}
+
+func (w *window) advance(now time.Time) {
+	start := now.Truncate(w.length)
+	switch start.Sub(w.start) {
+	case 0:
+		return
+	case w.length:
+		w.previous, w.current = w.current, 0
+	default:
+		w.previous, w.current = 0, 0
+	}
+	w.start = start
+}
+
+// time until one more message fits in capacity, 0 if it fits now
+
+func (w *window) wait(now time.Time, capacity int) time.Duration {
+	length := float64(w.length)
+	elapsed := float64(now.Sub(w.start))
+	free := float64(capacity - 1)
+	previous, current := float64(w.previous), float64(w.current)
+	if previous*(1-elapsed/length)+current <= free {
+		return 0
+	}
+	var wait float64
+	if current <= free {
+		// previous window slides out
+		wait = length*(1-(free-current)/previous) - elapsed
+	} else {
+		// current window slides out during next one
+		wait = length - elapsed + length*(1-free/current)
+	}
+	if wait < 1 {
+		wait = 1
+	}
+	return time.Duration(wait)
+}
+
+// remove windows without messages in sliding window, they are same as
+// new ones
+
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < MEMORY_SWEEP_INTERVAL {
+		return
+	}
+	l.lastSweep = now
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= 2*w.length {
+			delete(l.windows, key)
+		}
+	}
+}
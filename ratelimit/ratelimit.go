@@ -0,0 +1,126 @@
+// Package ratelimit describes rate limit policies of smtpd. Every
+// policy is sliding window of inbox, client network, envelope sender or
+// authenticated user.
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	SCOPE_INBOX  = "inbox"
+	SCOPE_IP     = "ip"
+	SCOPE_SENDER = "sender"
+	SCOPE_USER   = "user"
+
+	DEFAULT_IPV4_PREFIX = 32
+	DEFAULT_IPV6_PREFIX = 64
+)
+
+var (
+	Windows = map[string]time.Duration{
+		"second": time.Second,
+		"minute": time.Minute,
+		"hour":   time.Hour,
+	}
+)
+
+// Policy from config. Limit 0 of inbox scope is rate limit of inbox
+// settings. Sliding window of last window length accepts limit and
+// burst messages, so burst is extra messages tolerated in window.
+type Policy struct {
+	Scope   string
+	Window  string
+	Limit   int
+	Burst   int
+	Prefix  int // ip scope: IPv4 network bits
+	Prefix6 int // ip scope: IPv6 network bits
+}
+
+// Subject of message, empty values skip their policies
+type Subject struct {
+	MailboxID      int
+	InboxRateLimit int
+	IP             net.IP
+	Sender         string
+	AuthMailboxID  int
+}
+
+// Limit is policy applied to subject
+type Limit struct {
+	Scope    string
+	Key      string
+	Window   time.Duration
+	Limit    int // messages per window
+	Capacity int // limit and burst, messages accepted in sliding window
+}
+
+// Limiter counts message for all limits, if neither is exceeded.
+// Otherwise it returns exceeded limit and time until message fits.
+type Limiter interface {
+	Allow(limits []Limit) (*Limit, time.Duration, error)
+}
+
+// Limits of subject
+
+func Limits(policies []Policy, subject Subject) []Limit {
+	limits := []Limit{}
+	for _, policy := range policies {
+		window, ok := Windows[policy.Window]
+		if !ok {
+			continue
+		}
+		value, limit := "", policy.Limit
+		switch policy.Scope {
+		case SCOPE_INBOX:
+			if subject.MailboxID > 0 {
+				value = fmt.Sprintf("%d", subject.MailboxID)
+			}
+			if limit == 0 {
+				limit = subject.InboxRateLimit
+			}
+		case SCOPE_IP:
+			value = Network(subject.IP, policy.Prefix, policy.Prefix6)
+		case SCOPE_SENDER:
+			value = strings.ToLower(subject.Sender)
+		case SCOPE_USER:
+			if subject.AuthMailboxID > 0 {
+				value = fmt.Sprintf("%d", subject.AuthMailboxID)
+			}
+		}
+		if value == "" || limit <= 0 {
+			continue
+		}
+		limits = append(limits, Limit{
+			Scope:    policy.Scope,
+			Key:      fmt.Sprintf("rate-windows_%s_%s_%s", policy.Scope, policy.Window, value),
+			Window:   window,
+			Limit:    limit,
+			Capacity: limit + policy.Burst,
+		})
+	}
+	return limits
+}
+
+// Network of ip in CIDR notation, empty for nil ip
+
+func Network(ip net.IP, prefix, prefix6 int) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if prefix <= 0 || prefix > 32 {
+			prefix = DEFAULT_IPV4_PREFIX
+		}
+		mask := net.CIDRMask(prefix, 32)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+	if prefix6 <= 0 || prefix6 > 128 {
+		prefix6 = DEFAULT_IPV6_PREFIX
+	}
+	mask := net.CIDRMask(prefix6, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
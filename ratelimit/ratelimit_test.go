@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		ip              string
+		prefix, prefix6 int
+		network         string
+	}{
+		{"192.0.2.77", 0, 0, "192.0.2.77/32"},
+		{"192.0.2.77", 24, 0, "192.0.2.0/24"},
+		{"::ffff:192.0.2.77", 16, 0, "192.0.0.0/16"},
+		{"2001:db8:1:2:3:4:5:6", 24, 0, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6", 0, 48, "2001:db8:1::/48"},
+	}
+	for _, test := range tests {
+		if network := Network(net.ParseIP(test.ip), test.prefix, test.prefix6); network != test.network {
+			t.Errorf("%s/%d/%d: expected %s, got %s", test.ip, test.prefix, test.prefix6, test.network, network)
+		}
+	}
+	if network := Network(nil, 24, 64); network != "" {
+		t.Errorf("expected empty network, got %s", network)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	policies := []Policy{
+		{Scope: SCOPE_INBOX, Window: "second"},
+		{Scope: SCOPE_IP, Window: "minute", Limit: 100, Burst: 20, Prefix: 24},
+		{Scope: SCOPE_SENDER, Window: "hour", Limit: 1000},
+		{Scope: SCOPE_USER, Window: "hour", Limit: 500},
+	}
+	subject := Subject{MailboxID: 7, InboxRateLimit: 5, IP: net.ParseIP("192.0.2.77"), Sender: "From@Example.com"}
+	expected := []Limit{
+		{Scope: SCOPE_INBOX, Key: "rate-windows_inbox_second_7", Window: time.Second, Limit: 5, Capacity: 5},
+		{Scope: SCOPE_IP, Key: "rate-windows_ip_minute_192.0.2.0/24", Window: time.Minute, Limit: 100, Capacity: 120},
+		{Scope: SCOPE_SENDER, Key: "rate-windows_sender_hour_from@example.com", Window: time.Hour, Limit: 1000, Capacity: 1000},
+	}
+	if limits := Limits(policies, subject); !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected %+v, got %+v", expected, limits)
+	}
+	// null sender and unknown inbox rate limit are skipped, user is authenticated
+	subject = Subject{MailboxID: 7, AuthMailboxID: 7}
+	expected = []Limit{
+		{Scope: SCOPE_USER, Key: "rate-windows_user_hour_7", Window: time.Hour, Limit: 500, Capacity: 500},
+	}
+	if limits := Limits(policies, subject); !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected %+v, got %+v", expected, limits)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter()
+	limits := []Limit{
+		{Scope: SCOPE_INBOX, Key: "inbox", Window: time.Minute, Limit: 2, Capacity: 3},
+		{Scope: SCOPE_IP, Key: "ip", Window: time.Hour, Limit: 10, Capacity: 10},
+	}
+	for i := 0; i < 3; i++ {
+		if limit, _, _ := l.Allow(limits); limit != nil {
+			t.Fatalf("message %d rejected by %s", i, limit.Scope)
+		}
+	}
+	limit, retry, err := l.Allow(limits)
+	if err != nil || limit == nil || limit.Scope != SCOPE_INBOX {
+		t.Fatalf("inbox limit not exceeded: %v %v", limit, err)
+	}
+	if retry <= 0 || retry > 2*time.Minute {
+		t.Errorf("retry = %v", retry)
+	}
+	// rejected message isn't counted by ip limit
+	if current := l.windows["ip"].current; current != 3 {
+		t.Errorf("ip messages = %d", current)
+	}
+}
+
+func TestWindowWait(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+	tests := []struct {
+		previous, current int
+		elapsed           time.Duration
+		wait              time.Duration
+	}{
+		{0, 2, 0, 0},
+		{0, 3, 10 * time.Second, 70 * time.Second},
+		{3, 0, 0, 20 * time.Second},
+		{4, 1, 30 * time.Second, 15 * time.Second},
+		{4, 1, 45 * time.Second, 0},
+		{6, 6, 30 * time.Second, 70 * time.Second},
+	}
+	for _, test := range tests {
+		w := &window{length: time.Minute, start: start, previous: test.previous, current: test.current}
+		if wait := w.wait(start.Add(test.elapsed), 3); wait != test.wait {
+			t.Errorf("%d/%d after %v: expected wait %v, got %v", test.previous, test.current, test.elapsed, test.wait, wait)
+		}
+	}
+	// previous window slides out
+	w := &window{length: time.Minute, start: start, previous: 1, current: 3}
+	w.advance(start.Add(time.Minute + time.Second))
+	if w.previous != 3 || w.current != 0 || !w.start.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected window after minute: %+v", w)
+	}
+	w.advance(start.Add(5 * time.Minute))
+	if w.previous != 0 || w.current != 0 {
+		t.Errorf("unexpected window after 5 minutes: %+v", w)
+	}
+}
@@ -0,0 +1,52 @@
+package redisworker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+// DnsblCache keeps block list answers in redis, "" is stored for
+// names which are not listed
+
+type DnsblCache struct {
+	Config *config.Config
+}
+
+func getRedisDnsblKey(query string) string {
+	return fmt.Sprintf("dnsbl-cache_%s", query)
+}
+
+// get cached answer
+
+func (c *DnsblCache) Get(query string) ([]string, bool) {
+	redisCon := c.Config.RedisPool.Get()
+	defer redisCon.Close()
+
+	value, err := redis.String(redisCon.Do("GET", getRedisDnsblKey(query)))
+	if err != nil {
+		if err != redis.ErrNil {
+			log.Errorf("DNSBL cache GET error: %v", err)
+		}
+		return nil, false
+	}
+	if value == "" {
+		return []string{}, true
+	}
+	return strings.Split(value, ","), true
+}
+
+// store answer
+
+func (c *DnsblCache) Set(query string, codes []string) {
+	redisCon := c.Config.RedisPool.Get()
+	defer redisCon.Close()
+
+	_, err := redisCon.Do("SETEX", getRedisDnsblKey(query), c.Config.Dnsbl.Cache_Ttl, strings.Join(codes, ","))
+	if err != nil {
+		log.Errorf("DNSBL cache SETEX error: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package redisworker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/garyburd/redigo/redis"
+)
+
+func getRedisCacheFaultsKey(mailboxID int) string {
+	return fmt.Sprintf("inboxes-faults-cache_%d", mailboxID)
+}
+
+// get cached fault rules of inbox
+
+func GetCachedInboxFaults(config *config.Config, mailboxID int) ([]storage.FaultRule, error) {
+	var rules []storage.FaultRule
+
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	cacheData, err := redis.Bytes(redisCon.Do("GET", getRedisCacheFaultsKey(mailboxID)))
+	if err == nil {
+		err = json.Unmarshal(cacheData, &rules)
+	}
+	return rules, err
+}
+
+// store cache fault rules of inbox, empty rules are cached too
+
+func StoreCachedInboxFaults(config *config.Config, mailboxID int, rules []storage.FaultRule) {
+	cacheData, err := json.Marshal(rules)
+	if err != nil {
+		log.Errorf("StoreCachedInboxFaults: %v", err)
+		return
+	}
+
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Do("SETEX", getRedisCacheFaultsKey(mailboxID), INBOX_SETTINGS_TTL, cacheData)
+}
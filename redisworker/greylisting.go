@@ -0,0 +1,54 @@
+package redisworker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	GREYLIST_PASSED = "passed"
+)
+
+func getRedisGreylistKey(triplet string) string {
+	return fmt.Sprintf("greylist_%s", triplet)
+}
+
+// CheckGreylist returns seconds until triplet is accepted, 0 if it is
+// accepted now. First attempt stores its time, retry after delay
+// whitelists triplet.
+
+func CheckGreylist(config *config.Config, triplet string) (int, error) {
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisKey := getRedisGreylistKey(triplet)
+	now := time.Now().Unix()
+	// unseen triplet
+	_, err := redis.String(redisCon.Do("SET", redisKey, now, "EX", config.Greylisting.Retry_Window, "NX"))
+	if err == nil {
+		return config.Greylisting.Delay, nil
+	}
+	if err != redis.ErrNil {
+		return 0, err
+	}
+	value, err := redis.String(redisCon.Do("GET", redisKey))
+	if err != nil {
+		return 0, err
+	}
+	if value != GREYLIST_PASSED {
+		firstSeen, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if wait := firstSeen + int64(config.Greylisting.Delay) - now; wait > 0 {
+			return int(wait), nil
+		}
+	}
+	// retry after delay, whitelist is extended by every email
+	_, err = redisCon.Do("SET", redisKey, GREYLIST_PASSED, "EX", config.Greylisting.Whitelist_Ttl)
+	return 0, err
+}
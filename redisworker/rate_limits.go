@@ -0,0 +1,94 @@
+package redisworker
+
+import (
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/ratelimit"
+	"github.com/garyburd/redigo/redis"
+)
+
+// sliding window of every limit in hash, like ratelimit.MemoryLimiter:
+// messages of current fixed window and weighted part of previous one
+// are counted, limit and burst messages fit in window. Message is
+// counted in all limits only if neither is exceeded, so check is atomic.
+// KEYS - limits, ARGV - now (ms), then window (ms) and capacity of every
+// limit. Returns index of exceeded limit (0 if allowed) and milliseconds
+// until message fits.
+
+var rateLimitScript = redis.NewScript(-1, `
+local now = tonumber(ARGV[1])
+local rejected, retry = 0, 0
+local starts, previous, current = {}, {}, {}
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[2 * i])
+	local free = tonumber(ARGV[2 * i + 1]) - 1
+	local start = now - now % window
+	local state = redis.call("HMGET", key, "start", "previous", "current")
+	local prev, cur = 0, 0
+	if state[1] then
+		local last = tonumber(state[1])
+		if last == start then
+			prev, cur = tonumber(state[2]), tonumber(state[3])
+		elseif last + window == start then
+			prev = tonumber(state[3])
+		end
+	end
+	starts[i], previous[i], current[i] = start, prev, cur
+	local elapsed = now - start
+	if prev * (1 - elapsed / window) + cur > free then
+		local wait
+		if cur <= free then
+			-- previous window slides out
+			wait = window * (1 - (free - cur) / prev) - elapsed
+		else
+			-- current window slides out during next one
+			wait = window - elapsed + window * (1 - free / cur)
+		end
+		wait = math.max(1, math.ceil(wait))
+		if wait > retry or rejected == 0 then
+			rejected, retry = i, wait
+		end
+	end
+end
+if rejected == 0 then
+	for i, key in ipairs(KEYS) do
+		local window = tonumber(ARGV[2 * i])
+		redis.call("HMSET", key, "start", starts[i], "previous", previous[i], "current", current[i] + 1)
+		-- counters are needed until current window slides out
+		redis.call("PEXPIRE", key, 2 * window - (now - starts[i]))
+	end
+end
+return {rejected, retry}
+`)
+
+type RateLimiter struct {
+	Config *config.Config
+}
+
+func (l *RateLimiter) Allow(limits []ratelimit.Limit) (*ratelimit.Limit, time.Duration, error) {
+	if len(limits) == 0 {
+		return nil, 0, nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	args := redis.Args{}
+	for _, limit := range limits {
+		args = args.Add(limit.Key)
+	}
+	args = args.Add(now)
+	for _, limit := range limits {
+		args = args.Add(int64(limit.Window/time.Millisecond), limit.Capacity)
+	}
+
+	redisCon := l.Config.RedisPool.Get()
+	defer redisCon.Close()
+
+	result, err := redis.Int64s(rateLimitScript.Do(redisCon, append(redis.Args{len(limits)}, args...)...))
+	if err != nil || len(result) != 2 {
+		return nil, 0, err
+	}
+	if result[0] == 0 {
+		return nil, 0, nil
+	}
+	return &limits[result[0]-1], time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -2,11 +2,12 @@ package redisworker
 
 import (
 	"fmt"
-	"github.com/garyburd/redigo/redis"
+	"github.com/Polymail/go-falcon/cache"
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/storage"
 	"github.com/Polymail/go-falcon/utils"
+	"github.com/garyburd/redigo/redis"
 	"strconv"
 	"time"
 )
@@ -15,9 +16,7 @@ const (
 	REDIS_KEY_TTL        = 60
 	REDIS_KEY_MAX_COUNT  = 15
 	NOTIFICATION_TIMEOUT = 30
-	MAX_TTL_FOR_SPAM     = 20
-	MAX_EMAILS_FOR_SPAM  = 10
-	INBOX_SETTINGS_TTL   = 14400 // 4 hours
+	INBOX_SETTINGS_TTL   = cache.INBOX_SETTINGS_TTL // 4 hours
 )
 
 // get cached inbox setting
@@ -136,7 +135,7 @@ func IsNotSpamAttackCampaign(config *config.Config, mailboxID int) bool {
 	emailsKeyCount, err := redis.Int(redisCon.Do("INCR", redisKey))
 	if err == nil {
 		if emailsKeyCount > 1 {
-			_, err = redisCon.Do("EXPIRE", redisKey, MAX_TTL_FOR_SPAM) // expire 5 min
+			_, err = redisCon.Do("EXPIRE", redisKey, cache.CAMPAIGN_TTL)
 			if err != nil {
 				log.Errorf("CheckIfSendingCampaign EXPIRE error: %v", err)
 			}
@@ -145,5 +144,5 @@ func IsNotSpamAttackCampaign(config *config.Config, mailboxID int) bool {
 		log.Errorf("CheckIfSendingCampaign INCR error: %v", err)
 	}
 
-	return (emailsKeyCount < MAX_EMAILS_FOR_SPAM)
+	return (emailsKeyCount < cache.CAMPAIGN_MAX_EMAILS)
 }
@@ -0,0 +1,56 @@
+package redisworker
+
+import (
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// UseRedisStores replaces in-memory stores of config, so they are
+// shared by all falcon nodes
+
+func UseRedisStores(config *config.Config) {
+	config.SettingsCache = &SettingsCache{Config: config}
+	config.FaultsCache = &FaultsCache{Config: config}
+	config.CampaignCounter = &CampaignCounter{Config: config}
+	config.RateLimiter = &RateLimiter{Config: config}
+}
+
+// inbox settings in redis hashes
+
+type SettingsCache struct {
+	Config *config.Config
+}
+
+func (c *SettingsCache) GetInboxSettings(mailboxID int) (storage.InboxSettings, bool) {
+	inboxSettings, err := GetCachedInboxSettings(c.Config, mailboxID)
+	return inboxSettings, err == nil
+}
+
+func (c *SettingsCache) StoreInboxSettings(mailboxID int, inboxSettings storage.InboxSettings) {
+	StoreCachedInboxSettings(c.Config, mailboxID, inboxSettings)
+}
+
+// fault rules of inboxes in redis
+
+type FaultsCache struct {
+	Config *config.Config
+}
+
+func (c *FaultsCache) GetInboxFaults(mailboxID int) ([]storage.FaultRule, bool) {
+	rules, err := GetCachedInboxFaults(c.Config, mailboxID)
+	return rules, err == nil
+}
+
+func (c *FaultsCache) StoreInboxFaults(mailboxID int, rules []storage.FaultRule) {
+	StoreCachedInboxFaults(c.Config, mailboxID, rules)
+}
+
+// campaign counter in redis
+
+type CampaignCounter struct {
+	Config *config.Config
+}
+
+func (c *CampaignCounter) IsNotSpamAttackCampaign(mailboxID int) bool {
+	return IsNotSpamAttackCampaign(c.Config, mailboxID)
+}
@@ -0,0 +1,90 @@
+// Package resolver provides DNS lookups for sender authentication
+// (SPF, DKIM, DMARC) and block lists. Resolver is an interface, so
+// tests use in-memory Zone instead of real DNS.
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+// Resolver does DNS lookups. Missing name or record is reported by
+// error, for which IsNotFound returns true.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(network, host string) ([]net.IP, error) // network is "ip4" or "ip6"
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error) // PTR names of IP address
+}
+
+// IsNotFound returns true if name or record doesn't exist (NXDOMAIN or
+// empty answer), any other error is temporary
+
+func IsNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// DNSResolver uses system resolver or DNS server from config
+type DNSResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+}
+
+// NewDNSResolver returns resolver for server ("host:port"), system
+// resolver is used if server is empty. Timeout is for one lookup.
+
+func NewDNSResolver(server string, timeout time.Duration) *DNSResolver {
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	r := &DNSResolver{resolver: net.DefaultResolver, timeout: timeout}
+	if server != "" {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: timeout}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+func (r *DNSResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func (r *DNSResolver) LookupIP(network, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.resolver.LookupIP(ctx, network, host)
+}
+
+func (r *DNSResolver) LookupMX(name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.resolver.LookupMX(ctx, name)
+}
+
+func (r *DNSResolver) LookupAddr(addr string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+// canonical name: lowercase, without trailing dot
+
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
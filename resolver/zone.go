@@ -0,0 +1,144 @@
+package resolver
+
+import (
+	"net"
+	"sync"
+)
+
+// Zone is in-memory Resolver for tests. Names are case insensitive,
+// trailing dot is optional.
+type Zone struct {
+	mu   sync.RWMutex
+	txt  map[string][]string
+	ip   map[string][]net.IP
+	mx   map[string][]*net.MX
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func NewZone() *Zone {
+	return &Zone{
+		txt:  make(map[string][]string),
+		ip:   make(map[string][]net.IP),
+		mx:   make(map[string][]*net.MX),
+		ptr:  make(map[string][]string),
+		fail: make(map[string]bool),
+	}
+}
+
+// AddTXT adds TXT records, each value is one record
+
+func (z *Zone) AddTXT(name string, values ...string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = canonicalName(name)
+	z.txt[name] = append(z.txt[name], values...)
+}
+
+// AddIP adds A or AAAA records, PTR records are not added
+
+func (z *Zone) AddIP(name string, addrs ...string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = canonicalName(name)
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			z.ip[name] = append(z.ip[name], ip)
+		}
+	}
+}
+
+func (z *Zone) AddMX(name string, pref uint16, host string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = canonicalName(name)
+	z.mx[name] = append(z.mx[name], &net.MX{Host: host, Pref: pref})
+}
+
+// AddPTR adds PTR records for IP address
+
+func (z *Zone) AddPTR(addr string, names ...string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if ip := net.ParseIP(addr); ip != nil {
+		z.ptr[ip.String()] = append(z.ptr[ip.String()], names...)
+	}
+}
+
+// AddFailure makes all lookups of name fail with temporary error
+
+func (z *Zone) AddFailure(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.fail[canonicalName(name)] = true
+}
+
+func (z *Zone) LookupTXT(name string) ([]string, error) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	name = canonicalName(name)
+	if z.fail[name] {
+		return nil, tempError(name)
+	}
+	if len(z.txt[name]) == 0 {
+		return nil, notFoundError(name)
+	}
+	return append([]string{}, z.txt[name]...), nil
+}
+
+func (z *Zone) LookupIP(network, host string) ([]net.IP, error) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	host = canonicalName(host)
+	if z.fail[host] {
+		return nil, tempError(host)
+	}
+	var ips []net.IP
+	for _, ip := range z.ip[host] {
+		isV4 := ip.To4() != nil
+		if network == "ip" || (network == "ip4") == isV4 {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, notFoundError(host)
+	}
+	return ips, nil
+}
+
+func (z *Zone) LookupMX(name string) ([]*net.MX, error) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	name = canonicalName(name)
+	if z.fail[name] {
+		return nil, tempError(name)
+	}
+	if len(z.mx[name]) == 0 {
+		return nil, notFoundError(name)
+	}
+	return append([]*net.MX{}, z.mx[name]...), nil
+}
+
+func (z *Zone) LookupAddr(addr string) ([]string, error) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	if z.fail[ip.String()] {
+		return nil, tempError(addr)
+	}
+	if len(z.ptr[ip.String()]) == 0 {
+		return nil, notFoundError(addr)
+	}
+	return append([]string{}, z.ptr[ip.String()]...), nil
+}
+
+func notFoundError(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func tempError(name string) error {
+	return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
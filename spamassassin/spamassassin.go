@@ -20,8 +20,9 @@ var (
 )
 
 type Spamassassin struct {
-	config   *config.Config
-	RawEmail []byte
+	config    *config.Config
+	RawEmail  io.ReaderAt
+	EmailSize int64
 }
 
 type SpamassassinHeader struct {
@@ -41,10 +42,11 @@ type SpamassassinResponse struct {
 
 // check email by spamassassin
 
-func CheckSpamEmail(config *config.Config, email []byte) (string, error) {
+func CheckSpamEmail(config *config.Config, email io.ReaderAt, size int64) (string, error) {
 	spamassassin := &Spamassassin{
-		config:   config,
-		RawEmail: email,
+		config:    config,
+		RawEmail:  email,
+		EmailSize: size,
 	}
 	output, err := spamassassin.checkEmail()
 	if err != nil {
@@ -80,12 +82,12 @@ func (ss *Spamassassin) checkEmail() ([]string, error) {
 	if err != nil {
 		return dataArrays, err
 	}
-	_, err = conn.Write([]byte("Content-length: " + strconv.Itoa(len(ss.RawEmail)) + "\r\n\r\n"))
+	_, err = conn.Write([]byte("Content-length: " + strconv.FormatInt(ss.EmailSize, 10) + "\r\n\r\n"))
 	if err != nil {
 		return dataArrays, err
 	}
 	// write email
-	_, err = conn.Write(ss.RawEmail)
+	_, err = io.Copy(conn, io.NewSectionReader(ss.RawEmail, 0, ss.EmailSize))
 	if err != nil {
 		return dataArrays, err
 	}
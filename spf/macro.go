@@ -0,0 +1,192 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expand macro-string (s7). Letters c, r and t are allowed only in
+// explanation.
+
+func (c *checker) expand(value, domain string, exp bool) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			out.WriteByte(value[i])
+			continue
+		}
+		if i+1 >= len(value) {
+			return "", permError("invalid macro %q", value)
+		}
+		i++
+		switch value[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return "", permError("invalid macro %q", value)
+			}
+			expanded, err := c.expandMacro(value[i+1:i+end], domain, exp)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i += end
+		default:
+			return "", permError("invalid macro %q", value)
+		}
+	}
+	return out.String(), nil
+}
+
+// expand "%{" macro-letter transformers *delimiter "}" without braces
+
+func (c *checker) expandMacro(macro, domain string, exp bool) (string, error) {
+	if macro == "" {
+		return "", permError("empty macro")
+	}
+	letter := macro[0]
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.sender[:strings.LastIndex(c.sender, "@")]
+		if value == "" {
+			value = "postmaster"
+		}
+	case 'o':
+		value = c.sender[strings.LastIndex(c.sender, "@")+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(c.ip)
+	case 'p':
+		value = c.validatedName(domain)
+	case 'v':
+		value = "ip6"
+		if len(c.ip) == net.IPv4len {
+			value = "in-addr"
+		}
+	case 'h':
+		value = c.helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", permError("macro %%{%c} is allowed only in explanation", letter)
+		}
+		switch letter | 0x20 {
+		case 'c':
+			value = c.ip.String()
+		case 'r':
+			value = "unknown"
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", permError("unknown macro letter %q", letter)
+	}
+
+	// transformers: digits, "r" and delimiters
+	rest := macro[1:]
+	j := 0
+	for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+		j++
+	}
+	keep := 0
+	if j > 0 {
+		n, err := strconv.Atoi(rest[:j])
+		if err != nil || n == 0 {
+			return "", permError("invalid macro transformer %q", macro)
+		}
+		keep = n
+	}
+	reverse := false
+	if j < len(rest) && (rest[j] == 'r' || rest[j] == 'R') {
+		reverse = true
+		j++
+	}
+	delimiters := rest[j:]
+	if strings.Trim(delimiters, ".-+,/_=") != "" {
+		return "", permError("invalid macro delimiter %q", macro)
+	}
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for a, b := 0, len(parts)-1; a < b; a, b = a+1, b-1 {
+			parts[a], parts[b] = parts[b], parts[a]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+	// uppercase letter means URL escaping
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+	return value, nil
+}
+
+// expand domain-spec, long result is shortened from the left (s4.8)
+
+func (c *checker) expandDomain(value, domain string) (string, error) {
+	target, err := c.expand(value, domain, false)
+	if err != nil {
+		return "", err
+	}
+	target = strings.TrimSuffix(target, ".")
+	for len(target) > MAX_DOMAIN_LEN {
+		i := strings.IndexByte(target, '.')
+		if i < 0 {
+			break
+		}
+		target = target[i+1:]
+	}
+	return strings.ToLower(target), nil
+}
+
+// validated PTR name for %{p}, domain or its subdomain is preferred
+
+func (c *checker) validatedName(domain string) string {
+	names := c.validatedNames()
+	for _, name := range names {
+		if name == domain {
+			return name
+		}
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, "."+domain) {
+			return name
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return "unknown"
+}
+
+// IPv4 as is, IPv6 as dot separated nibbles
+
+func dottedIP(ip net.IP) string {
+	if len(ip) == net.IPv4len {
+		return ip.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0x0f))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,558 @@
+// Package spf evaluates Sender Policy Framework records (RFC 7208),
+// which tell whether client IP is allowed to send mail for domain.
+// See https://tools.ietf.org/html/rfc7208
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+type Result string
+
+const (
+	NONE      Result = "none"
+	NEUTRAL   Result = "neutral"
+	PASS      Result = "pass"
+	FAIL      Result = "fail"
+	SOFTFAIL  Result = "softfail"
+	TEMPERROR Result = "temperror"
+	PERMERROR Result = "permerror"
+
+	IDENTITY_MAILFROM = "mailfrom"
+	IDENTITY_HELO     = "helo"
+
+	MAX_DNS_LOOKUPS  = 10 // s4.6.4, mechanisms and modifiers with DNS lookups
+	MAX_VOID_LOOKUPS = 2  // s4.6.4, lookups without answer
+	MAX_NAME_LOOKUPS = 10 // s4.6.4, MX and PTR names of one mechanism
+	MAX_DOMAIN_LEN   = 253
+)
+
+var (
+	modifierRE    = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_.\-]*)=(.*)$`)
+	dualCidrRE    = regexp.MustCompile(`^(.*?)(?:/(\d+))?(?://(\d+))?$`)
+	macroStringRE = regexp.MustCompile(`^(?:%\{[slodiphcrtvSLODIPHCRTV][0-9]*[rR]?[.\-+,/_=]*\}|%%|%_|%-|[!-$&-~])*$`)
+)
+
+// Report is result of SPF check for one identity
+type Report struct {
+	Identity    string // mailfrom or helo
+	Domain      string // checked domain
+	Result      Result
+	Explanation string
+}
+
+// spfError stops evaluation with temperror or permerror
+
+type spfError struct {
+	result Result
+	msg    string
+}
+
+func (e *spfError) Error() string {
+	return e.msg
+}
+
+func permError(format string, args ...interface{}) error {
+	return &spfError{result: PERMERROR, msg: fmt.Sprintf(format, args...)}
+}
+
+func tempError(format string, args ...interface{}) error {
+	return &spfError{result: TEMPERROR, msg: fmt.Sprintf(format, args...)}
+}
+
+// Check evaluates SPF of client ip for MAIL FROM identity. Null sender
+// (bounce) is checked by HELO identity, as required by s2.4.
+
+func Check(r resolver.Resolver, ip net.IP, sender, helo string) *Report {
+	i := strings.LastIndex(sender, "@")
+	if sender == "" || i < 0 {
+		return CheckHelo(r, ip, helo)
+	}
+	report := &Report{Identity: IDENTITY_MAILFROM, Domain: strings.ToLower(strings.TrimSuffix(sender[i+1:], "."))}
+	return check(r, ip, report, sender, helo)
+}
+
+// CheckHelo evaluates SPF of client ip for HELO identity (s2.3). HELO
+// without domain name (address literal, single label) has none result.
+
+func CheckHelo(r resolver.Resolver, ip net.IP, helo string) *Report {
+	report := &Report{Identity: IDENTITY_HELO, Domain: strings.ToLower(strings.TrimSuffix(helo, "."))}
+	if strings.HasPrefix(report.Domain, "[") || !strings.Contains(report.Domain, ".") {
+		report.Result = NONE
+		report.Explanation = "HELO is not a domain name"
+		return report
+	}
+	return check(r, ip, report, "postmaster@"+helo, helo)
+}
+
+func check(r resolver.Resolver, ip net.IP, report *Report, sender, helo string) *Report {
+	if ip == nil {
+		report.Result = NONE
+		report.Explanation = "client address is unknown"
+		return report
+	}
+	report.Result, report.Explanation = CheckHost(r, ip, report.Domain, sender, helo)
+	return report
+}
+
+// CheckHost is check_host() function of s4. Explanation is text of exp
+// modifier for fail, error for temperror and permerror, or default text.
+
+func CheckHost(r resolver.Resolver, ip net.IP, domain, sender, helo string) (Result, string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	c := &checker{resolver: r, ip: ip, sender: sender, helo: helo}
+	result, explanation, err := c.checkHost(domain, true)
+	if err != nil {
+		return err.(*spfError).result, err.Error()
+	}
+	if explanation == "" {
+		explanation = defaultExplanation(result, domain, ip)
+	}
+	return result, explanation
+}
+
+func defaultExplanation(result Result, domain string, ip net.IP) string {
+	switch result {
+	case PASS:
+		return fmt.Sprintf("domain of %s designates %s as permitted sender", domain, ip)
+	case FAIL:
+		return fmt.Sprintf("domain of %s does not designate %s as permitted sender", domain, ip)
+	case SOFTFAIL:
+		return fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", domain, ip)
+	case NEUTRAL:
+		return fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, domain)
+	}
+	return fmt.Sprintf("domain of %s does not designate permitted sender hosts", domain)
+}
+
+// CHECKER
+
+type checker struct {
+	resolver    resolver.Resolver
+	ip          net.IP // 4 bytes for IPv4
+	sender      string
+	helo        string
+	lookups     int
+	voidLookups int
+}
+
+type directive struct {
+	qualifier Result
+	mechanism string
+	value     string // domain-spec or ip
+	cidr4     int    // -1 if not set
+	cidr6     int
+}
+
+type record struct {
+	directives []*directive
+	redirect   string
+	exp        string
+}
+
+// evaluate record of domain. Explanation is only set for fail on top
+// level, included records use explanation of including domain (s6.2)
+
+func (c *checker) checkHost(domain string, topLevel bool) (Result, string, error) {
+	if !isValidDomain(domain) {
+		return NONE, "", nil
+	}
+	txt, err := c.spfRecord(domain)
+	if err != nil || txt == "" {
+		return NONE, "", err
+	}
+	rec, err := parseRecord(txt)
+	if err != nil {
+		return NONE, "", err
+	}
+	for _, d := range rec.directives {
+		matched, err := c.match(d, domain)
+		if err != nil {
+			return NONE, "", err
+		}
+		if matched {
+			if d.qualifier == FAIL && topLevel && rec.exp != "" {
+				return FAIL, c.explanation(rec.exp, domain), nil
+			}
+			return d.qualifier, "", nil
+		}
+	}
+	if rec.redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return NONE, "", err
+		}
+		target, err := c.expandDomain(rec.redirect, domain)
+		if err != nil {
+			return NONE, "", err
+		}
+		result, explanation, err := c.checkHost(target, topLevel)
+		if err != nil {
+			return NONE, "", err
+		}
+		if result == NONE {
+			return NONE, "", permError("redirect domain %s has no SPF record", target)
+		}
+		return result, explanation, nil
+	}
+	return NEUTRAL, "", nil
+}
+
+// spfRecord returns "v=spf1" record of domain, empty if there is no one
+
+func (c *checker) spfRecord(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(domain)
+	if err != nil {
+		if resolver.IsNotFound(err) {
+			return "", nil
+		}
+		return "", tempError("DNS error for %s: %v", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", permError("domain %s has more than one SPF record", domain)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+func (c *checker) countLookup() error {
+	c.lookups++
+	if c.lookups > MAX_DNS_LOOKUPS {
+		return permError("too many DNS lookups")
+	}
+	return nil
+}
+
+// lookup error: not found is void lookup, other errors are temporary
+
+func (c *checker) lookupError(name string, err error) error {
+	if resolver.IsNotFound(err) {
+		c.voidLookups++
+		if c.voidLookups > MAX_VOID_LOOKUPS {
+			return permError("too many void DNS lookups")
+		}
+		return nil
+	}
+	return tempError("DNS error for %s: %v", name, err)
+}
+
+// PARSER
+
+func parseRecord(txt string) (*record, error) {
+	rec := &record{}
+	terms := strings.Fields(txt)[1:]
+	for _, term := range terms {
+		if m := modifierRE.FindStringSubmatch(term); m != nil {
+			name, value := strings.ToLower(m[1]), m[2]
+			if !macroStringRE.MatchString(value) {
+				return nil, permError("invalid modifier %q", term)
+			}
+			switch name {
+			case "redirect":
+				if rec.redirect != "" || value == "" {
+					return nil, permError("invalid redirect modifier %q", term)
+				}
+				rec.redirect = value
+			case "exp":
+				if rec.exp != "" || value == "" {
+					return nil, permError("invalid exp modifier %q", term)
+				}
+				rec.exp = value
+			}
+			// unknown modifiers are ignored (s6)
+			continue
+		}
+		d, err := parseDirective(term)
+		if err != nil {
+			return nil, err
+		}
+		rec.directives = append(rec.directives, d)
+	}
+	// redirect is ignored if record has "all" (s6.1)
+	for _, d := range rec.directives {
+		if d.mechanism == "all" {
+			rec.redirect = ""
+		}
+	}
+	return rec, nil
+}
+
+func parseDirective(term string) (*directive, error) {
+	d := &directive{qualifier: PASS, cidr4: -1, cidr6: -1}
+	switch term[0] {
+	case '+':
+		term = term[1:]
+	case '-':
+		d.qualifier, term = FAIL, term[1:]
+	case '~':
+		d.qualifier, term = SOFTFAIL, term[1:]
+	case '?':
+		d.qualifier, term = NEUTRAL, term[1:]
+	}
+	i := strings.IndexAny(term, ":/")
+	if i < 0 {
+		i = len(term)
+	}
+	d.mechanism, term = strings.ToLower(term[:i]), term[i:]
+	hasValue := strings.HasPrefix(term, ":")
+	if hasValue {
+		term = term[1:]
+	}
+	switch d.mechanism {
+	case "all":
+		if term != "" {
+			return nil, permError("invalid mechanism %q", d.mechanism+term)
+		}
+	case "include", "exists":
+		if !hasValue || !isMacroString(term) {
+			return nil, permError("invalid %s mechanism", d.mechanism)
+		}
+		d.value = term
+	case "a", "mx":
+		m := dualCidrRE.FindStringSubmatch(term)
+		if m == nil || (hasValue && !isMacroString(m[1])) || (!hasValue && m[1] != "") {
+			return nil, permError("invalid %s mechanism", d.mechanism)
+		}
+		d.value = m[1]
+		var err error
+		if d.cidr4, err = parseCidr(m[2], 32); err != nil {
+			return nil, err
+		}
+		if d.cidr6, err = parseCidr(m[3], 128); err != nil {
+			return nil, err
+		}
+	case "ptr":
+		if hasValue && !isMacroString(term) || !hasValue && term != "" {
+			return nil, permError("invalid ptr mechanism")
+		}
+		d.value = term
+	case "ip4", "ip6":
+		value, cidr := term, ""
+		if j := strings.IndexByte(term, '/'); j >= 0 {
+			value, cidr = term[:j], term[j+1:]
+			if cidr == "" {
+				return nil, permError("invalid %s mechanism", d.mechanism)
+			}
+		}
+		ip := net.ParseIP(value)
+		if !hasValue || ip == nil || (ip.To4() != nil) != (d.mechanism == "ip4") || strings.Contains(value, ":") == (d.mechanism == "ip4") {
+			return nil, permError("invalid %s mechanism", d.mechanism)
+		}
+		d.value = value
+		var err error
+		if d.mechanism == "ip4" {
+			d.cidr4, err = parseCidr(cidr, 32)
+		} else {
+			d.cidr6, err = parseCidr(cidr, 128)
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, permError("unknown mechanism %q", d.mechanism)
+	}
+	return d, nil
+}
+
+func parseCidr(value string, max int) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 0 || bits > max || (len(value) > 1 && value[0] == '0') {
+		return -1, permError("invalid CIDR length %q", value)
+	}
+	return bits, nil
+}
+
+func isMacroString(value string) bool {
+	return value != "" && macroStringRE.MatchString(value)
+}
+
+// MECHANISMS
+
+func (c *checker) match(d *directive, domain string) (bool, error) {
+	switch d.mechanism {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return c.ipMatches(net.ParseIP(d.value), d.cidr4, d.cidr6), nil
+	}
+	// other mechanisms use DNS
+	if err := c.countLookup(); err != nil {
+		return false, err
+	}
+	target := domain
+	if d.value != "" {
+		var err error
+		if target, err = c.expandDomain(d.value, domain); err != nil {
+			return false, err
+		}
+	}
+	switch d.mechanism {
+	case "include":
+		result, _, err := c.checkHost(target, false)
+		if err != nil {
+			return false, err
+		}
+		switch result {
+		case PASS:
+			return true, nil
+		case NONE:
+			return false, permError("included domain %s has no SPF record", target)
+		}
+		return false, nil
+	case "a":
+		return c.hostMatches(target, d.cidr4, d.cidr6)
+	case "mx":
+		mxs, err := c.resolver.LookupMX(target)
+		if err != nil {
+			return false, c.lookupError(target, err)
+		}
+		if len(mxs) > MAX_NAME_LOOKUPS {
+			return false, permError("domain %s has too many MX records", target)
+		}
+		for _, mx := range mxs {
+			matched, err := c.hostMatches(mx.Host, d.cidr4, d.cidr6)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		for _, name := range c.validatedNames() {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "exists":
+		_, err := c.resolver.LookupIP("ip4", target)
+		if err != nil {
+			return false, c.lookupError(target, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *checker) ipMatches(ip net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if len(c.ip) != net.IPv4len {
+			return false
+		}
+		if cidr4 < 0 {
+			cidr4 = 32
+		}
+		return (&net.IPNet{IP: ip4, Mask: net.CIDRMask(cidr4, 32)}).Contains(c.ip)
+	}
+	if len(c.ip) == net.IPv4len {
+		return false
+	}
+	if cidr6 < 0 {
+		cidr6 = 128
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(cidr6, 128)}).Contains(c.ip)
+}
+
+// host matches if one of its addresses (A for IPv4 client, AAAA for IPv6)
+// is in CIDR
+
+func (c *checker) hostMatches(host string, cidr4, cidr6 int) (bool, error) {
+	network := "ip6"
+	if len(c.ip) == net.IPv4len {
+		network = "ip4"
+	}
+	ips, err := c.resolver.LookupIP(network, host)
+	if err != nil {
+		return false, c.lookupError(host, err)
+	}
+	for _, ip := range ips {
+		if c.ipMatches(ip, cidr4, cidr6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validatedNames returns PTR names of client ip, which resolve back to
+// it (s5.5). Errors only mean no match.
+
+func (c *checker) validatedNames() []string {
+	names, err := c.resolver.LookupAddr(c.ip.String())
+	if err != nil {
+		return nil
+	}
+	network := "ip6"
+	if len(c.ip) == net.IPv4len {
+		network = "ip4"
+	}
+	var validated []string
+	for i, name := range names {
+		if i >= MAX_NAME_LOOKUPS {
+			break
+		}
+		ips, err := c.resolver.LookupIP(network, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				validated = append(validated, strings.ToLower(strings.TrimSuffix(name, ".")))
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// explanation is TXT record of exp domain with expanded macros,
+// default explanation is used on any error (s6.2)
+
+func (c *checker) explanation(exp, domain string) string {
+	target, err := c.expandDomain(exp, domain)
+	if err != nil {
+		return ""
+	}
+	txts, err := c.resolver.LookupTXT(target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := c.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// UTILS
+
+// domain name with at least two labels, labels are up to 63 chars
+
+func isValidDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) == 0 || len(domain) > MAX_DOMAIN_LEN || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
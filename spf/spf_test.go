@@ -0,0 +1,206 @@
+package spf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Polymail/go-falcon/resolver"
+)
+
+// zone from RFC 7208 Appendix A
+
+func newTestZone() *resolver.Zone {
+	zone := resolver.NewZone()
+	zone.AddIP("example.com", "192.0.2.10", "192.0.2.11")
+	zone.AddIP("amy.example.com", "192.0.2.65")
+	zone.AddIP("bob.example.com", "192.0.2.66")
+	zone.AddIP("mail-a.example.com", "192.0.2.129")
+	zone.AddIP("mail-b.example.com", "192.0.2.130")
+	zone.AddIP("www.example.com", "192.0.2.10")
+	zone.AddIP("mail-c.example.org", "192.0.2.140")
+	zone.AddIP("mail6.example.com", "2001:db8::25")
+	zone.AddMX("example.com", 10, "mail-a.example.com")
+	zone.AddMX("example.com", 20, "mail-b.example.com")
+	zone.AddMX("example.org", 10, "mail-c.example.org")
+	zone.AddPTR("192.0.2.10", "example.com")
+	zone.AddPTR("192.0.2.11", "example.com")
+	zone.AddPTR("192.0.2.65", "amy.example.com")
+	zone.AddPTR("192.0.2.66", "bob.example.com")
+	zone.AddPTR("192.0.2.129", "mail-a.example.com")
+	zone.AddPTR("192.0.2.130", "mail-b.example.com")
+	zone.AddPTR("192.0.2.140", "mail-c.example.org")
+	zone.AddPTR("10.0.0.4", "bob.example.com")
+	return zone
+}
+
+func TestCheckHost(t *testing.T) {
+	tests := []struct {
+		record string
+		ip     string
+		result Result
+	}{
+		{"v=spf1 +all", "192.0.2.1", PASS},
+		{"v=spf1 a -all", "192.0.2.10", PASS},
+		{"v=spf1 a -all", "192.0.2.65", FAIL},
+		{"v=spf1 a:example.org -all", "192.0.2.10", FAIL},
+		{"v=spf1 mx -all", "192.0.2.129", PASS},
+		{"v=spf1 mx -all", "192.0.2.10", FAIL},
+		{"v=spf1 mx:example.org -all", "192.0.2.140", PASS},
+		{"v=spf1 mx mx:example.org -all", "192.0.2.130", PASS},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.131", PASS},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.141", PASS},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.150", FAIL},
+		{"v=spf1 ptr -all", "192.0.2.65", PASS},
+		{"v=spf1 ptr -all", "192.0.2.140", FAIL},
+		{"v=spf1 ptr -all", "10.0.0.4", FAIL},
+		{"v=spf1 ip4:192.0.2.128/28 -all", "192.0.2.129", PASS},
+		{"v=spf1 ip4:192.0.2.128/28 -all", "192.0.2.65", FAIL},
+		{"v=spf1 ip6:2001:db8::/32 ~all", "2001:db8::1", PASS},
+		{"v=spf1 ip6:2001:db8::/32 ~all", "192.0.2.1", SOFTFAIL},
+		{"v=spf1 a:mail6.example.com//64 -all", "2001:db8::99", PASS},
+		{"v=spf1 ?all", "192.0.2.1", NEUTRAL},
+		{"v=spf1", "192.0.2.1", NEUTRAL},
+		{"v=spf1 -ip4:192.0.2.0/24 +all", "192.0.2.1", FAIL},
+		{"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all", "192.0.2.3", PASS},
+		{"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all", "192.0.2.4", FAIL},
+		{"v=spf1 include:_spf.example.net -all", "198.51.100.1", PASS},
+		{"v=spf1 include:_spf.example.net -all", "198.51.100.2", FAIL},
+		{"v=spf1 include:missing.example.net -all", "198.51.100.1", PERMERROR},
+		{"v=spf1 include:broken.example.net -all", "198.51.100.1", TEMPERROR},
+		{"v=spf1 redirect=_spf.example.net", "198.51.100.1", PASS},
+		{"v=spf1 redirect=_spf.example.net", "198.51.100.2", FAIL},
+		{"v=spf1 redirect=missing.example.net", "198.51.100.1", PERMERROR},
+		{"v=spf1 -all redirect=_spf.example.net", "198.51.100.1", FAIL},
+		{"v=spf1 foo:bar -all", "192.0.2.1", PERMERROR},
+		{"v=spf1 ip4:192.0.2.300 -all", "192.0.2.1", PERMERROR},
+		{"v=spf1 a/33 -all", "192.0.2.1", PERMERROR},
+		{"v=spf1 unknown=value -all", "192.0.2.1", FAIL},
+		{"v=spf1 redirect=a.example.net redirect=b.example.net", "192.0.2.1", PERMERROR},
+		{"v=spf1 a:void1.example.net a:void2.example.net a:void3.example.net -all", "192.0.2.1", PERMERROR},
+		{"v=spf1 include:loop.example.net -all", "192.0.2.1", PERMERROR},
+	}
+	for _, test := range tests {
+		zone := newTestZone()
+		zone.AddTXT("example.com", test.record)
+		zone.AddIP("3.2.0.192.joel._spf.example.com", "127.0.0.2")
+		zone.AddTXT("_spf.example.net", "v=spf1 ip4:198.51.100.1 -all")
+		zone.AddFailure("broken.example.net")
+		zone.AddTXT("loop.example.net", "v=spf1 include:loop.example.net -all")
+		result, explanation := CheckHost(zone, net.ParseIP(test.ip), "example.com", "joel@example.com", "mail.example.com")
+		if result != test.result {
+			t.Errorf("%q from %s: expected %s, got %s (%s)", test.record, test.ip, test.result, result, explanation)
+		}
+	}
+}
+
+func TestCheckHostRecords(t *testing.T) {
+	zone := newTestZone()
+	if result, _ := CheckHost(zone, net.ParseIP("192.0.2.1"), "example.com", "joel@example.com", ""); result != NONE {
+		t.Errorf("no record: expected none, got %s", result)
+	}
+	zone.AddTXT("example.com", "v=spf1 +all", "v=spf1 -all")
+	if result, _ := CheckHost(zone, net.ParseIP("192.0.2.1"), "example.com", "joel@example.com", ""); result != PERMERROR {
+		t.Errorf("two records: expected permerror, got %s", result)
+	}
+	zone.AddFailure("example.org")
+	if result, _ := CheckHost(zone, net.ParseIP("192.0.2.1"), "example.org", "joel@example.org", ""); result != TEMPERROR {
+		t.Errorf("dns failure: expected temperror, got %s", result)
+	}
+	if result, _ := CheckHost(zone, net.ParseIP("192.0.2.1"), "localhost", "joel@localhost", ""); result != NONE {
+		t.Errorf("single label domain: expected none, got %s", result)
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	zone := newTestZone()
+	zone.AddTXT("example.com", "v=spf1 mx -all exp=explain._spf.%{d}")
+	zone.AddTXT("explain._spf.example.com", "See http://%{d}/why.html?s=%{S}&i=%{C}")
+	result, explanation := CheckHost(zone, net.ParseIP("192.0.2.1"), "example.com", "strong-bad@email.example.com", "")
+	if result != FAIL {
+		t.Fatalf("expected fail, got %s", result)
+	}
+	expected := "See http://example.com/why.html?s=strong-bad%40email.example.com&i=192.0.2.1"
+	if explanation != expected {
+		t.Errorf("expected %q, got %q", expected, explanation)
+	}
+	result, explanation = CheckHost(zone, net.ParseIP("192.0.2.129"), "example.com", "strong-bad@email.example.com", "")
+	if result != PASS || explanation != "domain of example.com designates 192.0.2.129 as permitted sender" {
+		t.Errorf("unexpected pass result: %s (%s)", result, explanation)
+	}
+}
+
+// macro examples from RFC 7208 s7.4
+
+func TestMacroExpansion(t *testing.T) {
+	c := &checker{resolver: newTestZone(), ip: net.ParseIP("192.0.2.3").To4(), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	tests := []struct {
+		macro    string
+		expected string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"%{h}%%%_%-", "mx.example.org% %20"},
+	}
+	for _, test := range tests {
+		expanded, err := c.expand(test.macro, "email.example.com", false)
+		if err != nil || expanded != test.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", test.macro, test.expected, expanded, err)
+		}
+	}
+	c.ip = net.ParseIP("2001:db8::cb01")
+	expanded, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false)
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if expanded != expected {
+		t.Errorf("expected %q, got %q", expected, expanded)
+	}
+	if _, err := c.expand("%{c}", "email.example.com", false); err == nil {
+		t.Errorf("%%{c} outside of explanation should fail")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zone := newTestZone()
+	zone.AddTXT("example.com", "v=spf1 a -all")
+	zone.AddTXT("mail.example.com", "v=spf1 ip4:192.0.2.10 -all")
+	report := Check(zone, net.ParseIP("192.0.2.10"), "joel@Example.com", "mail.example.com")
+	if report.Identity != IDENTITY_MAILFROM || report.Domain != "example.com" || report.Result != PASS {
+		t.Errorf("unexpected mail from report: %+v", report)
+	}
+	report = Check(zone, net.ParseIP("192.0.2.11"), "", "mail.example.com")
+	if report.Identity != IDENTITY_HELO || report.Domain != "mail.example.com" || report.Result != FAIL {
+		t.Errorf("unexpected helo report: %+v", report)
+	}
+	report = Check(zone, nil, "joel@example.com", "mail.example.com")
+	if report.Result != NONE {
+		t.Errorf("unknown client: expected none, got %s", report.Result)
+	}
+}
+
+func TestCheckHelo(t *testing.T) {
+	zone := newTestZone()
+	zone.AddTXT("mail.example.com", "v=spf1 ip4:192.0.2.10 -all")
+	report := CheckHelo(zone, net.ParseIP("192.0.2.10"), "Mail.Example.com.")
+	if report.Identity != IDENTITY_HELO || report.Domain != "mail.example.com" || report.Result != PASS {
+		t.Errorf("unexpected helo report: %+v", report)
+	}
+	for _, helo := range []string{"[192.0.2.10]", "localhost", ""} {
+		if report = CheckHelo(zone, net.ParseIP("192.0.2.10"), helo); report.Result != NONE {
+			t.Errorf("helo %q: expected none, got %s", helo, report.Result)
+		}
+	}
+}
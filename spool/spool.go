@@ -0,0 +1,299 @@
+// Package spool keeps accepted emails on disk until storage workers
+// save them in database, so a crash or database outage doesn't lose
+// mail which was already confirmed to the client.
+package spool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Polymail/go-falcon/dnsbl"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+const (
+	BODY_EXT     = ".eml"
+	ENVELOPE_EXT = ".env"
+	TMP_EXT      = ".tmp"
+	FAILED_DIR   = "failed"
+)
+
+type Spool struct {
+	pending   int64 // entries, which are not stored or failed yet
+	Directory string
+}
+
+// envelope as stored on disk
+
+type spoolEnvelope struct {
+	MailboxID       int
+	From            string
+	Rcpts           []string
+	RcptMailboxes   map[string]int
+	StoredMailboxes []int
+	MailParams      smtpd.MailParams
+	RcptParams      map[string]smtpd.RcptParams
+	Spf             *spf.Report
+	SpfHelo         *spf.Report
+	Dnsbl           *dnsbl.Result
+	Trace           *smtpd.Trace
+	Attempts        int
+}
+
+// Open spool directory, create it if not exists
+
+func Open(directory string) (*Spool, error) {
+	err := os.MkdirAll(filepath.Join(directory, FAILED_DIR), 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{Directory: directory}, nil
+}
+
+func (s *Spool) path(id, ext string) string {
+	return filepath.Join(s.Directory, id+ext)
+}
+
+// Store writes email and its envelope on disk. When Store returns without
+// error, both files are synced and the entry survives a crash.
+
+func (s *Spool) Store(env *smtpd.BasicEnvelope) error {
+	id, err := newSpoolID()
+	if err != nil {
+		return err
+	}
+	if env.MailBody == nil {
+		return errors.New("email without data")
+	}
+	// body first, envelope file marks entry as complete
+	if err = writeFileSync(s.path(id, BODY_EXT), env.MailBody.Reader()); err != nil {
+		os.Remove(s.path(id, BODY_EXT))
+		return err
+	}
+	if err = s.writeEnvelope(id, env); err != nil {
+		os.Remove(s.path(id, BODY_EXT))
+		return err
+	}
+	env.SpoolID = id
+	atomic.AddInt64(&s.pending, 1)
+	return nil
+}
+
+// MarkStored saves inboxes, which already have email, and failed
+// attempts, so retry doesn't store it in them again
+
+func (s *Spool) MarkStored(env *smtpd.BasicEnvelope) error {
+	if env.SpoolID == "" {
+		return nil
+	}
+	return s.writeEnvelope(env.SpoolID, env)
+}
+
+// write envelope file atomically
+
+func (s *Spool) writeEnvelope(id string, env *smtpd.BasicEnvelope) error {
+	stored := spoolEnvelope{
+		MailboxID:       env.MailboxID,
+		RcptMailboxes:   env.RcptMailboxes,
+		StoredMailboxes: env.StoredMailboxes,
+		MailParams:      env.MailParams,
+		RcptParams:      env.RcptParams,
+		Spf:             env.Spf,
+		SpfHelo:         env.SpfHelo,
+		Dnsbl:           env.Dnsbl,
+		Trace:           env.Trace,
+		Attempts:        env.Attempts,
+	}
+	if env.From != nil {
+		stored.From = env.From.Email()
+	}
+	for _, rcpt := range env.Rcpts {
+		stored.Rcpts = append(stored.Rcpts, rcpt.Email())
+	}
+	envData, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path(id, ENVELOPE_EXT+TMP_EXT)
+	if err = writeFileSync(tmpPath, bytes.NewReader(envData)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, s.path(id, ENVELOPE_EXT)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(s.Directory)
+}
+
+// Remove entry after email was stored
+
+func (s *Spool) Remove(id string) error {
+	if id == "" {
+		return nil
+	}
+	// envelope first, body without envelope is removed on next start
+	err := os.Remove(s.path(id, ENVELOPE_EXT))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		atomic.AddInt64(&s.pending, -1)
+	}
+	err = os.Remove(s.path(id, BODY_EXT))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Fail moves entry, which can't be stored at all, to failed directory
+
+func (s *Spool) Fail(id string) error {
+	if id == "" {
+		return nil
+	}
+	for _, ext := range []string{BODY_EXT, ENVELOPE_EXT} {
+		err := os.Rename(s.path(id, ext), filepath.Join(s.Directory, FAILED_DIR, id+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && ext == ENVELOPE_EXT {
+			atomic.AddInt64(&s.pending, -1)
+		}
+	}
+	return nil
+}
+
+// Pending returns number of entries, which are not stored yet
+
+func (s *Spool) Pending() int {
+	return int(atomic.LoadInt64(&s.pending))
+}
+
+// Unfinished returns all complete entries, which are not stored yet.
+// Incomplete entries (crash during Store) are removed.
+
+func (s *Spool) Unfinished() ([]*smtpd.BasicEnvelope, error) {
+	var envelopes []*smtpd.BasicEnvelope
+	files, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return nil, err
+	}
+	complete := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ENVELOPE_EXT) {
+			complete[strings.TrimSuffix(file.Name(), ENVELOPE_EXT)] = true
+		}
+	}
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case file.IsDir():
+			continue
+		case strings.HasSuffix(name, TMP_EXT):
+			os.Remove(filepath.Join(s.Directory, name))
+		case strings.HasSuffix(name, BODY_EXT):
+			id := strings.TrimSuffix(name, BODY_EXT)
+			if !complete[id] {
+				log.Errorf("Spool: remove incomplete entry %s", id)
+				os.Remove(filepath.Join(s.Directory, name))
+				continue
+			}
+			env, err := s.Load(id)
+			if err != nil {
+				log.Errorf("Spool: invalid entry %s: %v", id, err)
+				s.Fail(id)
+				continue
+			}
+			envelopes = append(envelopes, env)
+		}
+	}
+	atomic.StoreInt64(&s.pending, int64(len(envelopes)))
+	return envelopes, nil
+}
+
+// Load entry from disk, body is read from spool file
+
+func (s *Spool) Load(id string) (*smtpd.BasicEnvelope, error) {
+	var stored spoolEnvelope
+	envData, err := ioutil.ReadFile(s.path(id, ENVELOPE_EXT))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(envData, &stored); err != nil {
+		return nil, err
+	}
+	body, err := mailbody.Open(s.path(id, BODY_EXT))
+	if err != nil {
+		return nil, err
+	}
+	env := &smtpd.BasicEnvelope{
+		MailboxID:       stored.MailboxID,
+		RcptMailboxes:   stored.RcptMailboxes,
+		StoredMailboxes: stored.StoredMailboxes,
+		MailParams:      stored.MailParams,
+		RcptParams:      stored.RcptParams,
+		Spf:             stored.Spf,
+		SpfHelo:         stored.SpfHelo,
+		Dnsbl:           stored.Dnsbl,
+		Trace:           stored.Trace,
+		Attempts:        stored.Attempts,
+		MailBody:        body,
+		SpoolID:         id,
+	}
+	env.From = smtpd.NewMailAddress(stored.From)
+	for _, rcpt := range stored.Rcpts {
+		env.Rcpts = append(env.Rcpts, smtpd.NewMailAddress(rcpt))
+	}
+	return env, nil
+}
+
+// utils
+
+func newSpoolID() (string, error) {
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%s", time.Now().UTC().UnixNano(), hex.EncodeToString(random)), nil
+}
+
+func writeFileSync(filename string, data io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(directory string) error {
+	d, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
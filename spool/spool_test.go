@@ -0,0 +1,132 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+)
+
+func newTestSpool(t *testing.T) *Spool {
+	directory, err := ioutil.TempDir("", "falcon-spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	s, err := Open(directory)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return s
+}
+
+func newTestEnvelope() *smtpd.BasicEnvelope {
+	return &smtpd.BasicEnvelope{
+		MailboxID:  42,
+		From:       smtpd.NewMailAddress("from@example.com"),
+		Rcpts:      []smtpd.MailAddress{smtpd.NewMailAddress("to@example.com"), smtpd.NewMailAddress("cc@example.com")},
+		MailBody:   mailbody.FromBytes([]byte("Subject: test\r\n\r\nbody\r\n")),
+		MailParams: smtpd.MailParams{Ret: "HDRS", EnvID: "QQ314159"},
+		RcptParams: map[string]smtpd.RcptParams{
+			"to@example.com": {Notify: []string{"SUCCESS", "FAILURE"}, Orcpt: "rfc822;to@example.com"},
+		},
+	}
+}
+
+func readBody(t *testing.T, env *smtpd.BasicEnvelope) string {
+	data, err := ioutil.ReadAll(env.MailBody.Reader())
+	if err != nil {
+		t.Fatalf("Read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestStoreAndReplay(t *testing.T) {
+	s := newTestSpool(t)
+	defer os.RemoveAll(s.Directory)
+
+	env := newTestEnvelope()
+	if err := s.Store(env); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if env.SpoolID == "" {
+		t.Fatalf("Store doesn't set SpoolID")
+	}
+
+	envelopes, err := s.Unfinished()
+	if err != nil {
+		t.Fatalf("Unfinished: %v", err)
+	}
+	if len(envelopes) != 1 {
+		t.Fatalf("Expected 1 unfinished entry, got %d", len(envelopes))
+	}
+	replayed := envelopes[0]
+	if replayed.SpoolID != env.SpoolID || replayed.MailboxID != 42 || readBody(t, replayed) != readBody(t, env) {
+		t.Errorf("Unexpected replayed envelope: %+v", replayed)
+	}
+	replayed.Discard()
+	if replayed.From.Email() != "from@example.com" || len(replayed.Rcpts) != 2 || replayed.Rcpts[1].Email() != "cc@example.com" {
+		t.Errorf("Unexpected replayed addresses: %v %v", replayed.From, replayed.Rcpts)
+	}
+	if replayed.MailParams.EnvID != "QQ314159" || len(replayed.RcptParams["to@example.com"].Notify) != 2 {
+		t.Errorf("Unexpected replayed DSN parameters: %+v %+v", replayed.MailParams, replayed.RcptParams)
+	}
+
+	if s.Pending() != 1 {
+		t.Errorf("Expected 1 pending entry, got %d", s.Pending())
+	}
+
+	if err := s.Remove(env.SpoolID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if s.Pending() != 0 {
+		t.Errorf("Expected no pending entries after Remove, got %d", s.Pending())
+	}
+	envelopes, _ = s.Unfinished()
+	if len(envelopes) != 0 {
+		t.Errorf("Expected no entries after Remove, got %d", len(envelopes))
+	}
+}
+
+func TestIncompleteEntryRemoved(t *testing.T) {
+	s := newTestSpool(t)
+	defer os.RemoveAll(s.Directory)
+
+	// crash after body was written
+	bodyPath := filepath.Join(s.Directory, "1.abc"+BODY_EXT)
+	ioutil.WriteFile(bodyPath, []byte("body"), 0640)
+	ioutil.WriteFile(filepath.Join(s.Directory, "1.abc"+ENVELOPE_EXT+TMP_EXT), []byte("{"), 0640)
+
+	envelopes, err := s.Unfinished()
+	if err != nil {
+		t.Fatalf("Unfinished: %v", err)
+	}
+	if len(envelopes) != 0 {
+		t.Errorf("Expected no entries, got %d", len(envelopes))
+	}
+	if _, err := os.Stat(bodyPath); !os.IsNotExist(err) {
+		t.Errorf("Incomplete body is not removed")
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := newTestSpool(t)
+	defer os.RemoveAll(s.Directory)
+
+	env := newTestEnvelope()
+	if err := s.Store(env); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := s.Fail(env.SpoolID); err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
+	envelopes, _ := s.Unfinished()
+	if len(envelopes) != 0 {
+		t.Errorf("Expected no entries after Fail, got %d", len(envelopes))
+	}
+	if _, err := os.Stat(filepath.Join(s.Directory, FAILED_DIR, env.SpoolID+BODY_EXT)); err != nil {
+		t.Errorf("Failed entry is not moved: %v", err)
+	}
+}
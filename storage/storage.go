@@ -7,6 +7,7 @@ import (
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/utils"
 	_ "github.com/lib/pq"
+	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -37,6 +38,17 @@ type StorageConfig struct {
 
 	Clamav_Sql string
 
+	Spf_Sql      string
+	Spf_Helo_Sql string // HELO identity, not stored if empty
+
+	Dkim_Sql string
+
+	Dmarc_Sql string
+
+	Dnsbl_Sql string
+
+	Faults_Sql string
+
 	Pop3_Count_And_Size_Messages string
 	Pop3_Messages_List           string
 	Pop3_Message_One             string
@@ -52,6 +64,17 @@ type DBConn struct {
 
 type InboxSettings struct {
 	MaxMessages, RateLimit int
+	GreylistingDisabled    bool // inbox opted out of greylisting
+}
+
+// FaultRule makes SMTP stage of inbox fail, see smtpd faults
+type FaultRule struct {
+	Stage   string // connect, mail, rcpt, data, end_of_data
+	Action  string // reply, drop, delay
+	Code    int    // reply code, 4xx or 5xx
+	Message string // reply text, default text if empty
+	Delay   int    // seconds to delay reply
+	Percent int    // percent of messages, every message if 0 or 100
 }
 
 func InitDatabase(config *StorageConfig) (*DBConn, error) {
@@ -113,6 +136,12 @@ func (db *DBConn) CheckUser(authMethod, username, cramPassword, cramSecret strin
 	return id, nil
 }
 
+// AddressModeFinder finds inbox of username in email address mode,
+// 0 if user is unknown
+type AddressModeFinder interface {
+	CheckAddressMode(username string) (int, error)
+}
+
 // check address mode
 
 func (db *DBConn) CheckAddressMode(username string) (int, error) {
@@ -121,8 +150,13 @@ func (db *DBConn) CheckAddressMode(username string) (int, error) {
 	)
 	log.Debugf("CheckAddressMode by %s", username)
 	err := db.DB.QueryRow(db.config.Email_Address_Mode_Sql, username).Scan(&id)
+	if err == sql.ErrNoRows {
+		// unknown user, not an error
+		log.Debugf("User Address %s doesn't found in inboxes", username)
+		return 0, nil
+	}
 	if err != nil {
-		log.Debugf("User Address %s doesn't found in inboxes (sql should return 'id' field): %v", username, err)
+		log.Errorf("CheckAddressMode (sql should return 'id' field): %v", err)
 		return 0, err
 	}
 	return id, nil
@@ -130,11 +164,16 @@ func (db *DBConn) CheckAddressMode(username string) (int, error) {
 
 // save email
 
-func (db *DBConn) StoreMail(mailboxId int, subject string, date time.Time, from, from_name, to, to_name, html, text string, rawEmail []byte) (int, error) {
+func (db *DBConn) StoreMail(mailboxId int, subject string, date time.Time, from, from_name, to, to_name, html, text string, rawEmail io.ReaderAt, rawSize int64) (int, error) {
 	var (
 		id int
 	)
-	strBody := utils.CheckAndFixUtf8(string(rawEmail))
+	// one copy of email for database
+	strBody, err := utils.ReadValidUtf8(io.NewSectionReader(rawEmail, 0, rawSize), rawSize)
+	if err != nil {
+		log.Errorf("Messages read error: %v", err)
+		return 0, err
+	}
 	sql := strings.Replace(db.config.Messages_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
 	// normalize variables
 	if len(subject) > 1000 {
@@ -153,7 +192,7 @@ func (db *DBConn) StoreMail(mailboxId int, subject string, date time.Time, from,
 		to_name = to_name[0:255]
 	}
 	// sql
-	err := db.DB.QueryRow(sql,
+	err = db.DB.QueryRow(sql,
 		mailboxId,
 		subject,
 		date.UTC(),
@@ -212,6 +251,92 @@ func (db *DBConn) UpdateVirusesReport(mailboxId int, messageId int, virusesRepor
 	return id, nil
 }
 
+// update SPF result
+
+func (db *DBConn) UpdateSpfReport(mailboxId int, messageId int, result, explanation string) (int, error) {
+	return db.updateSpfReport(db.config.Spf_Sql, mailboxId, messageId, result, explanation)
+}
+
+// update SPF report of HELO identity
+
+func (db *DBConn) UpdateSpfHeloReport(mailboxId int, messageId int, result, explanation string) (int, error) {
+	return db.updateSpfReport(db.config.Spf_Helo_Sql, mailboxId, messageId, result, explanation)
+}
+
+func (db *DBConn) updateSpfReport(query string, mailboxId int, messageId int, result, explanation string) (int, error) {
+	var (
+		id int
+	)
+	sql := strings.Replace(query, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
+	err := db.DB.QueryRow(sql,
+		mailboxId,
+		messageId,
+		result,
+		explanation).Scan(&id)
+	if err != nil {
+		log.Errorf("SPF SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update DKIM report
+
+func (db *DBConn) UpdateDkimReport(mailboxId int, messageId int, dkimReport string) (int, error) {
+	var (
+		id int
+	)
+	sql := strings.Replace(db.config.Dkim_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
+	err := db.DB.QueryRow(sql,
+		mailboxId,
+		messageId,
+		dkimReport).Scan(&id)
+	if err != nil {
+		log.Errorf("DKIM SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update DMARC result
+
+func (db *DBConn) UpdateDmarcReport(mailboxId int, messageId int, result, policy, reason string) (int, error) {
+	var (
+		id int
+	)
+	sql := strings.Replace(db.config.Dmarc_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
+	err := db.DB.QueryRow(sql,
+		mailboxId,
+		messageId,
+		result,
+		policy,
+		reason).Scan(&id)
+	if err != nil {
+		log.Errorf("DMARC SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update DNSBL listings
+
+func (db *DBConn) UpdateDnsblReport(mailboxId int, messageId int, score int, listings string) (int, error) {
+	var (
+		id int
+	)
+	sql := strings.Replace(db.config.Dnsbl_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
+	err := db.DB.QueryRow(sql,
+		mailboxId,
+		messageId,
+		score,
+		listings).Scan(&id)
+	if err != nil {
+		log.Errorf("DNSBL SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
 // save attachment
 
 func (db *DBConn) StoreAttachment(mailboxId int, messageId int, filename, attachmentType, contentType, contentId, transferEncoding, strBody string) (int, error) {
@@ -244,14 +369,61 @@ func (db *DBConn) StoreAttachment(mailboxId int, messageId int, filename, attach
 
 func (db *DBConn) GeInboxSettings(mailboxId int) (InboxSettings, error) {
 	var (
-		maxMessages int
-		rateLimit   int
+		maxMessages         int
+		rateLimit           int
+		greylistingDisabled bool
 	)
-	err := db.DB.QueryRow(db.config.Settings_Sql, mailboxId).Scan(&maxMessages, &rateLimit)
+	err := db.scanInboxSettings(mailboxId, &maxMessages, &rateLimit, &greylistingDisabled)
 	if err != nil {
 		log.Errorf("Settings SQL error: %v", err)
 	}
-	return InboxSettings{MaxMessages: maxMessages, RateLimit: rateLimit}, err
+	return InboxSettings{MaxMessages: maxMessages, RateLimit: rateLimit, GreylistingDisabled: greylistingDisabled}, err
+}
+
+// settings sql may skip optional columns, they keep zero value
+
+func (db *DBConn) scanInboxSettings(mailboxId int, dest ...interface{}) error {
+	rows, err := db.DB.Query(db.config.Settings_Sql, mailboxId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(columns) < len(dest) {
+		dest = dest[:len(columns)]
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	return rows.Scan(dest...)
+}
+
+// get fault rules of inbox
+
+func (db *DBConn) GetInboxFaults(mailboxId int) ([]FaultRule, error) {
+	rules := []FaultRule{}
+	rows, err := db.DB.Query(db.config.Faults_Sql, mailboxId)
+	if err != nil {
+		log.Errorf("Faults SQL error: %v", err)
+		return rules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule FaultRule
+		err = rows.Scan(&rule.Stage, &rule.Action, &rule.Code, &rule.Message, &rule.Delay, &rule.Percent)
+		if err != nil {
+			log.Errorf("Faults SQL error: %v", err)
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
 }
 
 // cleanup messages
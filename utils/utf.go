@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"io"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -21,3 +23,57 @@ func CheckAndFixUtf8(data string) string {
 	}
 	return data
 }
+
+// read text of size octets in string, invalid utf-8 symbols are removed
+// like in CheckAndFixUtf8, but text is copied only once
+func ReadValidUtf8(r io.Reader, size int64) (string, error) {
+	var out strings.Builder
+	out.Grow(int(size))
+	buf := make([]byte, 32*1024)
+	pending := 0
+	for {
+		n, err := r.Read(buf[pending:])
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		data := buf[:pending+n]
+		end := len(data)
+		if err == nil {
+			// incomplete symbol is decoded with next read
+			end = completeRunes(data)
+		}
+		writeValidUtf8(&out, data[:end])
+		pending = copy(buf, data[end:])
+		if err == io.EOF {
+			return out.String(), nil
+		}
+	}
+}
+
+// length of data without incomplete symbol at the end
+func completeRunes(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+func writeValidUtf8(out *strings.Builder, data []byte) {
+	start := 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			out.Write(data[start:i])
+			i++
+			start = i
+			continue
+		}
+		i += size
+	}
+	out.Write(data[start:])
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadValidUtf8(t *testing.T) {
+	tests := []string{
+		"plain text",
+		"Привет, мир",
+		"bad \xff\xfe octets",
+		"cut \xd0",
+		"\xe2\x82 cut in middle \xe2\x82\xac",
+	}
+	for _, text := range tests {
+		// one octet per read, symbols are split between reads
+		data, err := ReadValidUtf8(iotest.OneByteReader(strings.NewReader(text)), int64(len(text)))
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if expected := CheckAndFixUtf8(text); data != expected {
+			t.Errorf("%q: expected %q, got %q", text, expected, data)
+		}
+	}
+}
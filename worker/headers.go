@@ -0,0 +1,249 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dnsbl"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spamassassin"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+const (
+	RFC5322_DATE = "Mon, 02 Jan 2006 15:04:05 -0700"
+)
+
+// prepend Received, Authentication-Results and X-Falcon-Dnsbl headers to
+// raw email, headers use same line ending as email
+
+func addTraceHeaders(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail, reports *scanReports) *io.SectionReader {
+	newline := lineEnding(email.RawMail, email.RawSize)
+	var headers []string
+	if listings := dnsblHeader(config, envelop); listings != "" {
+		headers = append(headers, listings)
+	}
+	if results := authResultsHeader(config, envelop, email, reports); results != "" {
+		headers = append(headers, results)
+	}
+	if received := receivedHeader(envelop); received != "" {
+		headers = append(headers, received)
+	}
+	if len(headers) == 0 {
+		return io.NewSectionReader(email.RawMail, 0, email.RawSize)
+	}
+	prefix := strings.Replace(strings.Join(headers, "\n")+"\n", "\n", newline, -1)
+	return mailbody.WithPrefix([]byte(prefix), email.RawMail, email.RawSize)
+}
+
+// line ending of first line
+
+func lineEnding(rawMail io.ReaderAt, size int64) string {
+	line, _ := bufio.NewReader(io.NewSectionReader(rawMail, 0, size)).ReadSlice('\n')
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// Received header (RFC 5321 s4.4), recipient is only shown for single
+// recipient emails
+
+func receivedHeader(envelop *smtpd.BasicEnvelope) string {
+	trace := envelop.Trace
+	if trace == nil {
+		return ""
+	}
+	clientInfo := trace.ClientIP
+	if clientInfo == "" {
+		clientInfo = "unknown"
+	} else {
+		clientInfo = "[" + clientInfo + "]"
+	}
+	if trace.ClientName != "" {
+		clientInfo = trace.ClientName + " " + clientInfo
+	}
+	helo := trace.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	lines := []string{
+		headerFields("Received: from "+headerText(helo), headerComment(clientInfo)),
+		fmt.Sprintf("\tby %s (Falcon) with %s id %s", trace.ServerName, trace.Protocol, trace.QueueID),
+	}
+	if trace.TLSVersion != "" {
+		tls := "using " + trace.TLSVersion
+		if trace.TLSCipher != "" {
+			tls += " with cipher " + trace.TLSCipher
+		}
+		lines = append(lines, "\t"+headerComment(tls))
+	}
+	date := trace.ReceivedAt.Format(RFC5322_DATE)
+	if len(envelop.Rcpts) == 1 {
+		lines = append(lines, fmt.Sprintf("\tfor <%s>; %s", headerText(envelop.Rcpts[0].Email()), date))
+	} else {
+		lines[len(lines)-1] += ";"
+		lines = append(lines, "\t"+date)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Authentication-Results header (RFC 8601) with enabled checks. Spam and
+// virus results are only in header if email was scanned.
+
+func authResultsHeader(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail, reports *scanReports) string {
+	var results []string
+	// smtp auth
+	if envelop.Trace != nil && envelop.Trace.AuthMailboxID > 0 {
+		results = append(results, fmt.Sprintf("auth=pass smtp.auth=%d", envelop.Trace.AuthMailboxID))
+	} else if config.Adapter.Auth {
+		results = append(results, "auth=none")
+	}
+	// spf of MAIL FROM and HELO
+	if config.Spf.Enabled {
+		reports := []*spf.Report{envelop.Spf}
+		if envelop.Spf == nil || envelop.Spf.Identity != spf.IDENTITY_HELO {
+			// null sender is checked by HELO already
+			reports = append(reports, envelop.SpfHelo)
+		}
+		for _, report := range reports {
+			if report == nil {
+				continue
+			}
+			property := "smtp.mailfrom"
+			if report.Identity == spf.IDENTITY_HELO {
+				property = "smtp.helo"
+			}
+			results = append(results, headerFields("spf="+string(report.Result), headerComment(report.Explanation), property+"="+headerValue(report.Domain)))
+		}
+	}
+	// dkim
+	if config.Dkim.Enabled {
+		dkimReports := reports.dkim(config, email)
+		if len(dkimReports) == 0 {
+			results = append(results, "dkim=none")
+		}
+		for _, report := range dkimReports {
+			results = append(results, headerFields("dkim="+string(report.Result), headerComment(report.Reason), "header.d="+headerValue(report.Domain), "header.s="+headerValue(report.Selector)))
+		}
+	}
+	// dmarc
+	if config.Dmarc.Enabled {
+		report := reports.dmarc(config, envelop, email)
+		result := fmt.Sprintf("dmarc=%s", report.Result)
+		if report.Policy != "" {
+			result += fmt.Sprintf(" (p=%s pct=%d)", report.Policy, report.Percent)
+		}
+		results = append(results, result+" header.from="+headerValue(report.Domain))
+	}
+	// spamassassin
+	if reports.spamChecked {
+		results = append(results, spamResult(reports.spamReport, reports.spamErr))
+	}
+	// clamav
+	if reports.virusChecked {
+		switch {
+		case reports.virusErr != nil:
+			results = append(results, "x-virus=temperror")
+		case reports.virusReport != "":
+			results = append(results, headerFields("x-virus=fail", headerComment(reports.virusReport)))
+		default:
+			results = append(results, "x-virus=pass")
+		}
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	serverName := config.Adapter.Hostname
+	if envelop.Trace != nil {
+		serverName = envelop.Trace.ServerName
+	}
+	return "Authentication-Results: " + serverName + ";\n\t" + strings.Join(results, ";\n\t")
+}
+
+// X-Falcon-Dnsbl header if score of listings reaches tag score
+
+func dnsblHeader(config *config.Config, envelop *smtpd.BasicEnvelope) string {
+	result := envelop.Dnsbl
+	if !config.Dnsbl.Enabled || result == nil {
+		return ""
+	}
+	action := result.Action(config.Dnsbl.Reject_Score, config.Dnsbl.Tag_Score)
+	if action != dnsbl.ACTION_TAG && action != dnsbl.ACTION_REJECT {
+		return ""
+	}
+	listings := []string{}
+	for _, listing := range result.Listings {
+		listings = append(listings, fmt.Sprintf("%s=%s", headerValue(listing.Zone), strings.Join(listing.Codes, ",")))
+	}
+	return fmt.Sprintf("X-Falcon-Dnsbl: score=%d; %s", result.Score, strings.Join(listings, "; "))
+}
+
+func spamResult(report string, err error) string {
+	if err != nil {
+		return "x-spam=temperror"
+	}
+	var response spamassassin.SpamassassinResponse
+	if err := json.Unmarshal([]byte(report), &response); err != nil {
+		return "x-spam=temperror"
+	}
+	result := "pass"
+	if response.Spam {
+		result = "fail"
+	}
+	return fmt.Sprintf("x-spam=%s (score=%.1f threshold=%.1f)", result, response.Score, response.Threshold)
+}
+
+// comment in parentheses, nested parentheses are escaped. Empty text
+// has no comment.
+
+func headerComment(text string) string {
+	text = strings.TrimSpace(headerText(text))
+	if text == "" {
+		return ""
+	}
+	text = strings.Replace(text, "\\", "\\\\", -1)
+	text = strings.Replace(text, "(", "\\(", -1)
+	text = strings.Replace(text, ")", "\\)", -1)
+	return "(" + text + ")"
+}
+
+// fields separated by space, empty fields are skipped
+
+func headerFields(fields ...string) string {
+	nonEmpty := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field != "" {
+			nonEmpty = append(nonEmpty, field)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// property value is quoted if it isn't a token
+
+func headerValue(value string) string {
+	value = headerText(value)
+	if value != "" && !strings.ContainsAny(value, " \t;()<>@,:\\\"[]?=") {
+		return value
+	}
+	return "\"" + strings.Replace(strings.Replace(value, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
+
+// text without line breaks, so client data can't inject headers
+
+func headerText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dnsbl"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+func rawEmail(raw string) *parser.ParsedEmail {
+	return &parser.ParsedEmail{RawMail: strings.NewReader(raw), RawSize: int64(len(raw))}
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(data)
+}
+
+func TestAddTraceHeaders(t *testing.T) {
+	serverConfig := config.NewConfig()
+	serverConfig.Adapter.Auth = true
+	serverConfig.Spf.Enabled = true
+	envelop := &smtpd.BasicEnvelope{
+		Rcpts:   []smtpd.MailAddress{smtpd.NewMailAddress("to@example.com")},
+		Spf:     &spf.Report{Identity: spf.IDENTITY_MAILFROM, Domain: "example.org", Result: spf.FAIL, Explanation: "domain (example.org) says no"},
+		SpfHelo: &spf.Report{Identity: spf.IDENTITY_HELO, Domain: "mail.example.org", Result: spf.PASS, Explanation: "ok"},
+		Trace: &smtpd.Trace{
+			Helo:          "client\r\nX-Injected: yes",
+			ClientIP:      "192.0.2.1",
+			ServerName:    "falcon.test",
+			Protocol:      "ESMTPSA",
+			TLSVersion:    "TLS 1.3",
+			TLSCipher:     "TLS_AES_128_GCM_SHA256",
+			AuthMailboxID: 12,
+			QueueID:       "0123456789AB",
+			ReceivedAt:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	}
+	email := rawEmail("Subject: test\r\n\r\nbody\r\n")
+	reports := &scanReports{spamChecked: true, spamReport: `{"Spam":true,"Score":7.5,"Threshold":5}`, virusChecked: true}
+	expected := "Authentication-Results: falcon.test;\r\n" +
+		"\tauth=pass smtp.auth=12;\r\n" +
+		"\tspf=fail (domain \\(example.org\\) says no) smtp.mailfrom=example.org;\r\n" +
+		"\tspf=pass (ok) smtp.helo=mail.example.org;\r\n" +
+		"\tx-spam=fail (score=7.5 threshold=5.0);\r\n" +
+		"\tx-virus=pass\r\n" +
+		"Received: from client  X-Injected: yes ([192.0.2.1])\r\n" +
+		"\tby falcon.test (Falcon) with ESMTPSA id 0123456789AB\r\n" +
+		"\t(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n" +
+		"\tfor <to@example.com>; Thu, 02 Jan 2020 03:04:05 +0000\r\n" +
+		"Subject: test\r\n\r\nbody\r\n"
+	if raw := readAll(t, addTraceHeaders(serverConfig, envelop, email, reports)); raw != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, raw)
+	}
+
+	// LF email, only auth, several recipients
+	serverConfig = config.NewConfig()
+	envelop.Rcpts = append(envelop.Rcpts, smtpd.NewMailAddress("other@example.com"))
+	envelop.Trace.TLSVersion, envelop.Trace.Protocol = "", "SMTP"
+	email = rawEmail("Subject: test\n\nbody\n")
+	raw := readAll(t, addTraceHeaders(serverConfig, envelop, email, &scanReports{}))
+	if !strings.HasPrefix(raw, "Authentication-Results: falcon.test;\n\tauth=pass smtp.auth=12\nReceived: from client") || !strings.HasSuffix(raw, "with SMTP id 0123456789AB;\n\tThu, 02 Jan 2020 03:04:05 +0000\nSubject: test\n\nbody\n") {
+		t.Errorf("unexpected headers:\n%s", raw)
+	}
+}
+
+func TestAuthResultsHeaderEmptyComment(t *testing.T) {
+	serverConfig := config.NewConfig()
+	serverConfig.Spf.Enabled = true
+	envelop := &smtpd.BasicEnvelope{
+		Spf:   &spf.Report{Identity: spf.IDENTITY_HELO, Domain: "mail.example.org", Result: spf.NONE},
+		Trace: &smtpd.Trace{ServerName: "falcon.test"},
+	}
+	expected := "Authentication-Results: falcon.test;\n\tspf=none smtp.helo=mail.example.org"
+	if header := authResultsHeader(serverConfig, envelop, rawEmail(""), &scanReports{}); header != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+	// TLS without cipher
+	envelop.Trace.TLSVersion = "TLS 1.2"
+	if header := receivedHeader(envelop); !strings.Contains(header, "\n\t(using TLS 1.2);\n") {
+		t.Errorf("unexpected header %q", header)
+	}
+}
+
+func TestDnsblHeader(t *testing.T) {
+	serverConfig := config.NewConfig()
+	serverConfig.Dnsbl.Enabled = true
+	serverConfig.Dnsbl.Reject_Score = 10
+	serverConfig.Dnsbl.Tag_Score = 3
+	envelop := &smtpd.BasicEnvelope{Dnsbl: &dnsbl.Result{Score: 4, Listings: []*dnsbl.Listing{
+		{Zone: "bl.example", Query: "2.0.0.127.bl.example", Weight: 3, Codes: []string{"127.0.0.2", "127.0.0.4"}},
+		{Zone: "dbl.example", Query: "spam.example.dbl.example", Weight: 1, Codes: []string{"127.0.1.2"}},
+	}}}
+	expected := "X-Falcon-Dnsbl: score=4; bl.example=127.0.0.2,127.0.0.4; dbl.example=127.0.1.2"
+	if header := dnsblHeader(serverConfig, envelop); header != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+	// below tag score listings are only recorded
+	serverConfig.Dnsbl.Tag_Score = 5
+	if header := dnsblHeader(serverConfig, envelop); header != "" {
+		t.Errorf("unexpected header %q", header)
+	}
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spool"
+)
+
+const (
+	RETRY_MAX_DELAY = 3600 // seconds between attempts of spool entry
+)
+
+// spool entries, which failed to be stored, wait here for next attempt.
+// Entries are loaded from spool again, when their time comes.
+
+type retryQueue struct {
+	config    *config.Config
+	channel   chan *smtpd.BasicEnvelope
+	mailSpool *spool.Spool
+
+	mu      sync.Mutex
+	stopped bool
+	timers  map[string]*time.Timer
+	sending sync.WaitGroup
+}
+
+func newRetryQueue(config *config.Config, channel chan *smtpd.BasicEnvelope, mailSpool *spool.Spool) *retryQueue {
+	return &retryQueue{
+		config:    config,
+		channel:   channel,
+		mailSpool: mailSpool,
+		timers:    make(map[string]*time.Timer),
+	}
+}
+
+// delay before next attempt, doubled on every failed attempt
+
+func (q *retryQueue) delay(attempts int) time.Duration {
+	delay := time.Duration(q.config.Spool.Retry_Delay) * time.Second
+	for i := 1; i < attempts && delay < RETRY_MAX_DELAY*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > RETRY_MAX_DELAY*time.Second {
+		delay = RETRY_MAX_DELAY * time.Second
+	}
+	return delay
+}
+
+// schedule next attempt of entry, after stop entry waits for next start
+
+func (q *retryQueue) schedule(envelop *smtpd.BasicEnvelope) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped || envelop.SpoolID == "" {
+		return
+	}
+	id, delay := envelop.SpoolID, q.delay(envelop.Attempts)
+	log.Debugf("Spool: retry %s in %v", id, delay)
+	q.timers[id] = time.AfterFunc(delay, func() {
+		q.retry(id)
+	})
+}
+
+func (q *retryQueue) retry(id string) {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	delete(q.timers, id)
+	q.sending.Add(1)
+	q.mu.Unlock()
+	defer q.sending.Done()
+
+	envelop, err := q.mailSpool.Load(id)
+	if err != nil {
+		log.Errorf("Spool retry %s: %v", id, err)
+		return
+	}
+	envelop.QueuedAt = time.Now()
+	q.channel <- envelop
+}
+
+// stop waits for entries, which are being queued, so channel can be
+// closed after it
+
+func (q *retryQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	for id, timer := range q.timers {
+		timer.Stop()
+		delete(q.timers, id)
+	}
+	q.mu.Unlock()
+	q.sending.Wait()
+}
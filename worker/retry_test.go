@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/mailbody"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spool"
+)
+
+func TestRetryDelay(t *testing.T) {
+	serverConfig := config.NewConfig()
+	serverConfig.Spool.Retry_Delay = 60
+	q := newRetryQueue(serverConfig, nil, nil)
+	tests := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		10: RETRY_MAX_DELAY * time.Second,
+	}
+	for attempts, expected := range tests {
+		if delay := q.delay(attempts); delay != expected {
+			t.Errorf("delay(%d) = %v, expected %v", attempts, delay, expected)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	directory, err := ioutil.TempDir("", "falcon-spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+	mailSpool, err := spool.Open(directory)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	serverConfig := config.NewConfig()
+	channel := make(chan *smtpd.BasicEnvelope, 1)
+	q := newRetryQueue(serverConfig, channel, mailSpool)
+
+	envelop := &smtpd.BasicEnvelope{
+		MailboxID: 42,
+		From:      smtpd.NewMailAddress("from@example.com"),
+		Rcpts:     []smtpd.MailAddress{smtpd.NewMailAddress("to@example.com")},
+		MailBody:  mailbody.FromBytes([]byte("Subject: test\r\n\r\nbody\r\n")),
+	}
+	if err := mailSpool.Store(envelop); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	envelop.Attempts = 1
+	if err := mailSpool.MarkStored(envelop); err != nil {
+		t.Fatalf("MarkStored: %v", err)
+	}
+	// first retry is immediate
+	q.schedule(envelop)
+	select {
+	case retried := <-channel:
+		if retried.SpoolID != envelop.SpoolID || retried.Attempts != 1 || retried.QueuedAt.IsZero() {
+			t.Errorf("Unexpected retried envelope: %+v", retried)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Entry is not retried")
+	}
+
+	// nothing is queued after stop
+	serverConfig.Spool.Retry_Delay = 1
+	q.schedule(envelop)
+	q.stop()
+	q.schedule(envelop)
+	select {
+	case <-channel:
+		t.Errorf("Entry is retried after stop")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestUpdateSpoolLmtp(t *testing.T) {
+	directory, err := ioutil.TempDir("", "falcon-spool")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(directory)
+	mailSpool, err := spool.Open(directory)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	serverConfig := config.NewConfig()
+	serverConfig.Spool.Max_Attempts = 5
+	channel := make(chan *smtpd.BasicEnvelope, 1)
+	q := newRetryQueue(serverConfig, channel, mailSpool)
+	defer q.stop()
+	results := map[int]error{1: nil, 2: errors.New("connection refused")}
+
+	for _, lmtp := range []bool{false, true} {
+		envelop := &smtpd.BasicEnvelope{
+			MailboxID: 42,
+			From:      smtpd.NewMailAddress("from@example.com"),
+			Rcpts:     []smtpd.MailAddress{smtpd.NewMailAddress("to@example.com")},
+			MailBody:  mailbody.FromBytes([]byte("Subject: test\r\n\r\nbody\r\n")),
+		}
+		if err := mailSpool.Store(envelop); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if lmtp {
+			envelop.ExpectDelivery()
+		}
+		updateSpool(serverConfig, envelop, mailSpool, q, results)
+		_, loadErr := mailSpool.Load(envelop.SpoolID)
+		if lmtp {
+			// client sends email again after 451
+			if loadErr == nil || envelop.Attempts != 0 {
+				t.Errorf("LMTP entry is kept for retry, attempts %d", envelop.Attempts)
+			}
+			select {
+			case <-channel:
+				t.Errorf("LMTP entry is retried")
+			case <-time.After(100 * time.Millisecond):
+			}
+		} else {
+			if loadErr != nil || envelop.Attempts != 1 {
+				t.Errorf("Entry isn't kept for retry: %v, attempts %d", loadErr, envelop.Attempts)
+			}
+			select {
+			case <-channel:
+			case <-time.After(time.Second):
+				t.Errorf("Entry is not retried")
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+)
+
+// Stats of storage workers. Wait is time the last dequeued email
+// waited in queue, last dequeue is start time until first email.
+type Stats struct {
+	Busy        int
+	Stored      int64
+	Failed      int64
+	LastWait    time.Duration
+	LastDequeue time.Time
+}
+
+var (
+	stats   Stats
+	statsMu sync.Mutex
+)
+
+// GetStats returns copy of worker stats
+
+func GetStats() Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return stats
+}
+
+func statsStarted() {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.LastDequeue = time.Now()
+}
+
+// worker took email from queue
+
+func statsDequeued(envelop *smtpd.BasicEnvelope) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Busy++
+	stats.LastDequeue = time.Now()
+	if !envelop.QueuedAt.IsZero() {
+		stats.LastWait = stats.LastDequeue.Sub(envelop.QueuedAt)
+	}
+}
+
+// worker finished email, failed if some inbox didn't get it
+
+func statsDone(results map[int]error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Busy--
+	for _, err := range results {
+		if err != nil {
+			stats.Failed++
+			return
+		}
+	}
+	stats.Stored++
+}
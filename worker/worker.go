@@ -1,104 +1,372 @@
 package worker
 
 import (
+	"database/sql"
+	"encoding/json"
 	"github.com/Polymail/go-falcon/clamav"
 	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dkim"
+	"github.com/Polymail/go-falcon/dmarc"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/parser"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
 	"github.com/Polymail/go-falcon/redisworker"
 	"github.com/Polymail/go-falcon/spamassassin"
+	"github.com/Polymail/go-falcon/spool"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	errMailboxUnavailable = smtpd.SMTPError("550 5.1.1 Error: mailbox unavailable")
+)
+
+// Workers of storage queue with retries of failed spool entries
+
+type Workers struct {
+	wg      sync.WaitGroup
+	retries *retryQueue
+}
+
+// StopRetries stops queueing failed spool entries, after it channel
+// can be closed. Entries wait in spool for next start.
+
+func (w *Workers) StopRetries() {
+	if w.retries != nil {
+		w.retries.stop()
+	}
+}
+
+// Wait until channel is closed and drained
+
+func (w *Workers) Wait() {
+	w.wg.Wait()
+}
+
 // start worker
-func startParserAndStorageWorker(config *config.Config, channel chan *smtpd.BasicEnvelope) {
+func startParserAndStorageWorker(config *config.Config, channel chan *smtpd.BasicEnvelope, mailSpool *spool.Spool, retries *retryQueue, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Debugf("Starting storage worker")
+	for envelop := range channel {
+		statsDequeued(envelop)
+		results := storeEnvelope(config, envelop, mailSpool, retries)
+		statsDone(results)
+		// LMTP session wait for this result
+		envelop.Delivered(results)
+		// temp file of email is removed
+		if err := envelop.Discard(); err != nil {
+			log.Errorf("Email data: %v", err)
+		}
+	}
+}
+
+// reports from spam and virus scanners, shared by all inboxes
+
+type scanReports struct {
+	spamChecked  bool
+	spamReport   string
+	spamErr      error
+	virusChecked bool
+	virusReport  string
+	virusErr     error
+	dkimChecked  bool
+	dkimReports  []*dkim.Report
+	dmarcReport  *dmarc.Report
+}
+
+func (r *scanReports) spam(config *config.Config, email *parser.ParsedEmail) (string, error) {
+	if !r.spamChecked {
+		r.spamReport, r.spamErr = spamassassin.CheckSpamEmail(config, email.RawMail, email.RawSize)
+		r.spamChecked = true
+	}
+	return r.spamReport, r.spamErr
+}
+
+func (r *scanReports) viruses(config *config.Config, email *parser.ParsedEmail) (string, error) {
+	if !r.virusChecked {
+		r.virusReport, r.virusErr = clamav.CheckEmailForViruses(config, email.RawMail, email.RawSize)
+		r.virusChecked = true
+	}
+	return r.virusReport, r.virusErr
+}
+
+// dkim signatures are verified only if email has them
+
+func (r *scanReports) dkim(config *config.Config, email *parser.ParsedEmail) []*dkim.Report {
+	if !r.dkimChecked {
+		r.dkimReports = []*dkim.Report{}
+		if email.Headers.Get(dkim.SIGNATURE_HEADER) != "" {
+			r.dkimReports = dkim.Verify(config.Resolver, email.RawMail, email.RawSize)
+		}
+		r.dkimChecked = true
+	}
+	return r.dkimReports
+}
+
+// dmarc of header From domain, uses SPF result of session and DKIM reports
+
+func (r *scanReports) dmarc(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) *dmarc.Report {
+	if r.dmarcReport == nil {
+		fromDomain := ""
+		if i := strings.LastIndex(email.From.Address, "@"); i >= 0 {
+			fromDomain = email.From.Address[i+1:]
+		}
+		r.dmarcReport = dmarc.Check(config.Resolver, fromDomain, envelop.Spf, r.dkim(config, email))
+	}
+	return r.dmarcReport
+}
+
+// parse email once and store copy in every inbox, return result by inbox
+
+func storeEnvelope(config *config.Config, envelop *smtpd.BasicEnvelope, mailSpool *spool.Spool, retries *retryQueue) map[int]error {
+	mailboxIds := envelop.MailboxIDs()
+	results := make(map[int]error, len(mailboxIds))
+
+	// parse email
+	email, err := parser.ParseMail(envelop)
+	if err != nil {
+		log.Errorf("ParseMail: %v", err)
+		// invalid email never be stored
+		if mailSpool != nil {
+			if err := mailSpool.Fail(envelop.SpoolID); err != nil {
+				log.Errorf("Spool fail: %v", err)
+			}
+		}
+		for _, mailboxId := range mailboxIds {
+			results[mailboxId] = smtpd.SMTPError("554 5.6.0 Error: invalid message")
+		}
+		return results
+	}
+
+	reports := &scanReports{}
+	for _, mailboxId := range mailboxIds {
+		results[mailboxId] = storeInInbox(config, envelop, email, mailboxId, reports)
+		if results[mailboxId] == nil {
+			envelop.StoredMailboxes = append(envelop.StoredMailboxes, mailboxId)
+		}
+	}
+	if mailSpool != nil {
+		updateSpool(config, envelop, mailSpool, retries, results)
+	}
+	return results
+}
+
+// remove stored spool entry, retry or fail it after failed inboxes
+
+func updateSpool(config *config.Config, envelop *smtpd.BasicEnvelope, mailSpool *spool.Spool, retries *retryQueue, results map[int]error) {
+	failed, temporary := false, false
+	for _, err := range results {
+		if err != nil {
+			failed = true
+			temporary = temporary || !isPermanentError(err)
+		}
+	}
+	switch {
+	case !failed:
+		// email is in database, remove it from spool
+		if err := mailSpool.Remove(envelop.SpoolID); err != nil {
+			log.Errorf("Spool remove: %v", err)
+		}
+	case envelop.DeliveryExpected():
+		// LMTP client gets error for failed inboxes and sends email
+		// again, retry would store it twice
+		if err := mailSpool.Remove(envelop.SpoolID); err != nil {
+			log.Errorf("Spool remove: %v", err)
+		}
+	case envelop.Attempts+1 >= config.Spool.Max_Attempts || !temporary:
+		// retry can't help, keep email for admin
+		log.Errorf("Spool: entry %s is not stored after %d attempts", envelop.SpoolID, envelop.Attempts+1)
+		if err := mailSpool.Fail(envelop.SpoolID); err != nil {
+			log.Errorf("Spool fail: %v", err)
+		}
+	default:
+		// spool entry is retried for failed inboxes only
+		envelop.Attempts++
+		if err := mailSpool.MarkStored(envelop); err != nil {
+			log.Errorf("Spool mark stored: %v", err)
+		}
+		retries.schedule(envelop)
+	}
+}
+
+// permanent errors: inbox doesn't exist or reply is 5xx
+
+func isPermanentError(err error) bool {
+	if smtpErr, ok := err.(smtpd.SMTPError); ok {
+		return strings.HasPrefix(string(smtpErr), "5")
+	}
+	return false
+}
+
+// store parsed email in inbox, return error if email was not stored
+
+func storeInInbox(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail, mailboxId int, reports *scanReports) error {
 	var (
-		email     *parser.ParsedEmail
 		report    string
 		messageId int
+		err       error
 	)
-	log.Debugf("Starting storage worker")
-	for {
-		envelop := <-channel
-
-		// get settings
-		inboxSettings, err := redisworker.GetCachedInboxSettings(config, envelop.MailboxID)
-		if err != nil || 0 == inboxSettings.MaxMessages || 0 == inboxSettings.RateLimit {
-			// inbox setting from database
-			inboxSettings, err = config.DbPool.GeInboxSettings(envelop.MailboxID)
-			// check settings
+
+	// get settings
+	inboxSettings, ok := config.SettingsCache.GetInboxSettings(mailboxId)
+	if !ok || 0 == inboxSettings.MaxMessages || 0 == inboxSettings.RateLimit {
+		// inbox setting from database
+		inboxSettings, err = config.DbPool.GeInboxSettings(mailboxId)
+		// check settings
+		if err == sql.ErrNoRows {
+			// inbox is removed
+			return errMailboxUnavailable
+		} else if err != nil {
+			// invalid settings, spool entry is retried
+			return err
+		} else {
+			// cache setting
+			config.SettingsCache.StoreInboxSettings(mailboxId, inboxSettings)
+		}
+	}
+	// mass mailing is not scanned
+	scan := config.CampaignCounter.IsNotSpamAttackCampaign(mailboxId)
+	if scan {
+		// scan before storing, results are in Authentication-Results header
+		if config.Spamassassin.Enabled {
+			if _, err := reports.spam(config, email); err != nil {
+				log.Errorf("CheckSpamEmail: %v", err)
+			}
+		}
+		if config.Clamav.Enabled {
+			if _, err := reports.viruses(config, email); err != nil {
+				log.Errorf("CheckEmailForViruses: %v", err)
+			}
+		}
+	}
+	rawMail := addTraceHeaders(config, envelop, email, reports)
+	messageId, err = config.DbPool.StoreMail(mailboxId, email.Subject, email.Date, email.From.Address, email.From.Name, email.To.Address, email.To.Name, email.HtmlPart, email.TextPart, rawMail, rawMail.Size())
+	if err != nil {
+		log.Errorf("StoreMail: %v", err)
+		return err
+	}
+	// store attachments
+	for _, attachment := range email.Attachments {
+		_, err := config.DbPool.StoreAttachment(mailboxId, messageId, attachment.AttachmentFileName, attachment.AttachmentType, attachment.AttachmentContentType, attachment.AttachmentContentID, attachment.AttachmentTransferEncoding, attachment.AttachmentBody)
+		if err != nil {
+			log.Errorf("StoreAttachment: %v", err)
+		}
+	}
+
+	// spf result from session
+	if config.Spf.Enabled && envelop.Spf != nil {
+		_, err = config.DbPool.UpdateSpfReport(mailboxId, messageId, string(envelop.Spf.Result), envelop.Spf.Explanation)
+		if err != nil {
+			log.Errorf("UpdateSpfReport: %v", err)
+		}
+	}
+	if config.Spf.Enabled && envelop.SpfHelo != nil && config.Storage.Spf_Helo_Sql != "" {
+		_, err = config.DbPool.UpdateSpfHeloReport(mailboxId, messageId, string(envelop.SpfHelo.Result), envelop.SpfHelo.Explanation)
+		if err != nil {
+			log.Errorf("UpdateSpfHeloReport: %v", err)
+		}
+	}
+	// dnsbl listings from session
+	if config.Dnsbl.Enabled && envelop.Dnsbl != nil && len(envelop.Dnsbl.Listings) > 0 {
+		listings, err := json.Marshal(envelop.Dnsbl.Listings)
+		if err == nil {
+			_, err = config.DbPool.UpdateDnsblReport(mailboxId, messageId, envelop.Dnsbl.Score, string(listings))
 			if err != nil {
-				// invalid settings
-				continue
+				log.Errorf("UpdateDnsblReport: %v", err)
+			}
+		} else {
+			log.Errorf("DNSBL report: %v", err)
+		}
+	}
+
+	//cleanup messages
+	config.DbPool.CleanupMessages(mailboxId, inboxSettings)
+	// redis counter
+	if messageId > 0 && scan {
+		// spamassassin
+		if config.Spamassassin.Enabled {
+			report, err = reports.spam(config, email)
+			if err == nil {
+				// update spam info
+				_, err = config.DbPool.UpdateSpamReport(mailboxId, messageId, report)
+				if err != nil {
+					log.Errorf("UpdateSpamReport: %v", err)
+				}
+			}
+		}
+		// dkim
+		if config.Dkim.Enabled {
+			report, err := json.Marshal(reports.dkim(config, email))
+			if err == nil {
+				_, err = config.DbPool.UpdateDkimReport(mailboxId, messageId, string(report))
+				if err != nil {
+					log.Errorf("UpdateDkimReport: %v", err)
+				}
 			} else {
-				// cache setting in redis
-				redisworker.StoreCachedInboxSettings(config, envelop.MailboxID, inboxSettings)
+				log.Errorf("DKIM report: %v", err)
 			}
 		}
-		// parse email
-		email, err = parser.ParseMail(envelop)
-		if err == nil {
-			messageId, err = config.DbPool.StoreMail(email.MailboxID, email.Subject, email.Date, email.From.Address, email.From.Name, email.To.Address, email.To.Name, email.HtmlPart, email.TextPart, email.RawMail)
-			// store attachments
+		// dmarc
+		if config.Dmarc.Enabled {
+			report := reports.dmarc(config, envelop, email)
+			_, err = config.DbPool.UpdateDmarcReport(mailboxId, messageId, string(report.Result), report.Policy, report.Reason)
+			if err != nil {
+				log.Errorf("UpdateDmarcReport: %v", err)
+			}
+		}
+		// clamav
+		if config.Clamav.Enabled {
+			report, err = reports.viruses(config, email)
 			if err == nil {
-				for _, attachment := range email.Attachments {
-					_, err := config.DbPool.StoreAttachment(email.MailboxID, messageId, attachment.AttachmentFileName, attachment.AttachmentType, attachment.AttachmentContentType, attachment.AttachmentContentID, attachment.AttachmentTransferEncoding, attachment.AttachmentBody)
+				if len(report) > 0 {
+					// update viruses info
+					_, err = config.DbPool.UpdateVirusesReport(mailboxId, messageId, report)
 					if err != nil {
-						log.Errorf("StoreAttachment: %v", err)
-					}
-				}
-
-				//cleanup messages
-				config.DbPool.CleanupMessages(email.MailboxID, inboxSettings)
-				// redis counter
-				if messageId > 0 && redisworker.IsNotSpamAttackCampaign(config, envelop.MailboxID) {
-					// spamassassin
-					if config.Spamassassin.Enabled {
-						report, err = spamassassin.CheckSpamEmail(config, email.RawMail)
-						if err == nil {
-							// update spam info
-							_, err = config.DbPool.UpdateSpamReport(email.MailboxID, messageId, report)
-							if err != nil {
-								log.Errorf("UpdateSpamReport: %v", err)
-							}
-						} else {
-							log.Errorf("CheckSpamEmail: %v", err)
-						}
-					}
-					// clamav
-					if config.Clamav.Enabled {
-						report, err = clamav.CheckEmailForViruses(config, email.RawMail)
-						if err == nil {
-							if len(report) > 0 {
-								// update viruses info
-								_, err = config.DbPool.UpdateVirusesReport(email.MailboxID, messageId, report)
-								if err != nil {
-									log.Errorf("UpdateVirusesReport: %v", err)
-								}
-							}
-						} else {
-							log.Errorf("CheckEmailForViruses: %v", err)
-						}
-					}
-					// redis hooks
-					if config.Redis.Enabled {
-						redisworker.SendNotifications(config, email.MailboxID, messageId, email.Subject)
+						log.Errorf("UpdateVirusesReport: %v", err)
 					}
 				}
-
-			} else {
-				log.Errorf("StoreMail: %v", err)
 			}
-
-		} else {
-			log.Errorf("ParseMail: %v", err)
+		}
+		// redis hooks
+		if config.Redis.Enabled {
+			redisworker.SendNotifications(config, mailboxId, messageId, email.Subject)
 		}
 	}
+	return nil
 }
 
-// workers
-func StartWorkers(config *config.Config, channel chan *smtpd.BasicEnvelope) {
+// workers, which are done when channel is closed and drained
+func StartWorkers(config *config.Config, channel chan *smtpd.BasicEnvelope, mailSpool *spool.Spool) *Workers {
+	workers := &Workers{}
+	if mailSpool != nil {
+		workers.retries = newRetryQueue(config, channel, mailSpool)
+	}
+	statsStarted()
 	for i := 0; i < config.Adapter.Workers_Size; i++ {
-		go startParserAndStorageWorker(config, channel)
+		workers.wg.Add(1)
+		go startParserAndStorageWorker(config, channel, mailSpool, workers.retries, &workers.wg)
+	}
+	if mailSpool != nil {
+		replaySpool(channel, mailSpool)
+	}
+	return workers
+}
+
+// replay emails, which was accepted, but not stored before last stop.
+// Blocks until all entries are queued, so server starts after replay.
+
+func replaySpool(channel chan *smtpd.BasicEnvelope, mailSpool *spool.Spool) {
+	envelopes, err := mailSpool.Unfinished()
+	if err != nil {
+		log.Errorf("Spool replay: %v", err)
+		return
+	}
+	if len(envelopes) > 0 {
+		log.Infof("Spool replay: %d emails", len(envelopes))
+	}
+	for _, envelop := range envelopes {
+		envelop.QueuedAt = time.Now()
+		channel <- envelop
 	}
 }